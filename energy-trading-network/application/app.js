@@ -223,6 +223,36 @@ function generateFakeBlockchainHash() {
     return '0x' + crypto.randomBytes(32).toString('hex');
 }
 
+/**
+ * Convert a kWh amount to the chaincode's integer Wh
+ * @param {number|string} kwh
+ * @returns {number} Wh, rounded to the nearest unit
+ */
+function toWh(kwh) {
+    return Math.round(Number(kwh) * 1000);
+}
+
+/**
+ * Convert a TEC amount (or a TEC/kWh price) to the chaincode's integer millimes
+ * @param {number|string} tec
+ * @returns {number} Millimes, rounded to the nearest unit
+ */
+function toMillimes(tec) {
+    return Math.round(Number(tec) * 1000);
+}
+
+/**
+ * Total price of a trade in TEC, rounded like the chaincode's tradeValue
+ * The value is amount (Wh) x price (millimes/kWh) / 1000 millimes, halves rounded up.
+ * @param {number|string} amountKwh
+ * @param {number|string} pricePerKwh - TEC per kWh
+ * @returns {number} Total price in TEC
+ */
+function tradeTotalPrice(amountKwh, pricePerKwh) {
+    const product = BigInt(toWh(amountKwh)) * BigInt(toMillimes(pricePerKwh));
+    return Number((product + 500n) / 1000n) / 1000;
+}
+
 /**
  * Get network connection and contract (only if blockchain is enabled)
  * @param {string} factoryId - Factory identifier for wallet lookup
@@ -388,11 +418,11 @@ app.post('/api/factory/register', async (req, res) => {
                     'RegisterFactory',
                     factoryId,
                     name,
-                    initBalNum.toString(),
+                    toWh(initBalNum).toString(),
                     energyType,
-                    currencyBalNum.toString(),
-                    dailyConsNum.toString(),
-                    availableNum.toString()
+                    toMillimes(currencyBalNum).toString(),
+                    toWh(dailyConsNum).toString(),
+                    toWh(availableNum).toString()
                 );
                 await gateway.disconnect();
             } catch (e) {
@@ -451,7 +481,7 @@ app.post('/api/energy/mint', async (req, res) => {
         if (blockchainResult) {
             try {
                 const { contract, gateway } = blockchainResult;
-                await contract.submitTransaction('MintEnergyTokens', factoryId, amount.toString());
+                await contract.submitTransaction('MintEnergyTokens', factoryId, toWh(amount).toString());
                 await gateway.disconnect();
             } catch (e) {
                 console.log('Blockchain replication skipped:', e.message);
@@ -537,7 +567,7 @@ app.post('/api/energy/transfer', async (req, res) => {
         if (blockchainResult) {
             try {
                 const { contract, gateway } = blockchainResult;
-                await contract.submitTransaction('TransferEnergy', fromFactoryId, toFactoryId, amount.toString());
+                await contract.submitTransaction('TransferEnergy', fromFactoryId, toFactoryId, toWh(amount).toString());
                 await gateway.disconnect();
             } catch (e) {
                 console.log('Blockchain replication skipped:', e.message);
@@ -558,11 +588,11 @@ app.post('/api/energy/transfer', async (req, res) => {
 /**
  * Create an energy trade between factories
  * POST /api/trade/create
- * Body: { tradeId, sellerId, buyerId, amount, pricePerUnit }
+ * Body: { tradeId, sellerId, buyerId, amount, pricePerUnit, expiresAt?, deliveryStart?, deliveryEnd? }
  */
 app.post('/api/trade/create', async (req, res) => {
     try {
-        let { tradeId, sellerId, buyerId, amount, pricePerUnit } = req.body;
+        let { tradeId, sellerId, buyerId, amount, pricePerUnit, expiresAt, deliveryStart, deliveryEnd } = req.body;
 
         // Validate input
         if (!sellerId || !buyerId || !amount || !pricePerUnit) {
@@ -574,7 +604,7 @@ app.post('/api/trade/create', async (req, res) => {
             tradeId = generateTradeId();
         }
 
-        const totalPrice = parseFloat(amount) * parseFloat(pricePerUnit);
+        const totalPrice = tradeTotalPrice(amount, pricePerUnit);
         const pgAvailable = await isPgConnected();
         
         if (pgAvailable) {
@@ -591,7 +621,7 @@ app.post('/api/trade/create', async (req, res) => {
             try {
                 const { contract, gateway } = blockchainResult;
                 await contract.submitTransaction('CreateEnergyTrade', tradeId, sellerId, buyerId, 
-                    amount.toString(), pricePerUnit.toString());
+                    toWh(amount).toString(), toMillimes(pricePerUnit).toString(), expiresAt || '', deliveryStart || '', deliveryEnd || '');
                 await gateway.disconnect();
             } catch (e) {
                 console.log('Blockchain replication skipped:', e.message);
@@ -609,6 +639,64 @@ app.post('/api/trade/create', async (req, res) => {
     }
 });
 
+/**
+ * Accept a pending energy trade on behalf of the counterparty
+ * POST /api/trade/accept
+ * Body: { tradeId, factoryId }
+ * The ledger only executes trades both sides accepted, so the counterparty's own wallet
+ * identity (named after its factory ID) submits the acceptance.
+ */
+app.post('/api/trade/accept', async (req, res) => {
+    try {
+        const { tradeId, factoryId } = req.body;
+
+        if (!tradeId || !factoryId) {
+            return res.status(400).json({ error: 'Trade ID and factory ID are required' });
+        }
+
+        const pgAvailable = await isPgConnected();
+
+        if (pgAvailable) {
+            const tradeResult = await pgPool.query(
+                'SELECT seller_factory_id, buyer_factory_id FROM trades WHERE trade_id = $1 AND status = $2',
+                [tradeId, 'pending']
+            );
+
+            if (tradeResult.rows.length === 0) {
+                return res.status(404).json({ error: 'Trade not found or no longer pending' });
+            }
+
+            const trade = tradeResult.rows[0];
+            if (factoryId !== trade.seller_factory_id && factoryId !== trade.buyer_factory_id) {
+                return res.status(403).json({ error: `Factory ${factoryId} is not a party to trade ${tradeId}` });
+            }
+        }
+
+        // Accept on the blockchain with the counterparty's identity
+        const blockchainResult = await getContract(factoryId);
+        if (USE_BLOCKCHAIN && !blockchainResult) {
+            return res.status(503).json({ error: `Cannot reach the ledger as ${factoryId}; enroll its identity first` });
+        }
+        if (blockchainResult) {
+            const { contract, gateway } = blockchainResult;
+            try {
+                await contract.submitTransaction('AcceptTrade', tradeId);
+            } finally {
+                await gateway.disconnect();
+            }
+        }
+
+        res.json({
+            success: true,
+            message: `Trade ${tradeId} accepted by ${factoryId}`,
+            data: { tradeId, factoryId },
+            blockchainTxHash: generateFakeBlockchainHash()
+        });
+    } catch (error) {
+        res.status(500).json({ error: error.message });
+    }
+});
+
 /**
  * Execute a pending energy trade
  * POST /api/trade/execute
@@ -958,7 +1046,7 @@ app.put('/api/factory/:factoryId/available-energy', async (req, res) => {
         if (blockchainResult) {
             try {
                 const { contract, gateway } = blockchainResult;
-                await contract.submitTransaction('UpdateAvailableEnergy', factoryId, availableEnergy.toString());
+                await contract.submitTransaction('UpdateAvailableEnergy', factoryId, toWh(availableEnergy).toString());
                 await gateway.disconnect();
             } catch (e) {
                 console.log('Blockchain replication skipped:', e.message);
@@ -1004,7 +1092,7 @@ app.put('/api/factory/:factoryId/daily-consumption', async (req, res) => {
         if (blockchainResult) {
             try {
                 const { contract, gateway } = blockchainResult;
-                await contract.submitTransaction('UpdateDailyConsumption', factoryId, dailyConsumption.toString());
+                await contract.submitTransaction('UpdateDailyConsumption', factoryId, toWh(dailyConsumption).toString());
                 await gateway.disconnect();
             } catch (e) {
                 console.log('Blockchain replication skipped:', e.message);
@@ -1767,7 +1855,7 @@ app.post('/trades', async (req, res) => {
         
         if (pgAvailable) {
             const tradeId = generateTradeId();
-            const totalPrice = parseFloat(energy_amount) * parseFloat(price_per_kwh);
+            const totalPrice = tradeTotalPrice(energy_amount, price_per_kwh);
             
             await pgPool.query(`
                 INSERT INTO trades (trade_id, seller_factory_id, buyer_factory_id, energy_amount, price_per_kwh, total_price, status, blockchain_tx_hash)
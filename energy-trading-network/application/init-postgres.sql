@@ -100,9 +100,9 @@ CREATE TABLE IF NOT EXISTS trades (
     trade_id VARCHAR(100) UNIQUE NOT NULL,
     seller_factory_id VARCHAR(100) NOT NULL REFERENCES factories_credentials(factory_id) ON DELETE CASCADE,
     buyer_factory_id VARCHAR(100) NOT NULL REFERENCES factories_credentials(factory_id) ON DELETE CASCADE,
-    energy_amount DECIMAL(15,2) NOT NULL,
+    energy_amount DECIMAL(15,3) NOT NULL,  -- kWh, to the Wh as on the ledger
     price_per_kwh DECIMAL(10,4) NOT NULL,
-    total_price DECIMAL(15,2) NOT NULL,
+    total_price DECIMAL(15,3) NOT NULL,  -- TEC, to the millime as on the ledger
     status VARCHAR(20) DEFAULT 'pending',  -- pending, active, completed, cancelled
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
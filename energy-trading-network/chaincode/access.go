@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// FactoryIDAttribute - Enrollment attribute that binds a client certificate to a factory
+const FactoryIDAttribute = "factoryId"
+
+// callerIdentity - MSP ID and certificate ID of the client submitting the transaction
+type callerIdentity struct {
+	MSPID string
+	ID    string
+}
+
+// getCallerIdentity - Read the submitting client's identity from the transaction context
+func getCallerIdentity(ctx contractapi.TransactionContextInterface) (*callerIdentity, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client MSP ID: %v", err)
+	}
+
+	id, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	return &callerIdentity{MSPID: mspID, ID: id}, nil
+}
+
+// isFactoryOwner - Check whether the submitting client owns the factory
+// A client owns a factory when it belongs to the factory's MSP and either its
+// certificate carries a factoryId attribute naming the factory, or its
+// certificate ID is the one the factory was registered with.
+func isFactoryOwner(ctx contractapi.TransactionContextInterface, factory *Factory) (bool, error) {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if factory.OwnerMSP != "" && caller.MSPID == factory.OwnerMSP {
+		attrValue, found, err := ctx.GetClientIdentity().GetAttributeValue(FactoryIDAttribute)
+		if err != nil {
+			return false, fmt.Errorf("failed to read %s attribute: %v", FactoryIDAttribute, err)
+		}
+		if found && attrValue == factory.ID {
+			return true, nil
+		}
+		if caller.ID == factory.OwnerID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// assertFactoryOwner - Reject the call unless the submitting client owns the factory
+func assertFactoryOwner(ctx contractapi.TransactionContextInterface, factory *Factory) error {
+	ok, err := isFactoryOwner(ctx, factory)
+	if err != nil || ok {
+		return err
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("client from %s is not authorized to act for factory %s", caller.MSPID, factory.ID)
+}
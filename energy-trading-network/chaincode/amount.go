@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Amount - Fixed-point integer quantity used for every balance and price in the contract
+// Energy is expressed in Wh, TEC in millimes (1 TEC = 1000 millimes) and prices in
+// millimes per kWh. All arithmetic on amounts goes through the checked helpers below.
+type Amount = int64
+
+const (
+	WhPerKwh       Amount = 1000  // Wh in one kWh
+	MillimesPerTEC Amount = 1000  // Millimes in one TEC
+	BpsPerUnit     Amount = 10000 // Basis points in a whole (1x, or 100%)
+)
+
+// addAmount - Add two amounts, failing on overflow
+func addAmount(a Amount, b Amount) (Amount, error) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, fmt.Errorf("amount overflow: %d + %d", a, b)
+	}
+	return sum, nil
+}
+
+// subAmount - Subtract two amounts, failing on overflow
+func subAmount(a Amount, b Amount) (Amount, error) {
+	diff := a - b
+	if (b > 0 && diff > a) || (b < 0 && diff < a) {
+		return 0, fmt.Errorf("amount overflow: %d - %d", a, b)
+	}
+	return diff, nil
+}
+
+// mulDivAmount - Compute a * b / d for non-negative operands, rounding half up
+// The intermediate product is kept in 128 bits so only the final result can overflow.
+func mulDivAmount(a Amount, b Amount, d Amount) (Amount, error) {
+	if a < 0 || b < 0 || d <= 0 {
+		return 0, fmt.Errorf("invalid operands for %d * %d / %d", a, b, d)
+	}
+
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+
+	// Add d/2 before dividing so that exact halves round up
+	half := uint64(d) / 2
+	lo, carry := bits.Add64(lo, half, 0)
+	hi += carry
+
+	if hi >= uint64(d) {
+		return 0, fmt.Errorf("amount overflow: %d * %d / %d", a, b, d)
+	}
+	quo, _ := bits.Div64(hi, lo, uint64(d))
+	if quo > math.MaxInt64 {
+		return 0, fmt.Errorf("amount overflow: %d * %d / %d", a, b, d)
+	}
+
+	return Amount(quo), nil
+}
+
+// tradeValue - Value in millimes of an energy quantity (Wh) at a price (millimes per kWh)
+// Rounding rule: the exact value energyWh * price / 1000 is rounded to the nearest
+// millime, with exact halves rounded up.
+func tradeValue(energyWh Amount, pricePerKwh Amount) (Amount, error) {
+	return mulDivAmount(energyWh, pricePerKwh, WhPerKwh)
+}
+
+// amountFromDecimal - Convert a legacy floating-point quantity to fixed point
+// scale is the number of fixed-point units per legacy unit (e.g. 1000 Wh per kWh).
+func amountFromDecimal(value float64, scale Amount) (Amount, error) {
+	scaled := math.Round(value * float64(scale))
+	if math.IsNaN(scaled) || scaled >= math.MaxInt64 || scaled < math.MinInt64 {
+		return 0, fmt.Errorf("value %v cannot be represented as a fixed-point amount", value)
+	}
+	return Amount(scaled), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMulDivAmount(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b, d Amount
+		want    Amount
+		wantErr bool
+	}{
+		{name: "exact", a: 200000, b: 1000, d: 1000, want: 200000},
+		{name: "below half rounds down", a: 1, b: 1499, d: 1000, want: 1},
+		{name: "exact half rounds up", a: 1, b: 1500, d: 1000, want: 2},
+		{name: "above half rounds up", a: 1, b: 1501, d: 1000, want: 2},
+		{name: "zero operand", a: 0, b: 1500, d: 1000, want: 0},
+		{name: "odd divisor", a: 2, b: 1, d: 3, want: 1},
+		{name: "wide intermediate product", a: math.MaxInt64, b: 1000, d: 1000, want: math.MaxInt64},
+		{name: "result overflows int64", a: math.MaxInt64, b: 2, d: 1, wantErr: true},
+		{name: "result overflows 64 bits", a: math.MaxInt64, b: math.MaxInt64, d: 1, wantErr: true},
+		{name: "negative operand", a: -1, b: 1000, d: 1000, wantErr: true},
+		{name: "zero divisor", a: 1, b: 1, d: 0, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mulDivAmount(tt.a, tt.b, tt.d)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("mulDivAmount(%d, %d, %d) = %d, want an error", tt.a, tt.b, tt.d, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mulDivAmount(%d, %d, %d): %v", tt.a, tt.b, tt.d, err)
+			}
+			if got != tt.want {
+				t.Errorf("mulDivAmount(%d, %d, %d) = %d, want %d", tt.a, tt.b, tt.d, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTradeValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		energyWh Amount
+		price    Amount
+		want     Amount
+		wantErr  bool
+	}{
+		{name: "whole kWh", energyWh: 150 * WhPerKwh, price: 80, want: 12000},
+		{name: "fraction of a millime rounds down", energyWh: 1, price: 400, want: 0},
+		{name: "half a millime rounds up", energyWh: 1, price: 500, want: 1},
+		{name: "free energy", energyWh: 1000, price: 0, want: 0},
+		{name: "overflow", energyWh: math.MaxInt64, price: 1001, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tradeValue(tt.energyWh, tt.price)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("tradeValue(%d, %d) = %d, want an error", tt.energyWh, tt.price, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tradeValue(%d, %d): %v", tt.energyWh, tt.price, err)
+			}
+			if got != tt.want {
+				t.Errorf("tradeValue(%d, %d) = %d, want %d", tt.energyWh, tt.price, got, tt.want)
+			}
+		})
+	}
+}
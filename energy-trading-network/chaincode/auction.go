@@ -0,0 +1,593 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
+)
+
+// AuctionInterval - Delivery interval traded in a periodic double auction
+type AuctionInterval struct {
+	DocType       string   `json:"docType"`                                      // Record namespace ("auction")
+	ID            string   `json:"id"`                                           // Interval identifier
+	DeliveryStart string   `json:"deliveryStart"`                                // Start of the delivery interval (RFC 3339)
+	DeliveryEnd   string   `json:"deliveryEnd"`                                  // End of the delivery interval (RFC 3339)
+	GateClosure   string   `json:"gateClosure"`                                  // Orders are accepted strictly before this time (RFC 3339)
+	Status        string   `json:"status"`                                       // Auction status (open, cleared)
+	ClearingPrice Amount   `json:"clearingPrice,omitempty" metadata:",optional"` // Uniform price per kWh in millimes
+	ClearedVolume Amount   `json:"clearedVolume,omitempty" metadata:",optional"` // Energy traded at the clearing price in Wh
+	Demand        Amount   `json:"demand,omitempty" metadata:",optional"`        // Bid volume at or above the clearing price in Wh
+	Supply        Amount   `json:"supply,omitempty" metadata:",optional"`        // Ask volume at or below the clearing price in Wh
+	TradeIDs      []string `json:"tradeIds,omitempty" metadata:",optional"`      // Trades produced by clearing
+	CreatedAt     string   `json:"createdAt"`                                    // Creation timestamp
+	ClearedAt     string   `json:"clearedAt,omitempty" metadata:",optional"`     // Clearing timestamp
+	SchemaVersion int      `json:"schemaVersion,omitempty" metadata:",optional"` // Record layout version
+}
+
+// Auction statuses
+const (
+	AuctionStatusOpen    = "open"    // Collecting orders until gate closure
+	AuctionStatusCleared = "cleared" // Cleared; results are final
+)
+
+// auctionKey - Composite key of an auction interval
+func auctionKey(ctx contractapi.TransactionContextInterface, intervalID string) (string, error) {
+	return makeKey(ctx, docTypeAuction, intervalID)
+}
+
+// auctionOrderKey - Composite key of an order's entry in its auction interval
+func auctionOrderKey(ctx contractapi.TransactionContextInterface, offer *Offer) (string, error) {
+	return makeKey(ctx, docTypeBid, offer.IntervalID, offer.OfferType, offer.FactoryID, offer.ID)
+}
+
+// putAuction - Save an auction interval under its composite key
+func putAuction(ctx contractapi.TransactionContextInterface, auction *AuctionInterval) error {
+	key, err := auctionKey(ctx, auction.ID)
+	if err != nil {
+		return err
+	}
+	auction.DocType = docTypeAuction
+	return putRecord(ctx, key, auction)
+}
+
+// removeFromAuction - Take an order out of its auction interval (no-op for other offers)
+func removeFromAuction(ctx contractapi.TransactionContextInterface, offer *Offer) error {
+	if offer.IntervalID == "" {
+		return nil
+	}
+	key, err := auctionOrderKey(ctx, offer)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// assertAuctionOpen - Reject the call unless the auction still accepts order changes
+func assertAuctionOpen(auction *AuctionInterval, timestamp string) error {
+	if auction.Status != AuctionStatusOpen {
+		return fmt.Errorf("auction %s is %s", auction.ID, auction.Status)
+	}
+	if timestamp >= auction.GateClosure {
+		return fmt.Errorf("auction %s closed at %s", auction.ID, auction.GateClosure)
+	}
+	return nil
+}
+
+// OpenAuction - Open a periodic double auction for a delivery interval (operator only)
+// Bids and asks are collected until gate closure, which must fall before delivery starts.
+func (c *EnergyTokenContract) OpenAuction(ctx contractapi.TransactionContextInterface,
+	intervalID string, deliveryStart string, deliveryEnd string, gateClosure string) error {
+
+	if err := assertRole(ctx, RoleOperator); err != nil {
+		return err
+	}
+
+	key, err := auctionKey(ctx, intervalID)
+	if err != nil {
+		return err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read auction: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("auction %s already exists", intervalID)
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	if deliveryStart, err = normalizeTimestamp("delivery start", deliveryStart); err != nil {
+		return err
+	}
+	if deliveryEnd, err = normalizeTimestamp("delivery end", deliveryEnd); err != nil {
+		return err
+	}
+	if gateClosure, err = normalizeTimestamp("gate closure", gateClosure); err != nil {
+		return err
+	}
+	if deliveryEnd <= deliveryStart {
+		return fmt.Errorf("delivery end must be after delivery start")
+	}
+	if gateClosure > deliveryStart {
+		return fmt.Errorf("gate closure must not be after delivery start")
+	}
+	if gateClosure <= txTimestamp {
+		return fmt.Errorf("gate closure %s is not in the future", gateClosure)
+	}
+
+	auction := AuctionInterval{
+		ID:            intervalID,
+		DeliveryStart: deliveryStart,
+		DeliveryEnd:   deliveryEnd,
+		GateClosure:   gateClosure,
+		Status:        AuctionStatusOpen,
+		CreatedAt:     txTimestamp,
+		SchemaVersion: currentSchemaVersion,
+	}
+	if err := putAuction(ctx, &auction); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.AuctionOpened, events.AuctionOpenedEvent{
+		IntervalID:    auction.ID,
+		DeliveryStart: auction.DeliveryStart,
+		DeliveryEnd:   auction.DeliveryEnd,
+		GateClosure:   auction.GateClosure,
+		Timestamp:     txTimestamp,
+	})
+}
+
+// GetAuction - Get an auction interval, including its results once cleared
+func (c *EnergyTokenContract) GetAuction(ctx contractapi.TransactionContextInterface,
+	intervalID string) (*AuctionInterval, error) {
+
+	key, err := auctionKey(ctx, intervalID)
+	if err != nil {
+		return nil, err
+	}
+	auctionJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auction: %v", err)
+	}
+	if auctionJSON == nil {
+		return nil, fmt.Errorf("auction %s does not exist", intervalID)
+	}
+
+	var auction AuctionInterval
+	if err := json.Unmarshal(auctionJSON, &auction); err != nil {
+		return nil, err
+	}
+	return &auction, nil
+}
+
+// SubmitAuctionOrder - Submit a bid or ask to an open auction interval (factory owner only)
+// The order is an offer tied to the interval and reserves funds like any other offer. A
+// factory may only trade on one side of an interval.
+func (c *EnergyTokenContract) SubmitAuctionOrder(ctx contractapi.TransactionContextInterface,
+	orderID string, intervalID string, factoryID string, offerType string,
+	energyAmount Amount, pricePerKwh Amount) error {
+
+	if offerType != OfferTypeBuy && offerType != OfferTypeSell {
+		return fmt.Errorf("offer type must be %s or %s", OfferTypeBuy, OfferTypeSell)
+	}
+	if energyAmount <= 0 {
+		return fmt.Errorf("order energy amount must be positive")
+	}
+	if pricePerKwh < 0 {
+		return fmt.Errorf("price cannot be negative")
+	}
+
+	auction, err := c.GetAuction(ctx, intervalID)
+	if err != nil {
+		return err
+	}
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	if err := assertAuctionOpen(auction, txTimestamp); err != nil {
+		return err
+	}
+
+	factory, err := c.GetFactory(ctx, factoryID)
+	if err != nil {
+		return err
+	}
+	if err := assertFactoryOwner(ctx, factory); err != nil {
+		return err
+	}
+	if err := assertNewOffer(ctx, orderID); err != nil {
+		return err
+	}
+
+	// Keep each factory on one side so clearing never pairs it with itself
+	opposite, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeBid,
+		[]string{intervalID, oppositeSide(offerType), factoryID})
+	if err != nil {
+		return err
+	}
+	hasOpposite := opposite.HasNext()
+	opposite.Close()
+	if hasOpposite {
+		return fmt.Errorf("factory %s already has a %s order in auction %s",
+			factoryID, oppositeSide(offerType), intervalID)
+	}
+
+	order := Offer{
+		ID:            orderID,
+		FactoryID:     factoryID,
+		OfferType:     offerType,
+		EnergyType:    factory.EnergyType,
+		EnergyAmount:  energyAmount,
+		PricePerKwh:   pricePerKwh,
+		Status:        OfferStatusActive,
+		IntervalID:    intervalID,
+		DeliveryStart: auction.DeliveryStart,
+		DeliveryEnd:   auction.DeliveryEnd,
+		CreatedAt:     txTimestamp,
+		UpdatedAt:     txTimestamp,
+		SchemaVersion: currentSchemaVersion,
+	}
+	if err := reserveOffer(factory, &order); err != nil {
+		return err
+	}
+
+	key, err := auctionOrderKey(ctx, &order)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, []byte(order.ID)); err != nil {
+		return err
+	}
+	if err := putFactory(ctx, factory); err != nil {
+		return err
+	}
+	if err := putOffer(ctx, &order); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.OfferCreated, events.OfferCreatedEvent{
+		OfferID:      order.ID,
+		FactoryID:    order.FactoryID,
+		OfferType:    order.OfferType,
+		EnergyType:   order.EnergyType,
+		EnergyAmount: order.EnergyAmount,
+		PricePerKwh:  order.PricePerKwh,
+		Timestamp:    order.CreatedAt,
+	})
+}
+
+// GetAuctionOrders - List the orders of an auction interval
+// Before clearing these are the live orders; afterwards, the orders that took part with
+// their fills. Withdrawn orders are not listed.
+func (c *EnergyTokenContract) GetAuctionOrders(ctx contractapi.TransactionContextInterface,
+	intervalID string) ([]*Offer, error) {
+
+	var orders []*Offer
+	for _, side := range []string{OfferTypeBuy, OfferTypeSell} {
+		sideOrders, err := c.auctionOrders(ctx, intervalID, side)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, sideOrders...)
+	}
+	return orders, nil
+}
+
+// auctionOrders - Load the orders listed on one side of an auction interval
+func (c *EnergyTokenContract) auctionOrders(ctx contractapi.TransactionContextInterface,
+	intervalID string, side string) ([]*Offer, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeBid, []string{intervalID, side})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var orders []*Offer
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		order, err := c.GetOffer(ctx, string(queryResponse.Value))
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+// sortByPricePriority - Order one side best price first, then by offer ID
+// Bids rank highest price first and asks lowest price first; the offer ID makes the
+// order total, so clearing never depends on submission time or iteration order.
+func sortByPricePriority(orders []*Offer) {
+	sort.Slice(orders, func(i, j int) bool {
+		if orders[i].PricePerKwh != orders[j].PricePerKwh {
+			if orders[i].OfferType == OfferTypeBuy {
+				return orders[i].PricePerKwh > orders[j].PricePerKwh
+			}
+			return orders[i].PricePerKwh < orders[j].PricePerKwh
+		}
+		return orders[i].ID < orders[j].ID
+	})
+}
+
+// volumeAt - Energy the orders of one side are willing to trade at a price (Wh)
+func volumeAt(orders []*Offer, price Amount) (Amount, error) {
+	var volume Amount
+	for _, order := range orders {
+		if acceptsPrice(order, price) {
+			var err error
+			if volume, err = addAmount(volume, offerRemaining(order)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return volume, nil
+}
+
+// clearingPrice - Uniform price at which supply meets demand
+// Among the submitted prices, picks the one maximizing traded volume, then minimizing the
+// gap between demand and supply, then the lowest price. Returns the price, demand and
+// supply; a zero traded volume means the auction does not clear.
+func clearingPrice(bids []*Offer, asks []*Offer) (Amount, Amount, Amount, error) {
+	var bestPrice, bestDemand, bestSupply, bestVolume, bestGap Amount
+	found := false
+
+	for _, candidate := range append(append([]*Offer{}, bids...), asks...) {
+		price := candidate.PricePerKwh
+		demand, err := volumeAt(bids, price)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		supply, err := volumeAt(asks, price)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		volume, gap := demand, supply-demand
+		if supply < demand {
+			volume, gap = supply, demand-supply
+		}
+		if volume == 0 {
+			continue
+		}
+		if !found || volume > bestVolume ||
+			(volume == bestVolume && (gap < bestGap || (gap == bestGap && price < bestPrice))) {
+			bestPrice, bestDemand, bestSupply, bestVolume, bestGap = price, demand, supply, volume, gap
+			found = true
+		}
+	}
+
+	return bestPrice, bestDemand, bestSupply, nil
+}
+
+// prorate - Share of whole proportional to part / total, rounded down (part <= total)
+func prorate(part Amount, total Amount, whole Amount) Amount {
+	hi, lo := bits.Mul64(uint64(part), uint64(whole))
+	quo, _ := bits.Div64(hi, lo, uint64(total))
+	return Amount(quo)
+}
+
+// allocateSide - Split volume among the orders of one side that accept the price
+// Orders are served best price first. The orders at the price level where volume runs
+// out share what is left pro rata to their size; the Wh lost to rounding go one each to
+// those orders by ascending offer ID. orders must be sorted by sortByPricePriority.
+func allocateSide(orders []*Offer, price Amount, volume Amount) map[string]Amount {
+	allocations := make(map[string]Amount)
+	remaining := volume
+
+	for start := 0; start < len(orders) && remaining > 0; {
+		if !acceptsPrice(orders[start], price) {
+			break
+		}
+
+		// Collect the price level starting at start
+		end := start
+		var levelTotal Amount
+		for end < len(orders) && orders[end].PricePerKwh == orders[start].PricePerKwh {
+			levelTotal += offerRemaining(orders[end])
+			end++
+		}
+		level := orders[start:end]
+		start = end
+
+		if levelTotal <= remaining {
+			for _, order := range level {
+				allocations[order.ID] = offerRemaining(order)
+			}
+			remaining -= levelTotal
+			continue
+		}
+
+		allocated := Amount(0)
+		for _, order := range level {
+			share := prorate(offerRemaining(order), levelTotal, remaining)
+			allocations[order.ID] = share
+			allocated += share
+		}
+		for _, order := range level {
+			if allocated == remaining {
+				break
+			}
+			if allocations[order.ID] < offerRemaining(order) {
+				allocations[order.ID]++
+				allocated++
+			}
+		}
+		remaining = 0
+	}
+
+	return allocations
+}
+
+// ClearAuction - Clear an auction interval after gate closure at a uniform price
+// Every allocated bid and ask trades at the clearing price, so buyers never pay more and
+// sellers never receive less than their limit. Allocated asks and bids are paired in price
+// priority order to create the trades; unallocated remainders expire and release their
+// reservations. The trades are held in escrow until their delivery is confirmed. Clearing
+// is deterministic, so any client may run it.
+func (c *EnergyTokenContract) ClearAuction(ctx contractapi.TransactionContextInterface,
+	intervalID string) (*AuctionInterval, error) {
+
+	auction, err := c.GetAuction(ctx, intervalID)
+	if err != nil {
+		return nil, err
+	}
+	if auction.Status != AuctionStatusOpen {
+		return nil, fmt.Errorf("auction %s is %s", intervalID, auction.Status)
+	}
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if txTimestamp < auction.GateClosure {
+		return nil, fmt.Errorf("auction %s cannot be cleared before gate closure at %s",
+			intervalID, auction.GateClosure)
+	}
+
+	bids, err := c.auctionOrders(ctx, intervalID, OfferTypeBuy)
+	if err != nil {
+		return nil, err
+	}
+	asks, err := c.auctionOrders(ctx, intervalID, OfferTypeSell)
+	if err != nil {
+		return nil, err
+	}
+	sortByPricePriority(bids)
+	sortByPricePriority(asks)
+	orders := append(append([]*Offer{}, bids...), asks...)
+
+	price, demand, supply, err := clearingPrice(bids, asks)
+	if err != nil {
+		return nil, err
+	}
+	volume := demand
+	if supply < volume {
+		volume = supply
+	}
+	bidAllocations := allocateSide(bids, price, volume)
+	askAllocations := allocateSide(asks, price, volume)
+
+	// Load each factory once; reads within a transaction do not see its own writes
+	factories := make(map[string]*Factory)
+	for _, order := range orders {
+		if _, ok := factories[order.FactoryID]; !ok {
+			factory, err := c.GetFactory(ctx, order.FactoryID)
+			if err != nil {
+				return nil, err
+			}
+			factories[order.FactoryID] = factory
+		}
+	}
+
+	// Pair allocated asks with allocated bids in price priority order
+	var trades []*EnergyTrade
+	bidIndex := 0
+	for _, ask := range asks {
+		for askAllocations[ask.ID] > 0 {
+			for bidAllocations[bids[bidIndex].ID] == 0 {
+				bidIndex++
+			}
+			bid := bids[bidIndex]
+
+			quantity := askAllocations[ask.ID]
+			if bidAllocations[bid.ID] < quantity {
+				quantity = bidAllocations[bid.ID]
+			}
+			askAllocations[ask.ID] -= quantity
+			bidAllocations[bid.ID] -= quantity
+
+			// The bid's fills are valued on its notional, so they stay within its reservation
+			seller, buyer := factories[ask.FactoryID], factories[bid.FactoryID]
+			if _, err := fillOffer(seller, ask, quantity, price); err != nil {
+				return nil, err
+			}
+			totalPrice, err := fillOffer(buyer, bid, quantity, price)
+			if err != nil {
+				return nil, err
+			}
+
+			trade := &EnergyTrade{
+				TradeID:       newTradeID(ctx, len(trades)+1),
+				SellerID:      seller.ID,
+				BuyerID:       buyer.ID,
+				Amount:        quantity,
+				PricePerUnit:  price,
+				TotalPrice:    totalPrice,
+				Timestamp:     txTimestamp,
+				EnergySource:  seller.EnergyType,
+				OfferID:       ask.ID,
+				TakerOfferID:  bid.ID,
+				IntervalID:    intervalID,
+				DeliveryStart: auction.DeliveryStart,
+				DeliveryEnd:   auction.DeliveryEnd,
+				SchemaVersion: currentSchemaVersion,
+			}
+			if err := escrowTrade(seller, buyer, trade, txTimestamp); err != nil {
+				return nil, err
+			}
+			trades = append(trades, trade)
+		}
+	}
+
+	// The interval is closed: expire what was not allocated. The orders stay listed in the
+	// interval as part of its results.
+	for _, order := range orders {
+		if order.Status == OfferStatusActive {
+			if err := releaseOffer(factories[order.FactoryID], order); err != nil {
+				return nil, err
+			}
+			order.Status = OfferStatusExpired
+		}
+		order.UpdatedAt = txTimestamp
+		if err := putOffer(ctx, order); err != nil {
+			return nil, err
+		}
+	}
+	factoryIDs := make([]string, 0, len(factories))
+	for factoryID := range factories {
+		factoryIDs = append(factoryIDs, factoryID)
+	}
+	sort.Strings(factoryIDs)
+	for _, factoryID := range factoryIDs {
+		if err := putFactory(ctx, factories[factoryID]); err != nil {
+			return nil, err
+		}
+	}
+	for _, trade := range trades {
+		if err := putTrade(ctx, trade); err != nil {
+			return nil, err
+		}
+		auction.TradeIDs = append(auction.TradeIDs, trade.TradeID)
+	}
+
+	auction.Status = AuctionStatusCleared
+	auction.ClearedAt = txTimestamp
+	if volume > 0 {
+		auction.ClearingPrice = price
+		auction.ClearedVolume = volume
+		auction.Demand = demand
+		auction.Supply = supply
+	}
+	if err := putAuction(ctx, auction); err != nil {
+		return nil, err
+	}
+
+	return auction, emitEvent(ctx, events.AuctionCleared, events.AuctionClearedEvent{
+		IntervalID:    auction.ID,
+		ClearingPrice: auction.ClearingPrice,
+		ClearedVolume: auction.ClearedVolume,
+		TradeIDs:      auction.TradeIDs,
+		Timestamp:     txTimestamp,
+	})
+}
@@ -0,0 +1,198 @@
+package main
+
+import "testing"
+
+// auctionOrder - Active auction order of energyAmount Wh at a limit price
+func auctionOrder(id string, offerType string, energyAmount Amount, price Amount) *Offer {
+	return &Offer{ID: id, OfferType: offerType, EnergyAmount: energyAmount, PricePerKwh: price, Status: OfferStatusActive}
+}
+
+func TestClearingPrice(t *testing.T) {
+	tests := []struct {
+		name       string
+		bids       []*Offer
+		asks       []*Offer
+		wantPrice  Amount
+		wantDemand Amount
+		wantSupply Amount
+	}{
+		{
+			name: "lowest price among equal volume and gap",
+			bids: []*Offer{auctionOrder("B1", OfferTypeBuy, 500, 300), auctionOrder("B2", OfferTypeBuy, 300, 250)},
+			asks: []*Offer{auctionOrder("A1", OfferTypeSell, 400, 200), auctionOrder("A2", OfferTypeSell, 400, 280)},
+			// 280 and 300 both trade 500 Wh with 300 Wh left over
+			wantPrice: 280, wantDemand: 500, wantSupply: 800,
+		},
+		{
+			name:      "smaller gap beats a lower price",
+			bids:      []*Offer{auctionOrder("B1", OfferTypeBuy, 100, 300), auctionOrder("B2", OfferTypeBuy, 50, 200)},
+			asks:      []*Offer{auctionOrder("A1", OfferTypeSell, 100, 200)},
+			wantPrice: 300, wantDemand: 100, wantSupply: 100,
+		},
+		{
+			name: "no overlap does not clear",
+			bids: []*Offer{auctionOrder("B1", OfferTypeBuy, 100, 100)},
+			asks: []*Offer{auctionOrder("A1", OfferTypeSell, 100, 200)},
+		},
+		{
+			name: "one side empty",
+			bids: []*Offer{auctionOrder("B1", OfferTypeBuy, 100, 100)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			price, demand, supply, err := clearingPrice(tt.bids, tt.asks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if price != tt.wantPrice || demand != tt.wantDemand || supply != tt.wantSupply {
+				t.Errorf("clearingPrice = %d at demand %d, supply %d, want %d at demand %d, supply %d",
+					price, demand, supply, tt.wantPrice, tt.wantDemand, tt.wantSupply)
+			}
+		})
+	}
+}
+
+func TestAllocateSide(t *testing.T) {
+	tests := []struct {
+		name   string
+		orders []*Offer
+		price  Amount
+		volume Amount
+		want   map[string]Amount
+	}{
+		{
+			name: "better prices are served in full first",
+			orders: []*Offer{
+				auctionOrder("B1", OfferTypeBuy, 100, 400),
+				auctionOrder("B2", OfferTypeBuy, 200, 300),
+				auctionOrder("B3", OfferTypeBuy, 100, 300),
+			},
+			price: 300, volume: 250,
+			want: map[string]Amount{"B1": 100, "B2": 100, "B3": 50},
+		},
+		{
+			name: "rounding remainder goes to the lowest IDs",
+			orders: []*Offer{
+				auctionOrder("A1", OfferTypeSell, 100, 200),
+				auctionOrder("A2", OfferTypeSell, 100, 200),
+				auctionOrder("A3", OfferTypeSell, 100, 200),
+			},
+			price: 200, volume: 101,
+			want: map[string]Amount{"A1": 34, "A2": 34, "A3": 33},
+		},
+		{
+			name: "pro rata to remaining size",
+			orders: []*Offer{
+				{ID: "A1", OfferType: OfferTypeSell, EnergyAmount: 500, FilledAmount: 400, PricePerKwh: 200, Status: OfferStatusActive},
+				auctionOrder("A2", OfferTypeSell, 200, 200),
+			},
+			price: 200, volume: 100,
+			want: map[string]Amount{"A1": 34, "A2": 66},
+		},
+		{
+			name: "orders not accepting the price get nothing",
+			orders: []*Offer{
+				auctionOrder("A1", OfferTypeSell, 100, 200),
+				auctionOrder("A2", OfferTypeSell, 100, 300),
+			},
+			price: 250, volume: 100,
+			want: map[string]Amount{"A1": 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sortByPricePriority(tt.orders)
+			got := allocateSide(tt.orders, tt.price, tt.volume)
+
+			var total Amount
+			for _, order := range tt.orders {
+				if got[order.ID] != tt.want[order.ID] {
+					t.Errorf("%s allocated %d Wh, want %d Wh", order.ID, got[order.ID], tt.want[order.ID])
+				}
+				total += got[order.ID]
+			}
+			if total != tt.volume {
+				t.Errorf("allocated %d Wh in total, want %d Wh", total, tt.volume)
+			}
+		})
+	}
+}
+
+func TestClearAuctionTransaction(t *testing.T) {
+	// Both bids clear against the ask at 200, so each buyer keeps 200 millimes in escrow of
+	// what its bid held and the seller keeps all 2000 Wh in escrow
+	ctx := newTestContext(t, "2026-01-01T12:00:00Z")
+	seller, first, second := serializedIdentity(t, "Org1MSP", "client"),
+		serializedIdentity(t, "Org1MSP", "client"), serializedIdentity(t, "Org1MSP", "client")
+	seedFactories(t, ctx,
+		ownFactory(t, ctx, seller, &Factory{ID: "S1", EnergyType: "solar", EnergyBalance: 2000}),
+		ownFactory(t, ctx, first, &Factory{ID: "B1", CurrencyBalance: 1000}),
+		ownFactory(t, ctx, second, &Factory{ID: "B2", CurrencyBalance: 1000}))
+	if err := putAuction(ctx, &AuctionInterval{ID: "I1", DeliveryStart: "2026-01-01T14:00:00Z",
+		DeliveryEnd: "2026-01-01T15:00:00Z", GateClosure: "2026-01-01T13:00:00Z", Status: AuctionStatusOpen}); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, ctx)
+
+	c := new(EnergyTokenContract)
+	for _, order := range []struct {
+		creator   []byte
+		id        string
+		factoryID string
+		offerType string
+		energy    Amount
+		price     Amount
+	}{
+		{creator: seller, id: "ASK", factoryID: "S1", offerType: OfferTypeSell, energy: 2000, price: 200},
+		{creator: first, id: "BID1", factoryID: "B1", offerType: OfferTypeBuy, energy: 1000, price: 300},
+		{creator: second, id: "BID2", factoryID: "B2", offerType: OfferTypeBuy, energy: 1000, price: 250},
+	} {
+		submitAs(t, ctx, order.creator)
+		if err := c.SubmitAuctionOrder(ctx, order.id, "I1", order.factoryID, order.offerType, order.energy, order.price); err != nil {
+			t.Fatal(err)
+		}
+		commit(t, ctx)
+	}
+
+	startTransaction(t, ctx, "2026-01-01T13:00:00Z")
+	auction, err := c.ClearAuction(ctx, "I1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auction.ClearingPrice != 200 || auction.ClearedVolume != 2000 || len(auction.TradeIDs) != 2 {
+		t.Fatalf("cleared %d Wh at %d in %d trades, want 2000 Wh at 200 in 2", auction.ClearedVolume,
+			auction.ClearingPrice, len(auction.TradeIDs))
+	}
+	commit(t, ctx)
+
+	for _, want := range []struct {
+		factoryID string
+		energy    Amount
+		currency  Amount
+	}{
+		{factoryID: "S1", energy: 2000},
+		{factoryID: "B1", currency: 200},
+		{factoryID: "B2", currency: 200},
+	} {
+		factory, err := c.GetFactory(ctx, want.factoryID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if factory.ReservedEnergy != want.energy || factory.ReservedCurrency != want.currency {
+			t.Errorf("%s holds %d Wh, %d millimes, want %d Wh, %d millimes", want.factoryID,
+				factory.ReservedEnergy, factory.ReservedCurrency, want.energy, want.currency)
+		}
+	}
+	for _, tradeID := range auction.TradeIDs {
+		trade, err := c.GetTrade(ctx, tradeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trade.Status != TradeStatusEscrowed || trade.TotalPrice != 200 {
+			t.Errorf("trade %s is %s for %d millimes, want escrowed for 200", tradeID, trade.Status, trade.TotalPrice)
+		}
+	}
+}
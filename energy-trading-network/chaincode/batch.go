@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
+)
+
+// maxBatchSize - Most trades a single SettleBatch call settles
+const maxBatchSize = 200
+
+// NetPosition - Net movement of one factory across a settlement batch once every trade is delivered
+type NetPosition struct {
+	FactoryID string `json:"factoryId"`                           // Factory identifier
+	Energy    Amount `json:"energy"`                              // Energy received in Wh (negative when the factory sells more than it buys)
+	Currency  Amount `json:"currency"`                            // TEC received before fees in millimes (negative when the factory buys more than it sells)
+	Fees      Amount `json:"fees,omitempty" metadata:",optional"` // Platform fees on the factory's sales in millimes
+}
+
+// BatchSettlement - Netted settlement batch, held in escrow until its delivery is confirmed
+// Each factory holds only its net debit across the batch: the energy it sells beyond what
+// it buys, and the TEC it pays beyond what it receives net of fees.
+type BatchSettlement struct {
+	DocType              string                `json:"docType"`                                             // Record namespace ("batch")
+	BatchID              string                `json:"batchId"`                                             // Transaction ID of the settlement
+	TradeIDs             []string              `json:"tradeIds"`                                            // Trades escrowed, in the order given
+	Value                Amount                `json:"value"`                                               // Gross value of the trades held in escrow in millimes
+	Fees                 Amount                `json:"fees"`                                                // Platform fees set on the trades in millimes
+	Positions            []*NetPosition        `json:"positions"`                                           // Net position of each factory, by factory ID
+	Status               string                `json:"status"`                                              // Batch status, shared by its trades (escrowed, completed, refunded)
+	DeliveryStart        string                `json:"deliveryStart,omitempty" metadata:",optional"`        // Latest delivery slot start of the trades; delivery is confirmed from then
+	DeliveryDeadline     string                `json:"deliveryDeadline"`                                    // Last moment delivery of the batch can be confirmed (RFC 3339)
+	DeliveryConfirmation *DeliveryConfirmation `json:"deliveryConfirmation,omitempty" metadata:",optional"` // Identity that confirmed delivery
+	Timestamp            string                `json:"timestamp"`                                           // Transaction timestamp
+	SchemaVersion        int                   `json:"schemaVersion,omitempty" metadata:",optional"`        // Record layout version
+}
+
+// batchKey - Ledger key of a settlement batch
+func batchKey(ctx contractapi.TransactionContextInterface, batchID string) (string, error) {
+	return makeKey(ctx, docTypeBatch, batchID)
+}
+
+// putBatch - Save a settlement batch under its composite key
+func putBatch(ctx contractapi.TransactionContextInterface, batch *BatchSettlement) error {
+	key, err := batchKey(ctx, batch.BatchID)
+	if err != nil {
+		return err
+	}
+	batch.DocType = docTypeBatch
+	return putRecord(ctx, key, batch)
+}
+
+// batchHolds - Energy (Wh) and TEC (millimes) a factory holds in escrow for a batch
+// It is the factory's net debit on each balance, zero for a net creditor.
+func batchHolds(position *NetPosition) (Amount, Amount, error) {
+	var energy, currency Amount
+	if position.Energy < 0 {
+		energy = -position.Energy
+	}
+	net, err := subAmount(position.Currency, position.Fees)
+	if err != nil {
+		return 0, 0, err
+	}
+	if net < 0 {
+		currency = -net
+	}
+	return energy, currency, nil
+}
+
+// parseTradeIDs - Parse a comma-separated list of trade IDs, rejecting blanks and duplicates
+func parseTradeIDs(value string) ([]string, error) {
+	seen := make(map[string]bool)
+	var tradeIDs []string
+	for _, tradeID := range strings.Split(value, ",") {
+		tradeID = strings.TrimSpace(tradeID)
+		if tradeID == "" {
+			return nil, fmt.Errorf("trade IDs must be a comma-separated list without blanks")
+		}
+		if seen[tradeID] {
+			return nil, fmt.Errorf("trade %s is listed more than once", tradeID)
+		}
+		seen[tradeID] = true
+		tradeIDs = append(tradeIDs, tradeID)
+	}
+
+	if len(tradeIDs) > maxBatchSize {
+		return nil, fmt.Errorf("a batch can settle at most %d trades", maxBatchSize)
+	}
+	return tradeIDs, nil
+}
+
+// netPositions - Net movement of each factory across trades delivered in full, by factory ID
+func netPositions(trades []*EnergyTrade) ([]*NetPosition, error) {
+	byFactory := make(map[string]*NetPosition)
+	position := func(factoryID string) *NetPosition {
+		if _, ok := byFactory[factoryID]; !ok {
+			byFactory[factoryID] = &NetPosition{FactoryID: factoryID}
+		}
+		return byFactory[factoryID]
+	}
+
+	var err error
+	for _, trade := range trades {
+		seller, buyer := position(trade.SellerID), position(trade.BuyerID)
+		if seller.Energy, err = subAmount(seller.Energy, trade.Amount); err != nil {
+			return nil, err
+		}
+		if seller.Currency, err = addAmount(seller.Currency, trade.TotalPrice); err != nil {
+			return nil, err
+		}
+		if seller.Fees, err = addAmount(seller.Fees, trade.Fee); err != nil {
+			return nil, err
+		}
+		if buyer.Energy, err = addAmount(buyer.Energy, trade.Amount); err != nil {
+			return nil, err
+		}
+		if buyer.Currency, err = subAmount(buyer.Currency, trade.TotalPrice); err != nil {
+			return nil, err
+		}
+	}
+
+	positions := make([]*NetPosition, 0, len(byFactory))
+	for _, position := range byFactory {
+		positions = append(positions, position)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i].FactoryID < positions[j].FactoryID
+	})
+	return positions, nil
+}
+
+// SettleBatch - Execute a batch of accepted trades at once with multilateral netting (zone operator only)
+// tradeIDs is a comma-separated list of trades ExecuteTrade could execute. The trades are
+// marked escrowed together, with their fees set at the current schedule, and each factory
+// holds only its net debit across the batch: a factory that receives as much TEC as it
+// pays holds none, however much it buys. The holds are checked once per factory and each
+// factory is written once. The batch is delivered as a whole with ConfirmBatchDelivery,
+// or refunded as a whole by RefundUndeliveredTrades. Either all trades are escrowed or
+// none is.
+func (c *EnergyTokenContract) SettleBatch(ctx contractapi.TransactionContextInterface,
+	tradeIDs string) (*BatchSettlement, error) {
+
+	if err := assertRole(ctx, RoleOperator); err != nil {
+		return nil, err
+	}
+	ids, err := parseTradeIDs(tradeIDs)
+	if err != nil {
+		return nil, err
+	}
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := getFeeSchedule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := BatchSettlement{
+		BatchID:       ctx.GetStub().GetTxID(),
+		TradeIDs:      ids,
+		Status:        TradeStatusEscrowed,
+		Timestamp:     txTimestamp,
+		SchemaVersion: currentSchemaVersion,
+	}
+	trades := make([]*EnergyTrade, 0, len(ids))
+	for _, tradeID := range ids {
+		trade, err := c.GetTrade(ctx, tradeID)
+		if err != nil {
+			return nil, err
+		}
+		if err := assertTradeExecutable(trade, txTimestamp); err != nil {
+			return nil, err
+		}
+		if trade.Fee, err = tradeFee(schedule, trade.TotalPrice); err != nil {
+			return nil, err
+		}
+		deadline, err := deliveryDeadline(txTimestamp, trade.DeliveryEnd)
+		if err != nil {
+			return nil, err
+		}
+
+		if batch.Value, err = addAmount(batch.Value, trade.TotalPrice); err != nil {
+			return nil, err
+		}
+		if batch.Fees, err = addAmount(batch.Fees, trade.Fee); err != nil {
+			return nil, err
+		}
+		if trade.DeliveryStart > batch.DeliveryStart {
+			batch.DeliveryStart = trade.DeliveryStart
+		}
+		if deadline > batch.DeliveryDeadline {
+			batch.DeliveryDeadline = deadline
+		}
+		trades = append(trades, trade)
+	}
+	if batch.Positions, err = netPositions(trades); err != nil {
+		return nil, err
+	}
+
+	// Positions come sorted by factory ID, so each factory is read and written once, in order
+	factoryIDs := make([]string, 0, len(batch.Positions))
+	for _, position := range batch.Positions {
+		energy, currency, err := batchHolds(position)
+		if err != nil {
+			return nil, err
+		}
+		if energy == 0 && currency == 0 {
+			continue
+		}
+		factory, err := c.GetFactory(ctx, position.FactoryID)
+		if err != nil {
+			return nil, err
+		}
+		if err := reserveFunds(factory, energy, currency); err != nil {
+			return nil, fmt.Errorf("factory %s cannot cover its net position: %v", factory.ID, err)
+		}
+		if err := putFactory(ctx, factory); err != nil {
+			return nil, err
+		}
+		factoryIDs = append(factoryIDs, factory.ID)
+	}
+
+	// All trades of the batch share its delivery deadline, so they are refunded together
+	for _, trade := range trades {
+		trade.Status = TradeStatusEscrowed
+		trade.ExecutedAt = txTimestamp
+		trade.DeliveryDeadline = batch.DeliveryDeadline
+		trade.BatchID = batch.BatchID
+		if err := putTrade(ctx, trade); err != nil {
+			return nil, err
+		}
+	}
+	if err := putBatch(ctx, &batch); err != nil {
+		return nil, err
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := emitEvent(ctx, events.BatchSettled, events.BatchSettledEvent{
+		BatchID:    batch.BatchID,
+		TradeIDs:   batch.TradeIDs,
+		FactoryIDs: factoryIDs,
+		Value:      batch.Value,
+		Fees:       batch.Fees,
+		MSPID:      caller.MSPID,
+		ClientID:   caller.ID,
+		Timestamp:  txTimestamp,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &batch, nil
+}
+
+// ConfirmBatchDelivery - Confirm the full metered delivery of a settlement batch and settle it (meter or oracle only)
+// Every trade of the batch is settled as by ConfirmDelivery with all its energy delivered:
+// the net holds are released, energy and TEC move, each trade pays the fee set when the
+// batch was escrowed and is invoiced, and each factory's unreserved TEC then pays any
+// imbalance penalties it still owes. Each factory is written once. A batch cannot be
+// delivered in part; a batch whose delivery is not confirmed by its deadline is refunded.
+func (c *EnergyTokenContract) ConfirmBatchDelivery(ctx contractapi.TransactionContextInterface,
+	batchID string) (*BatchSettlement, error) {
+
+	role, err := assertDeliveryConfirmer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	batch, err := c.GetBatch(ctx, batchID)
+	if err != nil {
+		return nil, err
+	}
+	if batch.Status != TradeStatusEscrowed {
+		return nil, fmt.Errorf("batch %s is %s", batchID, batch.Status)
+	}
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if batch.DeliveryStart != "" && txTimestamp < batch.DeliveryStart {
+		return nil, fmt.Errorf("delivery of batch %s starts at %s", batchID, batch.DeliveryStart)
+	}
+	if txTimestamp > batch.DeliveryDeadline {
+		return nil, fmt.Errorf("delivery of batch %s had to be confirmed by %s", batchID, batch.DeliveryDeadline)
+	}
+
+	// Load each factory once; reads within a transaction do not see its own writes
+	factories := make(map[string]*Factory)
+	loadFactory := func(factoryID string) (*Factory, error) {
+		if factory, ok := factories[factoryID]; ok {
+			return factory, nil
+		}
+		factory, err := c.GetFactory(ctx, factoryID)
+		if err != nil {
+			return nil, err
+		}
+		factories[factoryID] = factory
+		return factory, nil
+	}
+
+	for _, position := range batch.Positions {
+		energy, currency, err := batchHolds(position)
+		if err != nil {
+			return nil, err
+		}
+		factory, err := loadFactory(position.FactoryID)
+		if err != nil {
+			return nil, err
+		}
+		if err := releaseFunds(factory, energy, currency); err != nil {
+			return nil, err
+		}
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	confirmation := &DeliveryConfirmation{
+		MSPID:       caller.MSPID,
+		ClientID:    caller.ID,
+		Role:        role,
+		ConfirmedAt: txTimestamp,
+	}
+
+	// The net holds cover every movement, so balances are only checked once all are applied
+	for _, tradeID := range batch.TradeIDs {
+		trade, err := c.GetTrade(ctx, tradeID)
+		if err != nil {
+			return nil, err
+		}
+		if trade.Status != TradeStatusEscrowed || trade.BatchID != batchID {
+			return nil, fmt.Errorf("trade %s is %s outside batch %s", tradeID, trade.Status, batchID)
+		}
+		seller, err := loadFactory(trade.SellerID)
+		if err != nil {
+			return nil, err
+		}
+		buyer, err := loadFactory(trade.BuyerID)
+		if err != nil {
+			return nil, err
+		}
+		if err := transferTrade(seller, buyer, trade.Amount, trade.TotalPrice); err != nil {
+			return nil, err
+		}
+		if err := chargeTradeFee(ctx, seller, buyer, trade, trade.Amount, trade.TotalPrice, trade.Fee); err != nil {
+			return nil, err
+		}
+
+		trade.Status = TradeStatusCompleted
+		trade.DeliveredAmount = trade.Amount
+		trade.DeliveryConfirmation = confirmation
+		if err := putTrade(ctx, trade); err != nil {
+			return nil, err
+		}
+	}
+
+	factoryIDs := make([]string, 0, len(factories))
+	for factoryID := range factories {
+		factoryIDs = append(factoryIDs, factoryID)
+	}
+	sort.Strings(factoryIDs)
+	var collected Amount
+	for _, factoryID := range factoryIDs {
+		factory := factories[factoryID]
+		if spendableEnergy(factory) < 0 || spendableCurrency(factory) < 0 {
+			return nil, fmt.Errorf("factory %s cannot cover its net position in batch %s", factoryID, batchID)
+		}
+		// The proceeds first pay any imbalance penalties the factory still owes
+		paid, err := c.collectImbalanceDebt(ctx, factory, factories)
+		if err != nil {
+			return nil, err
+		}
+		if collected, err = addAmount(collected, paid); err != nil {
+			return nil, err
+		}
+	}
+	// Collecting debt may load the buyers it is owed to
+	factoryIDs = make([]string, 0, len(factories))
+	for factoryID := range factories {
+		factoryIDs = append(factoryIDs, factoryID)
+	}
+	sort.Strings(factoryIDs)
+	for _, factoryID := range factoryIDs {
+		if err := putFactory(ctx, factories[factoryID]); err != nil {
+			return nil, err
+		}
+	}
+
+	batch.Status = TradeStatusCompleted
+	batch.DeliveryConfirmation = confirmation
+	if err := putBatch(ctx, batch); err != nil {
+		return nil, err
+	}
+
+	if err := emitEvent(ctx, events.BatchDelivered, events.BatchDeliveredEvent{
+		BatchID:       batch.BatchID,
+		TradeIDs:      batch.TradeIDs,
+		FactoryIDs:    factoryIDs,
+		Value:         batch.Value,
+		Fees:          batch.Fees,
+		DebtCollected: collected,
+		MSPID:         caller.MSPID,
+		ClientID:      caller.ID,
+		Timestamp:     txTimestamp,
+	}); err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+// refundBatch - Return what an escrowed batch holds and mark it and its trades refunded
+// Factories are taken from and added to the cache; the caller writes them. Returns the
+// refunded trades, in batch order.
+func (c *EnergyTokenContract) refundBatch(ctx contractapi.TransactionContextInterface,
+	batch *BatchSettlement, factories map[string]*Factory) ([]*EnergyTrade, error) {
+
+	for _, position := range batch.Positions {
+		energy, currency, err := batchHolds(position)
+		if err != nil {
+			return nil, err
+		}
+		if energy == 0 && currency == 0 {
+			continue
+		}
+		factory, ok := factories[position.FactoryID]
+		if !ok {
+			if factory, err = c.GetFactory(ctx, position.FactoryID); err != nil {
+				return nil, err
+			}
+			factories[factory.ID] = factory
+		}
+		if err := releaseFunds(factory, energy, currency); err != nil {
+			return nil, err
+		}
+	}
+
+	trades := make([]*EnergyTrade, 0, len(batch.TradeIDs))
+	for _, tradeID := range batch.TradeIDs {
+		trade, err := c.GetTrade(ctx, tradeID)
+		if err != nil {
+			return nil, err
+		}
+		trade.Status = TradeStatusRefunded
+		trade.Fee = 0
+		trades = append(trades, trade)
+	}
+	batch.Status = TradeStatusRefunded
+	return trades, nil
+}
+
+// GetBatch - Get a settlement batch by the ID of the transaction that settled it
+func (c *EnergyTokenContract) GetBatch(ctx contractapi.TransactionContextInterface,
+	batchID string) (*BatchSettlement, error) {
+
+	key, err := batchKey(ctx, batchID)
+	if err != nil {
+		return nil, err
+	}
+	batchJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch: %v", err)
+	}
+	if batchJSON == nil {
+		return nil, fmt.Errorf("batch %s does not exist", batchID)
+	}
+
+	var batch BatchSettlement
+	if err := json.Unmarshal(batchJSON, &batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestParseTradeIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "trimmed and in order", value: "T2, T1 ,T3", want: []string{"T2", "T1", "T3"}},
+		{name: "blank entry", value: "T1,,T2", wantErr: true},
+		{name: "empty list", value: "", wantErr: true},
+		{name: "duplicate", value: "T1,T2,T1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTradeIDs(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseTradeIDs(%q) = %v, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTradeIDs(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetPositions(t *testing.T) {
+	tests := []struct {
+		name   string
+		trades []*EnergyTrade
+		want   []*NetPosition
+	}{
+		{
+			name:   "single trade",
+			trades: []*EnergyTrade{{SellerID: "F2", BuyerID: "F1", Amount: 5000, TotalPrice: 1500}},
+			want: []*NetPosition{
+				{FactoryID: "F1", Energy: 5000, Currency: -1500},
+				{FactoryID: "F2", Energy: -5000, Currency: 1500},
+			},
+		},
+		{
+			name: "opposite trades net out",
+			trades: []*EnergyTrade{
+				{SellerID: "F1", BuyerID: "F2", Amount: 5000, TotalPrice: 1500},
+				{SellerID: "F2", BuyerID: "F1", Amount: 3000, TotalPrice: 1200},
+			},
+			want: []*NetPosition{
+				{FactoryID: "F1", Energy: -2000, Currency: 300},
+				{FactoryID: "F2", Energy: 2000, Currency: -300},
+			},
+		},
+		{
+			name: "ring of trades",
+			trades: []*EnergyTrade{
+				{SellerID: "F1", BuyerID: "F2", Amount: 1000, TotalPrice: 300},
+				{SellerID: "F2", BuyerID: "F3", Amount: 1000, TotalPrice: 300},
+				{SellerID: "F3", BuyerID: "F1", Amount: 1000, TotalPrice: 300},
+			},
+			want: []*NetPosition{
+				{FactoryID: "F1"},
+				{FactoryID: "F2"},
+				{FactoryID: "F3"},
+			},
+		},
+		{
+			name: "empty batch",
+			want: []*NetPosition{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := netPositions(tt.trades)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("netPositions = %s, want %s", formatPositions(got), formatPositions(tt.want))
+			}
+		})
+	}
+}
+
+// formatPositions - Net positions as readable text for failure messages
+func formatPositions(positions []*NetPosition) string {
+	text := ""
+	for _, position := range positions {
+		text += fmt.Sprintf("%+v ", *position)
+	}
+	return text
+}
+
+// seedBatchTrades - Save factories F1 to F3 and two accepted trades in which F1 sells 1000 Wh
+// to F2 and buys 1000 Wh from F3, each for 300 millimes, then return the operator and meter
+func seedBatchTrades(t *testing.T, ctx *contractapi.TransactionContext, feeRateBps Amount) ([]byte, []byte) {
+	t.Helper()
+	operator, meter := serializedIdentity(t, "Org1MSP", "client"), serializedIdentity(t, "Org1MSP", "client")
+	seedRoles(t, ctx, submitAs(t, ctx, operator), RoleOperator)
+	seedRoles(t, ctx, submitAs(t, ctx, meter), RoleMeter)
+
+	// F1 has no TEC: it buys as much as it sells, so it holds nothing
+	seedFactories(t, ctx,
+		&Factory{ID: "F1", EnergyBalance: 1000},
+		&Factory{ID: "F2", CurrencyBalance: 300},
+		&Factory{ID: "F3", EnergyBalance: 1000})
+	accepted := &TradeAcceptance{MSPID: "Org1MSP", ClientID: "client", AcceptedAt: "2026-01-01T11:00:00Z"}
+	for _, trade := range []*EnergyTrade{
+		{TradeID: "T1", SellerID: "F1", BuyerID: "F2"},
+		{TradeID: "T2", SellerID: "F3", BuyerID: "F1"},
+	} {
+		trade.Amount, trade.PricePerUnit, trade.TotalPrice = 1000, 300, 300
+		trade.Status, trade.Timestamp, trade.SchemaVersion = TradeStatusPending, "2026-01-01T11:00:00Z", currentSchemaVersion
+		trade.SellerAcceptance, trade.BuyerAcceptance = accepted, accepted
+		if err := putTrade(ctx, trade); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if feeRateBps > 0 {
+		key, err := feeScheduleKey(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := putRecord(ctx, key, &FeeSchedule{DocType: docTypeConfig, RateBps: feeRateBps}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit(t, ctx)
+	return operator, meter
+}
+
+// assertBalances - Check the committed balances and reservations of factories F1 to F3
+func assertBalances(t *testing.T, ctx *contractapi.TransactionContext, want map[string]*Factory) {
+	t.Helper()
+	for factoryID, w := range want {
+		f, err := new(EnergyTokenContract).GetFactory(ctx, factoryID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.EnergyBalance != w.EnergyBalance || f.ReservedEnergy != w.ReservedEnergy ||
+			f.CurrencyBalance != w.CurrencyBalance || f.ReservedCurrency != w.ReservedCurrency {
+			t.Errorf("%s has %d Wh (%d reserved), %d millimes (%d reserved); want %d Wh (%d), %d millimes (%d)",
+				factoryID, f.EnergyBalance, f.ReservedEnergy, f.CurrencyBalance, f.ReservedCurrency,
+				w.EnergyBalance, w.ReservedEnergy, w.CurrencyBalance, w.ReservedCurrency)
+		}
+	}
+}
+
+func TestSettleBatchNetCreditorGrossDebtor(t *testing.T) {
+	ctx := newTestContext(t, "2026-01-01T12:00:00Z")
+	operator, meter := seedBatchTrades(t, ctx, 0)
+
+	c := new(EnergyTokenContract)
+	submitAs(t, ctx, operator)
+	batch, err := c.SettleBatch(ctx, "T1,T2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(t, ctx)
+	assertBalances(t, ctx, map[string]*Factory{
+		"F1": {EnergyBalance: 1000},
+		"F2": {CurrencyBalance: 300, ReservedCurrency: 300},
+		"F3": {EnergyBalance: 1000, ReservedEnergy: 1000},
+	})
+
+	submitAs(t, ctx, meter)
+	if err := c.ConfirmDelivery(ctx, "T1", 1000); err == nil {
+		t.Error("confirming a batch trade on its own should fail")
+	}
+	if _, err := c.ConfirmBatchDelivery(ctx, batch.BatchID); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, ctx)
+	assertBalances(t, ctx, map[string]*Factory{
+		"F1": {EnergyBalance: 1000},
+		"F2": {EnergyBalance: 1000},
+		"F3": {CurrencyBalance: 300},
+	})
+	for _, tradeID := range []string{"T1", "T2"} {
+		trade, err := c.GetTrade(ctx, tradeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trade.Status != TradeStatusCompleted || trade.BatchID != batch.BatchID || trade.InvoiceNumber == "" {
+			t.Errorf("trade %s is %s in batch %q with invoice %q", tradeID, trade.Status, trade.BatchID, trade.InvoiceNumber)
+		}
+	}
+	if _, err := c.ConfirmBatchDelivery(ctx, batch.BatchID); err == nil {
+		t.Error("confirming a delivered batch again should fail")
+	}
+}
+
+func TestSettleBatchHoldsFees(t *testing.T) {
+	// A 10% fee on its sale leaves F1 owing 30 millimes net, which it does not have
+	ctx := newTestContext(t, "2026-01-01T12:00:00Z")
+	operator, _ := seedBatchTrades(t, ctx, 1000)
+
+	submitAs(t, ctx, operator)
+	if _, err := new(EnergyTokenContract).SettleBatch(ctx, "T1,T2"); err == nil {
+		t.Error("settling a batch a factory cannot cover net of fees should fail")
+	}
+}
+
+func TestRefundBatch(t *testing.T) {
+	ctx := newTestContext(t, "2026-01-01T12:00:00Z")
+	operator, _ := seedBatchTrades(t, ctx, 0)
+
+	c := new(EnergyTokenContract)
+	submitAs(t, ctx, operator)
+	batch, err := c.SettleBatch(ctx, "T1,T2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(t, ctx)
+
+	factories := make(map[string]*Factory)
+	trades, err := c.refundBatch(ctx, batch, factories)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 2 || trades[0].Status != TradeStatusRefunded || trades[1].Status != TradeStatusRefunded {
+		t.Errorf("refunded %d trades", len(trades))
+	}
+	if batch.Status != TradeStatusRefunded {
+		t.Errorf("batch is %s, want refunded", batch.Status)
+	}
+	// F1 held nothing, so only the factories that hold are loaded
+	if len(factories) != 2 || factories["F2"].ReservedCurrency != 0 || factories["F3"].ReservedEnergy != 0 {
+		t.Errorf("refund left holds on factories %v", factories)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
+)
+
+// deliveryConfirmationWindow - How long after its delivery slot ends (or, without a slot, after
+// execution) the delivery of an executed trade can be confirmed
+const deliveryConfirmationWindow = 24 * time.Hour
+
+// DeliveryConfirmation - Meter or oracle identity that confirmed the delivery of a trade
+type DeliveryConfirmation struct {
+	MSPID       string `json:"mspId"`       // MSP ID of the confirming identity
+	ClientID    string `json:"clientId"`    // Certificate ID of the confirming identity
+	Role        string `json:"role"`        // Role the identity confirmed under (meter, oracle)
+	ConfirmedAt string `json:"confirmedAt"` // Confirmation timestamp
+}
+
+// deliveryDeadline - Last moment the delivery of a trade executed at now can be confirmed
+func deliveryDeadline(now string, deliveryEnd string) (string, error) {
+	from := now
+	if deliveryEnd > now {
+		from = deliveryEnd
+	}
+	t, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return "", err
+	}
+	return t.Add(deliveryConfirmationWindow).UTC().Format(time.RFC3339), nil
+}
+
+// escrowTrade - Hold the buyer's payment and the seller's energy until delivery is confirmed
+// The trade is marked escrowed as executed at timestamp, with its delivery deadline. The
+// factories are updated in memory and must be written by the caller.
+func escrowTrade(seller *Factory, buyer *Factory, trade *EnergyTrade, timestamp string) error {
+	if err := reserveFunds(buyer, 0, trade.TotalPrice); err != nil {
+		return err
+	}
+	if err := reserveFunds(seller, trade.Amount, 0); err != nil {
+		return err
+	}
+	deadline, err := deliveryDeadline(timestamp, trade.DeliveryEnd)
+	if err != nil {
+		return err
+	}
+
+	trade.Status = TradeStatusEscrowed
+	trade.ExecutedAt = timestamp
+	trade.DeliveryDeadline = deadline
+	return nil
+}
+
+// releaseEscrow - Unlock what an escrowed trade holds, before it settles or is refunded
+func releaseEscrow(seller *Factory, buyer *Factory, trade *EnergyTrade) error {
+	if err := releaseFunds(buyer, 0, trade.TotalPrice); err != nil {
+		return err
+	}
+	return releaseFunds(seller, trade.Amount, 0)
+}
+
+// assertDeliveryConfirmer - Reject the call unless the submitting client holds the meter or
+// oracle role. Returns the role it holds, meter first.
+func assertDeliveryConfirmer(ctx contractapi.TransactionContextInterface) (string, error) {
+	for _, role := range []string{RoleMeter, RoleOracle} {
+		ok, err := callerHasRole(ctx, role)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return role, nil
+		}
+	}
+	return "", fmt.Errorf("caller does not hold the %s or %s role", RoleMeter, RoleOracle)
+}
+
+// ConfirmDelivery - Confirm the metered delivery of an executed trade and pay the seller (meter or oracle only)
+// deliveredAmount is the energy metered as delivered in Wh, at most the trade's amount. The
+// delivered energy goes to the buyer and its value to the seller less the platform fee, and
+// the seller's invoice is issued. A shortfall is settled as an imbalance: the buyer gets the
+// rest of the escrow back plus compensation at the imbalance price. The seller's unreserved
+// TEC then pays any penalties of earlier imbalances it still owes. Delivery can be confirmed
+// from the start of the trade's delivery slot until its delivery deadline.
+func (c *EnergyTokenContract) ConfirmDelivery(ctx contractapi.TransactionContextInterface,
+	tradeID string, deliveredAmount Amount) error {
+
+	role, err := assertDeliveryConfirmer(ctx)
+	if err != nil {
+		return err
+	}
+
+	trade, err := c.GetTrade(ctx, tradeID)
+	if err != nil {
+		return err
+	}
+	if trade.Status != TradeStatusEscrowed {
+		return fmt.Errorf("trade %s is %s", tradeID, trade.Status)
+	}
+	if trade.BatchID != "" {
+		return fmt.Errorf("trade %s is delivered with batch %s; use ConfirmBatchDelivery", tradeID, trade.BatchID)
+	}
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	if trade.DeliveryStart != "" && txTimestamp < trade.DeliveryStart {
+		return fmt.Errorf("delivery of trade %s starts at %s", tradeID, trade.DeliveryStart)
+	}
+	if txTimestamp > trade.DeliveryDeadline {
+		return fmt.Errorf("delivery of trade %s had to be confirmed by %s", tradeID, trade.DeliveryDeadline)
+	}
+	if deliveredAmount < 0 || deliveredAmount > trade.Amount {
+		return fmt.Errorf("delivered amount must be between 0 and %d Wh", trade.Amount)
+	}
+
+	seller, err := c.GetFactory(ctx, trade.SellerID)
+	if err != nil {
+		return err
+	}
+	buyer, err := c.GetFactory(ctx, trade.BuyerID)
+	if err != nil {
+		return err
+	}
+
+	// Release the escrow and spend it on what was delivered
+	if err := releaseEscrow(seller, buyer, trade); err != nil {
+		return err
+	}
+	imbalance := &Imbalance{}
+	if deliveredAmount == trade.Amount {
+		if err := settleMarketTrade(ctx, seller, buyer, trade); err != nil {
+			return err
+		}
+	} else if imbalance, err = settleShortfall(ctx, seller, buyer, trade, deliveredAmount, txTimestamp); err != nil {
+		return err
+	}
+
+	// The proceeds first pay any imbalance penalties the seller still owes
+	factories := map[string]*Factory{seller.ID: seller, buyer.ID: buyer}
+	collected, err := c.collectImbalanceDebt(ctx, seller, factories)
+	if err != nil {
+		return err
+	}
+	factoryIDs := make([]string, 0, len(factories))
+	for factoryID := range factories {
+		factoryIDs = append(factoryIDs, factoryID)
+	}
+	sort.Strings(factoryIDs)
+	for _, factoryID := range factoryIDs {
+		if err := putFactory(ctx, factories[factoryID]); err != nil {
+			return err
+		}
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	trade.Status = TradeStatusCompleted
+	trade.DeliveredAmount = deliveredAmount
+	trade.DeliveryConfirmation = &DeliveryConfirmation{
+		MSPID:       caller.MSPID,
+		ClientID:    caller.ID,
+		Role:        role,
+		ConfirmedAt: txTimestamp,
+	}
+	if err := putTrade(ctx, trade); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.DeliveryConfirmed, events.DeliveryConfirmedEvent{
+		TradeID:         trade.TradeID,
+		SellerID:        trade.SellerID,
+		BuyerID:         trade.BuyerID,
+		Amount:          trade.Amount,
+		TotalPrice:      trade.TotalPrice,
+		Fee:             trade.Fee,
+		NetAmount:       trade.NetAmount,
+		InvoiceNumber:   trade.InvoiceNumber,
+		DeliveredAmount: trade.DeliveredAmount,
+		Shortfall:       imbalance.Shortfall,
+		Refund:          imbalance.Refund,
+		Compensation:    imbalance.Compensation,
+		Outstanding:     imbalance.Outstanding,
+		DebtCollected:   collected,
+		MSPID:           caller.MSPID,
+		ClientID:        caller.ID,
+		Timestamp:       txTimestamp,
+	})
+}
+
+// RefundUndeliveredTrades - Refund every escrowed trade whose delivery deadline has passed
+// The buyer's TEC and the seller's energy are released and the trade is marked refunded;
+// the trades of a settlement batch are refunded with their batch, releasing its net holds.
+// Deadlines are judged against the transaction timestamp, so any client may run the sweep.
+// Returns the IDs of the trades that were refunded.
+func (c *EnergyTokenContract) RefundUndeliveredTrades(ctx contractapi.TransactionContextInterface) ([]string, error) {
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := buildQuery(map[string]interface{}{
+		"docType":          docTypeTrade,
+		"status":           TradeStatusEscrowed,
+		"deliveryDeadline": map[string]interface{}{"$lt": txTimestamp},
+	}, indexStatus)
+	if err != nil {
+		return nil, err
+	}
+	stale, err := queryTrades(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Factories are loaded once and written once, as several trades may share one
+	factories := make(map[string]*Factory)
+	loadFactory := func(factoryID string) (*Factory, error) {
+		if factory, ok := factories[factoryID]; ok {
+			return factory, nil
+		}
+		factory, err := c.GetFactory(ctx, factoryID)
+		if err != nil {
+			return nil, err
+		}
+		factories[factoryID] = factory
+		return factory, nil
+	}
+
+	refunded := []string{}
+	batches := make(map[string]bool)
+	for _, candidate := range stale {
+		// Re-read each trade so it is part of the read set and checked at commit
+		trade, err := c.GetTrade(ctx, candidate.TradeID)
+		if err != nil {
+			return nil, err
+		}
+		if trade.Status != TradeStatusEscrowed || trade.DeliveryDeadline >= txTimestamp {
+			continue
+		}
+
+		if trade.BatchID != "" {
+			if batches[trade.BatchID] {
+				continue
+			}
+			batches[trade.BatchID] = true
+			batch, err := c.GetBatch(ctx, trade.BatchID)
+			if err != nil {
+				return nil, err
+			}
+			trades, err := c.refundBatch(ctx, batch, factories)
+			if err != nil {
+				return nil, err
+			}
+			for _, trade := range trades {
+				if err := putTrade(ctx, trade); err != nil {
+					return nil, err
+				}
+				refunded = append(refunded, trade.TradeID)
+			}
+			if err := putBatch(ctx, batch); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		seller, err := loadFactory(trade.SellerID)
+		if err != nil {
+			return nil, err
+		}
+		buyer, err := loadFactory(trade.BuyerID)
+		if err != nil {
+			return nil, err
+		}
+		if err := releaseEscrow(seller, buyer, trade); err != nil {
+			return nil, err
+		}
+
+		trade.Status = TradeStatusRefunded
+		if err := putTrade(ctx, trade); err != nil {
+			return nil, err
+		}
+		refunded = append(refunded, trade.TradeID)
+	}
+
+	if len(refunded) == 0 {
+		return refunded, nil
+	}
+
+	factoryIDs := make([]string, 0, len(factories))
+	for factoryID := range factories {
+		factoryIDs = append(factoryIDs, factoryID)
+	}
+	sort.Strings(factoryIDs)
+	for _, factoryID := range factoryIDs {
+		if err := putFactory(ctx, factories[factoryID]); err != nil {
+			return nil, err
+		}
+	}
+
+	return refunded, emitEvent(ctx, events.TradesRefunded, events.TradesRefundedEvent{
+		TradeIDs:  refunded,
+		Timestamp: txTimestamp,
+	})
+}
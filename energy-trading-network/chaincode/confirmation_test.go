@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestConfirmDeliveryTransaction(t *testing.T) {
+	ctx := newTestContext(t, "2026-01-01T12:00:00Z")
+	meter := serializedIdentity(t, "Org1MSP", "client")
+	seedRoles(t, ctx, submitAs(t, ctx, meter), RoleMeter)
+	seedFactories(t, ctx,
+		&Factory{ID: "S1", EnergyType: "solar", EnergyBalance: 1000, ReservedEnergy: 1000},
+		&Factory{ID: "B1", CurrencyBalance: 500, ReservedCurrency: 300})
+	if err := putTrade(ctx, &EnergyTrade{TradeID: "T1", SellerID: "S1", BuyerID: "B1", Amount: 1000,
+		PricePerUnit: 300, TotalPrice: 300, Status: TradeStatusEscrowed, Timestamp: "2026-01-01T11:00:00Z",
+		DeliveryDeadline: "2026-01-01T18:00:00Z", SchemaVersion: currentSchemaVersion}); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, ctx)
+
+	c := new(EnergyTokenContract)
+	if err := c.ConfirmDelivery(ctx, "T1", 1000); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, ctx)
+
+	trade, err := c.GetTrade(ctx, "T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.Status != TradeStatusCompleted || trade.DeliveredAmount != 1000 || trade.NetAmount != 300-trade.Fee {
+		t.Errorf("trade is %s with %d Wh delivered and %d millimes net", trade.Status, trade.DeliveredAmount, trade.NetAmount)
+	}
+	seller, err := c.GetFactory(ctx, "S1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seller.EnergyBalance != 0 || seller.ReservedEnergy != 0 || seller.CurrencyBalance != trade.NetAmount {
+		t.Errorf("seller has %d Wh (%d reserved) and %d millimes, want 0 Wh and %d millimes",
+			seller.EnergyBalance, seller.ReservedEnergy, seller.CurrencyBalance, trade.NetAmount)
+	}
+	buyer, err := c.GetFactory(ctx, "B1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buyer.EnergyBalance != 1000 || buyer.CurrencyBalance != 200 || buyer.ReservedCurrency != 0 {
+		t.Errorf("buyer has %d Wh and %d millimes (%d reserved), want 1000 Wh and 200 millimes",
+			buyer.EnergyBalance, buyer.CurrencyBalance, buyer.ReservedCurrency)
+	}
+
+	if err := c.ConfirmDelivery(ctx, "T1", 1000); err == nil {
+		t.Error("confirming a completed trade should fail")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// gateClosureLead - How long before its delivery starts a slot stops trading
+const gateClosureLead = time.Hour
+
+// parseDeliveryWindow - Validate and normalize a delivery window (both RFC 3339)
+// Both bounds empty means the record has no delivery slot.
+func parseDeliveryWindow(deliveryStart string, deliveryEnd string) (string, string, error) {
+	if deliveryStart == "" && deliveryEnd == "" {
+		return "", "", nil
+	}
+	if deliveryStart == "" || deliveryEnd == "" {
+		return "", "", fmt.Errorf("delivery start and end must be given together")
+	}
+
+	start, err := normalizeTimestamp("delivery start", deliveryStart)
+	if err != nil {
+		return "", "", err
+	}
+	end, err := normalizeTimestamp("delivery end", deliveryEnd)
+	if err != nil {
+		return "", "", err
+	}
+	if end <= start {
+		return "", "", fmt.Errorf("delivery end must be after delivery start")
+	}
+	return start, end, nil
+}
+
+// slotGateClosure - Time at which a delivery slot starting at deliveryStart stops trading
+func slotGateClosure(deliveryStart string) (string, error) {
+	start, err := time.Parse(time.RFC3339, deliveryStart)
+	if err != nil {
+		return "", err
+	}
+	return start.Add(-gateClosureLead).UTC().Format(time.RFC3339), nil
+}
+
+// assertSlotOpen - Reject trading in a delivery slot that has passed gate closure
+// Records without a delivery slot are always open.
+func assertSlotOpen(now string, deliveryStart string) error {
+	if deliveryStart == "" {
+		return nil
+	}
+	gateClosure, err := slotGateClosure(deliveryStart)
+	if err != nil {
+		return err
+	}
+	if now >= gateClosure {
+		return fmt.Errorf("delivery slot starting %s closed at %s", deliveryStart, gateClosure)
+	}
+	return nil
+}
+
+// deliveryWindow - Validate a delivery window requested at now for a new offer or trade
+func deliveryWindow(now string, deliveryStart string, deliveryEnd string) (string, string, error) {
+	start, end, err := parseDeliveryWindow(deliveryStart, deliveryEnd)
+	if err != nil {
+		return "", "", err
+	}
+	if err := assertSlotOpen(now, start); err != nil {
+		return "", "", err
+	}
+	return start, end, nil
+}
+
+// slotSelector - Selector matching records delivered within [from, to] (RFC 3339, "" for open bounds)
+func slotSelector(docType string, from string, to string) (map[string]interface{}, error) {
+	start := map[string]interface{}{"$gt": ""}
+	if from != "" {
+		bound, err := normalizeTimestamp("from", from)
+		if err != nil {
+			return nil, err
+		}
+		start = map[string]interface{}{"$gte": bound}
+	}
+
+	selector := map[string]interface{}{
+		"docType":       docType,
+		"deliveryStart": start,
+	}
+	if to != "" {
+		bound, err := normalizeTimestamp("to", to)
+		if err != nil {
+			return nil, err
+		}
+		selector["deliveryEnd"] = map[string]interface{}{"$lte": bound}
+	}
+	return selector, nil
+}
+
+// GetOffersBySlot - Get active offers whose delivery slot lies within [from, to], earliest slot first
+// offerType and the RFC 3339 bounds are optional filters ("" to ignore); offers without a
+// delivery slot are never returned.
+func (c *EnergyTokenContract) GetOffersBySlot(ctx contractapi.TransactionContextInterface,
+	offerType string, from string, to string) ([]*Offer, error) {
+
+	selector, err := slotSelector(docTypeOffer, from, to)
+	if err != nil {
+		return nil, err
+	}
+	selector["status"] = OfferStatusActive
+	if offerType != "" {
+		selector["offerType"] = offerType
+	}
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := buildQuery(restrictToLive(selector, txTimestamp), indexDelivery)
+	if err != nil {
+		return nil, err
+	}
+	offers, err := queryOffers(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(offers, func(i, j int) bool {
+		if offers[i].DeliveryStart != offers[j].DeliveryStart {
+			return offers[i].DeliveryStart < offers[j].DeliveryStart
+		}
+		if offers[i].PricePerKwh != offers[j].PricePerKwh {
+			return offers[i].PricePerKwh < offers[j].PricePerKwh
+		}
+		return offers[i].ID < offers[j].ID
+	})
+
+	return offers, nil
+}
+
+// GetTradesBySlot - Get trades whose delivery slot lies within [from, to], earliest slot first
+// The RFC 3339 bounds are optional ("" to ignore); trades without a delivery slot are never
+// returned.
+func (c *EnergyTokenContract) GetTradesBySlot(ctx contractapi.TransactionContextInterface,
+	from string, to string) ([]*EnergyTrade, error) {
+
+	selector, err := slotSelector(docTypeTrade, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := buildQuery(selector, indexDelivery)
+	if err != nil {
+		return nil, err
+	}
+	trades, err := queryTrades(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(trades, func(i, j int) bool {
+		if trades[i].DeliveryStart != trades[j].DeliveryStart {
+			return trades[i].DeliveryStart < trades[j].DeliveryStart
+		}
+		if trades[i].Timestamp != trades[j].Timestamp {
+			return trades[i].Timestamp < trades[j].Timestamp
+		}
+		return trades[i].TradeID < trades[j].TradeID
+	})
+
+	return trades, nil
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
 )
 
 // Token symbol for the digital coin
@@ -15,71 +17,166 @@ type EnergyTokenContract struct {
 	contractapi.Contract
 }
 
+// currentSchemaVersion - Version of the record layout written by this chaincode
+// Version 1 stores all quantities as fixed-point integer amounts; records without a
+// version predate it and must be converted with MigrateLegacyRecords.
+const currentSchemaVersion = 1
+
 // Factory - Represents a factory in the industrial zone
 type Factory struct {
-	ID                 string  `json:"id"`                           // Factory identifier (e.g., "Factory01")
-	Name               string  `json:"name"`                         // Factory name
-	EnergyBalance      float64 `json:"energyBalance"`                // Energy tokens balance (in kWh)
-	EnergyType         string  `json:"energyType"`                   // Type of energy source (solar, wind, footstep)
-	CurrencyBalance    float64 `json:"currencyBalance"`              // Balance in TEC (Tunisian Energy Coin)
-	DailyConsumption   float64 `json:"dailyConsumption"`             // Daily energy consumption in kWh
-	AvailableEnergy    float64 `json:"availableEnergy"`              // Currently available energy in kWh
-	Email              string  `json:"email,omitempty"`              // Factory email for authentication
-	PasswordHash       string  `json:"passwordHash,omitempty"`       // Hashed password for authentication
-	Localisation       string  `json:"localisation,omitempty"`       // Factory location
-	FiscalMatricule    string  `json:"fiscalMatricule,omitempty"`    // Fiscal registration number
-	EnergyCapacity     float64 `json:"energyCapacity,omitempty"`     // Maximum energy capacity
-	ContactInfo        string  `json:"contactInfo,omitempty"`        // Contact information
-	CurrentGeneration  float64 `json:"currentGeneration,omitempty"`  // Current energy generation
-	CurrentConsumption float64 `json:"currentConsumption,omitempty"` // Current energy consumption
-	CreatedAt          string  `json:"createdAt,omitempty"`          // Creation timestamp
+	DocType            string   `json:"docType"`                                           // Record namespace ("factory")
+	ID                 string   `json:"id"`                                                // Factory identifier (e.g., "Factory01")
+	Name               string   `json:"name"`                                              // Factory name
+	EnergyBalance      Amount   `json:"energyBalance"`                                     // Energy tokens balance (in Wh)
+	EnergyType         string   `json:"energyType"`                                        // Type of energy source (solar, wind, footstep)
+	CurrencyBalance    Amount   `json:"currencyBalance"`                                   // Balance in millimes of TEC (Tunisian Energy Coin)
+	DailyConsumption   Amount   `json:"dailyConsumption"`                                  // Daily energy consumption in Wh
+	AvailableEnergy    Amount   `json:"availableEnergy"`                                   // Currently available energy in Wh
+	ReservedEnergy     Amount   `json:"reservedEnergy,omitempty" metadata:",optional"`     // Energy locked by active sell offers and escrowed trades in Wh
+	ReservedCurrency   Amount   `json:"reservedCurrency,omitempty" metadata:",optional"`   // TEC locked by active buy offers and escrowed trades in millimes
+	Localisation       string   `json:"localisation,omitempty" metadata:",optional"`       // Factory location
+	FiscalMatricule    string   `json:"fiscalMatricule,omitempty" metadata:",optional"`    // Fiscal registration number
+	EnergyCapacity     Amount   `json:"energyCapacity,omitempty" metadata:",optional"`     // Maximum energy capacity in Wh
+	CurrentGeneration  Amount   `json:"currentGeneration,omitempty" metadata:",optional"`  // Current energy generation in Wh
+	CurrentConsumption Amount   `json:"currentConsumption,omitempty" metadata:",optional"` // Current energy consumption in Wh
+	CreatedAt          string   `json:"createdAt,omitempty" metadata:",optional"`          // Creation timestamp
+	OwnerMSP           string   `json:"ownerMsp,omitempty" metadata:",optional"`           // MSP ID of the identity that owns the factory
+	OwnerID            string   `json:"ownerId,omitempty" metadata:",optional"`            // Certificate ID of the identity that owns the factory
+	PrivateDetailsHash string   `json:"privateDetailsHash,omitempty" metadata:",optional"` // SHA-256 of the details in the private collection
+	InvoiceSequence    int64    `json:"invoiceSequence,omitempty" metadata:",optional"`    // Number of the last invoice issued by the factory as seller
+	ImbalanceDebt      Amount   `json:"imbalanceDebt,omitempty" metadata:",optional"`      // Imbalance penalties still owed in millimes, collected when the factory is next paid for a sale
+	ImbalancesOwed     []string `json:"imbalancesOwed,omitempty" metadata:",optional"`     // Trades whose imbalance penalty is still partly owed, oldest first
+	SchemaVersion      int      `json:"schemaVersion,omitempty" metadata:",optional"`      // Record layout version
 }
 
 // Offer - Represents an energy offer in the marketplace
 type Offer struct {
-	ID           string  `json:"id"`           // Offer identifier
-	FactoryID    string  `json:"factoryId"`    // Factory creating the offer
-	OfferType    string  `json:"offerType"`    // Type of offer (buy/sell)
-	EnergyAmount float64 `json:"energyAmount"` // Amount of energy
-	PricePerKwh  float64 `json:"pricePerKwh"`  // Price per kWh
-	Status       string  `json:"status"`       // Offer status (active, completed, cancelled)
-	CreatedAt    string  `json:"createdAt"`    // Creation timestamp
-	UpdatedAt    string  `json:"updatedAt"`    // Last update timestamp
+	DocType          string   `json:"docType"`                                         // Record namespace ("offer")
+	ID               string   `json:"id"`                                              // Offer identifier
+	FactoryID        string   `json:"factoryId"`                                       // Factory creating the offer
+	OfferType        string   `json:"offerType"`                                       // Type of offer (buy/sell)
+	EnergyType       string   `json:"energyType,omitempty" metadata:",optional"`       // Energy source of the offering factory
+	EnergyAmount     Amount   `json:"energyAmount"`                                    // Amount of energy in Wh
+	FilledAmount     Amount   `json:"filledAmount,omitempty" metadata:",optional"`     // Energy already traded through AcceptOffer in Wh
+	FilledNotional   Amount   `json:"filledNotional,omitempty" metadata:",optional"`   // Filled Wh times their price per kWh, summed over fills (thousandths of a millime)
+	PricePerKwh      Amount   `json:"pricePerKwh"`                                     // Price per kWh in millimes
+	Status           string   `json:"status"`                                          // Offer status (active, pending, completed, cancelled, expired)
+	ReservedEnergy   Amount   `json:"reservedEnergy,omitempty" metadata:",optional"`   // Energy this offer holds in reserve in Wh
+	ReservedCurrency Amount   `json:"reservedCurrency,omitempty" metadata:",optional"` // TEC this offer holds in reserve in millimes
+	BookPriority     string   `json:"bookPriority,omitempty" metadata:",optional"`     // Order book time priority: arrival time and transaction ID ("" outside the book)
+	OrderType        string   `json:"orderType,omitempty" metadata:",optional"`        // Order book order type (limit, market, stop, stop-limit)
+	TimeInForce      string   `json:"timeInForce,omitempty" metadata:",optional"`      // Order book time in force (GTC, IOC, FOK)
+	StopPrice        Amount   `json:"stopPrice,omitempty" metadata:",optional"`        // Last price per kWh in millimes that triggers a stop order
+	TriggeredAt      string   `json:"triggeredAt,omitempty" metadata:",optional"`      // When a stop order's stop price was crossed
+	IntervalID       string   `json:"intervalId,omitempty" metadata:",optional"`       // Auction interval the order was submitted to, if any
+	DeliveryStart    string   `json:"deliveryStart,omitempty" metadata:",optional"`    // Start of the delivery slot (RFC 3339)
+	DeliveryEnd      string   `json:"deliveryEnd,omitempty" metadata:",optional"`      // End of the delivery slot (RFC 3339)
+	ValidUntil       string   `json:"validUntil,omitempty" metadata:",optional"`       // Last moment the offer can be filled (RFC 3339)
+	AcceptedSources  []string `json:"acceptedSources,omitempty" metadata:",optional"`  // Energy sources a buy offer takes (empty for any)
+	Revision         int      `json:"revision,omitempty" metadata:",optional"`         // Number of amendments applied through AmendOffer
+	CreatedAt        string   `json:"createdAt"`                                       // Creation timestamp
+	UpdatedAt        string   `json:"updatedAt"`                                       // Last update timestamp
+	SchemaVersion    int      `json:"schemaVersion,omitempty" metadata:",optional"`    // Record layout version
 }
 
+// Offer types
+const (
+	OfferTypeBuy  = "buy"  // Bid: the factory buys energy and reserves TEC
+	OfferTypeSell = "sell" // Ask: the factory sells energy and reserves it
+)
+
+// Offer statuses
+const (
+	OfferStatusActive    = "active"    // Open on the marketplace; holds a reservation
+	OfferStatusPending   = "pending"   // Stop order waiting for its stop price; holds a reservation
+	OfferStatusCompleted = "completed" // Closed; no longer holds a reservation
+	OfferStatusCancelled = "cancelled" // Withdrawn by its factory; reservation released
+	OfferStatusExpired   = "expired"   // Closed unfilled past its validity or auction; reservation released
+)
+
 // EnergyTrade - Represents an energy trade transaction
 type EnergyTrade struct {
-	TradeID      string  `json:"tradeId"`      // Unique trade identifier
-	SellerID     string  `json:"sellerId"`     // Factory selling energy
-	BuyerID      string  `json:"buyerId"`      // Factory buying energy
-	Amount       float64 `json:"amount"`       // Amount of energy in kWh
-	PricePerUnit float64 `json:"pricePerUnit"` // Price per kWh in tokens
-	TotalPrice   float64 `json:"totalPrice"`   // Total transaction value
-	Timestamp    string  `json:"timestamp"`    // Transaction timestamp
-	Status       string  `json:"status"`       // Trade status (pending, completed, cancelled)
+	DocType              string                `json:"docType"`                                             // Record namespace ("trade")
+	TradeID              string                `json:"tradeId"`                                             // Unique trade identifier
+	SellerID             string                `json:"sellerId"`                                            // Factory selling energy
+	BuyerID              string                `json:"buyerId"`                                             // Factory buying energy
+	Amount               Amount                `json:"amount"`                                              // Amount of energy in Wh
+	PricePerUnit         Amount                `json:"pricePerUnit"`                                        // Price per kWh in millimes
+	TotalPrice           Amount                `json:"totalPrice"`                                          // Gross transaction value paid by the buyer in millimes
+	Fee                  Amount                `json:"fee,omitempty" metadata:",optional"`                  // Platform fee taken from the seller's proceeds in millimes
+	NetAmount            Amount                `json:"netAmount,omitempty" metadata:",optional"`            // Value received by the seller after the fee in millimes (set on settlement)
+	Timestamp            string                `json:"timestamp"`                                           // Transaction timestamp
+	Status               string                `json:"status"`                                              // Trade status (pending, escrowed, completed, cancelled, rejected, expired, refunded)
+	EnergySource         string                `json:"energySource,omitempty" metadata:",optional"`         // Energy source of the seller
+	InvoiceNumber        string                `json:"invoiceNumber,omitempty" metadata:",optional"`        // Tax invoice issued on settlement
+	ExpiresAt            string                `json:"expiresAt,omitempty" metadata:",optional"`            // Deadline for executing the trade (RFC 3339)
+	ExecutedAt           string                `json:"executedAt,omitempty" metadata:",optional"`           // When ExecuteTrade put the trade in escrow
+	DeliveryDeadline     string                `json:"deliveryDeadline,omitempty" metadata:",optional"`     // Last moment delivery of an escrowed trade can be confirmed (RFC 3339)
+	DeliveredAmount      Amount                `json:"deliveredAmount,omitempty" metadata:",optional"`      // Energy metered as delivered in Wh
+	ImbalanceID          string                `json:"imbalanceId,omitempty" metadata:",optional"`          // Imbalance that settled a delivery shortfall, if any (see GetImbalance)
+	DeliveryConfirmation *DeliveryConfirmation `json:"deliveryConfirmation,omitempty" metadata:",optional"` // Identity that confirmed delivery
+	OfferID              string                `json:"offerId,omitempty" metadata:",optional"`              // Offer the trade filled, if any
+	TakerOfferID         string                `json:"takerOfferId,omitempty" metadata:",optional"`         // Incoming order matched against OfferID, or the bid of an auction trade
+	IntervalID           string                `json:"intervalId,omitempty" metadata:",optional"`           // Auction interval that produced the trade, if any
+	LotID                string                `json:"lotId,omitempty" metadata:",optional"`                // Sealed-bid lot the trade settled, if any
+	BatchID              string                `json:"batchId,omitempty" metadata:",optional"`              // SettleBatch transaction that settled the trade, if any
+	DeliveryStart        string                `json:"deliveryStart,omitempty" metadata:",optional"`        // Start of the delivery slot (RFC 3339)
+	DeliveryEnd          string                `json:"deliveryEnd,omitempty" metadata:",optional"`          // End of the delivery slot (RFC 3339)
+	ProposedBy           string                `json:"proposedBy,omitempty" metadata:",optional"`           // Side that proposed the trade (seller or buyer)
+	SellerAcceptance     *TradeAcceptance      `json:"sellerAcceptance,omitempty" metadata:",optional"`     // Identity that accepted for the seller
+	BuyerAcceptance      *TradeAcceptance      `json:"buyerAcceptance,omitempty" metadata:",optional"`      // Identity that accepted for the buyer
+	SchemaVersion        int                   `json:"schemaVersion,omitempty" metadata:",optional"`        // Record layout version
 }
 
-// InitLedger - Initialize the ledger with sample factories
+// Trade statuses
+const (
+	TradeStatusPending   = "pending"   // Created, waiting for execution
+	TradeStatusEscrowed  = "escrowed"  // Executed; buyer's TEC and seller's energy held until delivery is confirmed
+	TradeStatusCompleted = "completed" // Settled; energy and TEC have moved
+	TradeStatusCancelled = "cancelled" // Withdrawn by the seller
+	TradeStatusRejected  = "rejected"  // Declined by the buyer
+	TradeStatusExpired   = "expired"   // Not executed before its expiry
+	TradeStatusRefunded  = "refunded"  // Delivery not confirmed by its deadline; escrow returned
+)
+
+// InitLedger - Initialize the ledger with sample factories (zone operator only)
+// The first Org1MSP admin to call InitLedger becomes the zone operator. Sample factories
+// that already exist are skipped, so running it again never resets their balances.
 func (c *EnergyTokenContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
+	if err := bootstrapOperator(ctx); err != nil {
+		return err
+	}
+
 	// Create initial factories in the industrial zone
 	factories := []Factory{
-		{ID: "Factory01", Name: "Solar Manufacturing Plant", EnergyBalance: 1000.0, EnergyType: "solar", CurrencyBalance: 1000.0, DailyConsumption: 800.0, AvailableEnergy: 1200.0, CurrentGeneration: 0, CurrentConsumption: 0},
-		{ID: "Factory02", Name: "Wind Power Assembly", EnergyBalance: 800.0, EnergyType: "wind", CurrencyBalance: 800.0, DailyConsumption: 750.0, AvailableEnergy: 850.0, CurrentGeneration: 0, CurrentConsumption: 0},
-		{ID: "Factory03", Name: "Tech Production Facility", EnergyBalance: 500.0, EnergyType: "footstep", CurrencyBalance: 500.0, DailyConsumption: 600.0, AvailableEnergy: 450.0, CurrentGeneration: 0, CurrentConsumption: 0},
-		{ID: "Factory04", Name: "Heavy Industry Corp", EnergyBalance: 300.0, EnergyType: "solar", CurrencyBalance: 300.0, DailyConsumption: 900.0, AvailableEnergy: 250.0, CurrentGeneration: 0, CurrentConsumption: 0},
-		{ID: "Factory05", Name: "Electronics Assembly", EnergyBalance: 600.0, EnergyType: "wind", CurrencyBalance: 600.0, DailyConsumption: 550.0, AvailableEnergy: 700.0, CurrentGeneration: 0, CurrentConsumption: 0},
+		{ID: "Factory01", Name: "Solar Manufacturing Plant", EnergyBalance: 1000 * WhPerKwh, EnergyType: "solar", CurrencyBalance: 1000 * MillimesPerTEC, DailyConsumption: 800 * WhPerKwh, AvailableEnergy: 1200 * WhPerKwh, CurrentGeneration: 0, CurrentConsumption: 0, SchemaVersion: currentSchemaVersion},
+		{ID: "Factory02", Name: "Wind Power Assembly", EnergyBalance: 800 * WhPerKwh, EnergyType: "wind", CurrencyBalance: 800 * MillimesPerTEC, DailyConsumption: 750 * WhPerKwh, AvailableEnergy: 850 * WhPerKwh, CurrentGeneration: 0, CurrentConsumption: 0, SchemaVersion: currentSchemaVersion},
+		{ID: "Factory03", Name: "Tech Production Facility", EnergyBalance: 500 * WhPerKwh, EnergyType: "footstep", CurrencyBalance: 500 * MillimesPerTEC, DailyConsumption: 600 * WhPerKwh, AvailableEnergy: 450 * WhPerKwh, CurrentGeneration: 0, CurrentConsumption: 0, SchemaVersion: currentSchemaVersion},
+		{ID: "Factory04", Name: "Heavy Industry Corp", EnergyBalance: 300 * WhPerKwh, EnergyType: "solar", CurrencyBalance: 300 * MillimesPerTEC, DailyConsumption: 900 * WhPerKwh, AvailableEnergy: 250 * WhPerKwh, CurrentGeneration: 0, CurrentConsumption: 0, SchemaVersion: currentSchemaVersion},
+		{ID: "Factory05", Name: "Electronics Assembly", EnergyBalance: 600 * WhPerKwh, EnergyType: "wind", CurrencyBalance: 600 * MillimesPerTEC, DailyConsumption: 550 * WhPerKwh, AvailableEnergy: 700 * WhPerKwh, CurrentGeneration: 0, CurrentConsumption: 0, SchemaVersion: currentSchemaVersion},
+	}
+
+	// Bind the sample factories to the identity initializing the ledger
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
 	}
 
-	// Store each factory in the blockchain ledger
-	for _, factory := range factories {
-		factoryJSON, err := json.Marshal(factory)
+	// Store each factory in the blockchain ledger, leaving factories that already exist as they are
+	for i := range factories {
+		factory := &factories[i]
+		exists, err := c.FactoryExists(ctx, factory.ID)
 		if err != nil {
-			return fmt.Errorf("failed to marshal factory: %v", err)
+			return err
+		}
+		if exists {
+			continue
 		}
+		factory.OwnerMSP = caller.MSPID
+		factory.OwnerID = caller.ID
 
 		// Put factory data on the ledger
-		err = ctx.GetStub().PutState(factory.ID, factoryJSON)
-		if err != nil {
+		if err := putFactory(ctx, factory); err != nil {
 			return fmt.Errorf("failed to put factory on ledger: %v", err)
 		}
 	}
@@ -87,10 +184,22 @@ func (c *EnergyTokenContract) InitLedger(ctx contractapi.TransactionContextInter
 	return nil
 }
 
-// RegisterFactory - Register a new factory in the industrial zone
+// RegisterFactory - Register a new factory in the industrial zone (zone operator only)
 func (c *EnergyTokenContract) RegisterFactory(ctx contractapi.TransactionContextInterface,
-	factoryID string, name string, initialBalance float64, energyType string, currencyBalance float64,
-	dailyConsumption float64, availableEnergy float64) error {
+	factoryID string, name string, initialBalance Amount, energyType string, currencyBalance Amount,
+	dailyConsumption Amount, availableEnergy Amount) error {
+
+	if err := assertRole(ctx, RoleOperator); err != nil {
+		return err
+	}
+
+	// Validate amounts
+	if initialBalance < 0 || currencyBalance < 0 || dailyConsumption < 0 || availableEnergy < 0 {
+		return fmt.Errorf("balances and energy amounts cannot be negative")
+	}
+	if err := assertEnergySource(energyType); err != nil {
+		return err
+	}
 
 	// Check if factory already exists
 	exists, err := c.FactoryExists(ctx, factoryID)
@@ -101,6 +210,18 @@ func (c *EnergyTokenContract) RegisterFactory(ctx contractapi.TransactionContext
 		return fmt.Errorf("factory %s already exists", factoryID)
 	}
 
+	// The registering identity owns the factory until SetFactoryOwner hands it over
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Get timestamp
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
 	// Create new factory (CurrencyBalance set from parameter)
 	factory := Factory{
 		ID:                 factoryID,
@@ -112,21 +233,40 @@ func (c *EnergyTokenContract) RegisterFactory(ctx contractapi.TransactionContext
 		AvailableEnergy:    availableEnergy,
 		CurrentGeneration:  0,
 		CurrentConsumption: 0,
+		CreatedAt:          txTimestamp,
+		OwnerMSP:           caller.MSPID,
+		OwnerID:            caller.ID,
+		SchemaVersion:      currentSchemaVersion,
 	}
 
-	// Marshal factory to JSON
-	factoryJSON, err := json.Marshal(factory)
-	if err != nil {
+	// Save factory to ledger
+	if err := putFactory(ctx, &factory); err != nil {
 		return err
 	}
 
-	// Save factory to ledger
-	return ctx.GetStub().PutState(factoryID, factoryJSON)
+	return emitFactoryRegistered(ctx, &factory)
+}
+
+// emitFactoryRegistered - Emit the FactoryRegistered event for a new factory
+func emitFactoryRegistered(ctx contractapi.TransactionContextInterface, factory *Factory) error {
+	return emitEvent(ctx, events.FactoryRegistered, events.FactoryRegisteredEvent{
+		FactoryID:       factory.ID,
+		Name:            factory.Name,
+		EnergyType:      factory.EnergyType,
+		EnergyBalance:   factory.EnergyBalance,
+		CurrencyBalance: factory.CurrencyBalance,
+		OwnerMSP:        factory.OwnerMSP,
+		Timestamp:       factory.CreatedAt,
+	})
 }
 
-// MintEnergyTokens - Generate energy tokens when factory produces surplus energy
+// MintEnergyTokens - Generate energy tokens when factory produces surplus energy (meter oracle only)
 func (c *EnergyTokenContract) MintEnergyTokens(ctx contractapi.TransactionContextInterface,
-	factoryID string, amount float64) error {
+	factoryID string, amount Amount) error {
+
+	if err := assertRole(ctx, RoleOracle); err != nil {
+		return err
+	}
 
 	// Validate amount
 	if amount <= 0 {
@@ -140,25 +280,40 @@ func (c *EnergyTokenContract) MintEnergyTokens(ctx contractapi.TransactionContex
 	}
 
 	// Add tokens to factory balance
-	factory.EnergyBalance += amount
+	factory.EnergyBalance, err = addAmount(factory.EnergyBalance, amount)
+	if err != nil {
+		return err
+	}
 
 	// Update factory on ledger
-	factoryJSON, err := json.Marshal(factory)
+	if err := putFactory(ctx, factory); err != nil {
+		return err
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
 	if err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(factoryID, factoryJSON)
+	return emitEvent(ctx, events.TokensMinted, events.TokensMintedEvent{
+		FactoryID:     factoryID,
+		Amount:        amount,
+		EnergyBalance: factory.EnergyBalance,
+		Timestamp:     txTimestamp,
+	})
 }
 
 // TransferEnergy - Transfer energy tokens from one factory to another
 func (c *EnergyTokenContract) TransferEnergy(ctx contractapi.TransactionContextInterface,
-	fromFactoryID string, toFactoryID string, amount float64) error {
+	fromFactoryID string, toFactoryID string, amount Amount) error {
 
 	// Validate amount
 	if amount <= 0 {
 		return fmt.Errorf("transfer amount must be positive")
 	}
+	if fromFactoryID == toFactoryID {
+		return fmt.Errorf("cannot transfer energy to the same factory")
+	}
 
 	// Get sender factory
 	fromFactory, err := c.GetFactory(ctx, fromFactoryID)
@@ -166,10 +321,15 @@ func (c *EnergyTokenContract) TransferEnergy(ctx contractapi.TransactionContextI
 		return err
 	}
 
-	// Check if sender has sufficient balance
-	if fromFactory.EnergyBalance < amount {
-		return fmt.Errorf("insufficient energy balance: has %.2f, needs %.2f",
-			fromFactory.EnergyBalance, amount)
+	// Only the owner of the debited factory may transfer its tokens
+	if err := assertFactoryOwner(ctx, fromFactory); err != nil {
+		return err
+	}
+
+	// Check if sender has sufficient balance outside its offer reservations
+	if spendableEnergy(fromFactory) < amount {
+		return fmt.Errorf("insufficient unreserved energy balance: has %d Wh, needs %d Wh",
+			spendableEnergy(fromFactory), amount)
 	}
 
 	// Get receiver factory
@@ -179,174 +339,225 @@ func (c *EnergyTokenContract) TransferEnergy(ctx contractapi.TransactionContextI
 	}
 
 	// Transfer tokens
-	fromFactory.EnergyBalance -= amount
-	toFactory.EnergyBalance += amount
-
-	// Update both factories on ledger
-	fromFactoryJSON, err := json.Marshal(fromFactory)
+	fromFactory.EnergyBalance, err = subAmount(fromFactory.EnergyBalance, amount)
 	if err != nil {
 		return err
 	}
-
-	toFactoryJSON, err := json.Marshal(toFactory)
+	toFactory.EnergyBalance, err = addAmount(toFactory.EnergyBalance, amount)
 	if err != nil {
 		return err
 	}
 
-	err = ctx.GetStub().PutState(fromFactoryID, fromFactoryJSON)
+	// Update both factories on ledger
+	if err := putFactory(ctx, fromFactory); err != nil {
+		return err
+	}
+	if err := putFactory(ctx, toFactory); err != nil {
+		return err
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
 	if err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(toFactoryID, toFactoryJSON)
+	return emitEvent(ctx, events.EnergyTransferred, events.EnergyTransferredEvent{
+		FromFactoryID: fromFactoryID,
+		ToFactoryID:   toFactoryID,
+		Amount:        amount,
+		Timestamp:     txTimestamp,
+	})
 }
 
-// CreateEnergyTrade - Create a new energy trade between factories
+// CreateEnergyTrade - Propose a new energy trade between factories (seller or buyer)
+// The proposer's acceptance is recorded with the trade; the counterparty must accept it
+// with AcceptTrade before it can be executed. expiresAt is the RFC 3339 deadline for
+// executing the trade ("" for the default lifetime).
 func (c *EnergyTokenContract) CreateEnergyTrade(ctx contractapi.TransactionContextInterface,
-	tradeID string, sellerID string, buyerID string, amount float64, pricePerUnit float64) error {
+	tradeID string, sellerID string, buyerID string, amount Amount, pricePerUnit Amount, expiresAt string,
+	deliveryStart string, deliveryEnd string) error {
+
+	// Validate amounts
+	if amount <= 0 {
+		return fmt.Errorf("trade amount must be positive")
+	}
+	if pricePerUnit < 0 {
+		return fmt.Errorf("price cannot be negative")
+	}
 
 	// Check if trade already exists
-	tradeJSON, err := ctx.GetStub().GetState(tradeID)
+	key, err := tradeKey(ctx, tradeID)
+	if err != nil {
+		return err
+	}
+	tradeJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return fmt.Errorf("failed to read trade: %v", err)
 	}
 	if tradeJSON != nil {
 		return fmt.Errorf("trade %s already exists", tradeID)
 	}
+	if sellerID == buyerID {
+		return fmt.Errorf("seller and buyer must be different factories")
+	}
 
 	// Validate seller has enough energy
 	seller, err := c.GetFactory(ctx, sellerID)
 	if err != nil {
 		return err
 	}
-	if seller.EnergyBalance < amount {
-		return fmt.Errorf("seller has insufficient energy balance")
+	if spendableEnergy(seller) < amount {
+		return fmt.Errorf("seller has insufficient unreserved energy balance")
 	}
 
 	// Verify buyer exists
-	_, err = c.GetFactory(ctx, buyerID)
+	buyer, err := c.GetFactory(ctx, buyerID)
 	if err != nil {
 		return err
 	}
 
-	// Calculate total price
-	totalPrice := amount * pricePerUnit
+	// Calculate total price, rounded to the nearest millime
+	totalPrice, err := tradeValue(amount, pricePerUnit)
+	if err != nil {
+		return err
+	}
 
 	// Get timestamp
-	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	expiresAt, err = tradeExpiry(txTimestamp, expiresAt)
+	if err != nil {
+		return err
+	}
+	deliveryStart, deliveryEnd, err = deliveryWindow(txTimestamp, deliveryStart, deliveryEnd)
 	if err != nil {
 		return err
 	}
 
 	// Create trade record
 	trade := EnergyTrade{
-		TradeID:      tradeID,
-		SellerID:     sellerID,
-		BuyerID:      buyerID,
-		Amount:       amount,
-		PricePerUnit: pricePerUnit,
-		TotalPrice:   totalPrice,
-		Timestamp:    txTimestamp.String(),
-		Status:       "pending",
+		TradeID:       tradeID,
+		SellerID:      sellerID,
+		BuyerID:       buyerID,
+		Amount:        amount,
+		PricePerUnit:  pricePerUnit,
+		TotalPrice:    totalPrice,
+		Timestamp:     txTimestamp,
+		Status:        TradeStatusPending,
+		ExpiresAt:     expiresAt,
+		EnergySource:  seller.EnergyType,
+		DeliveryStart: deliveryStart,
+		DeliveryEnd:   deliveryEnd,
+		SchemaVersion: currentSchemaVersion,
+	}
+
+	// The proposer must act for one side of the trade, and accepts it for that side
+	sides, err := acceptTradeSides(ctx, &trade, seller, buyer, txTimestamp)
+	if err != nil {
+		return err
+	}
+	if len(sides) == 0 {
+		return fmt.Errorf("caller is not authorized to act for factory %s or %s", sellerID, buyerID)
 	}
+	trade.ProposedBy = sides[0]
 
 	// Save trade to ledger
-	tradeJSON, err = json.Marshal(trade)
-	if err != nil {
+	if err := putTrade(ctx, &trade); err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(tradeID, tradeJSON)
+	return emitEvent(ctx, events.TradeCreated, events.TradeCreatedEvent{
+		TradeID:      trade.TradeID,
+		SellerID:     trade.SellerID,
+		BuyerID:      trade.BuyerID,
+		Amount:       trade.Amount,
+		PricePerUnit: trade.PricePerUnit,
+		TotalPrice:   trade.TotalPrice,
+		Status:       trade.Status,
+		ProposedBy:   trade.ProposedBy,
+		Timestamp:    trade.Timestamp,
+	})
 }
 
-// ExecuteTrade - Complete an energy trade transaction
+// ExecuteTrade - Execute the financial leg of an energy trade
+// The buyer's payment and the seller's energy are held in escrow until a meter or oracle
+// confirms delivery with ConfirmDelivery; without confirmation by the delivery deadline
+// RefundUndeliveredTrades returns them.
 func (c *EnergyTokenContract) ExecuteTrade(ctx contractapi.TransactionContextInterface,
 	tradeID string) error {
 
 	// Get trade from ledger
-	tradeJSON, err := ctx.GetStub().GetState(tradeID)
+	trade, err := c.GetTrade(ctx, tradeID)
 	if err != nil {
-		return fmt.Errorf("failed to read trade: %v", err)
-	}
-	if tradeJSON == nil {
-		return fmt.Errorf("trade %s does not exist", tradeID)
+		return err
 	}
 
-	var trade EnergyTrade
-	err = json.Unmarshal(tradeJSON, &trade)
+	// Only accepted pending trades that have not expired can be executed
+	txTimestamp, err := getTxTimestamp(ctx)
 	if err != nil {
 		return err
 	}
-
-	// Check if trade is already completed
-	if trade.Status == "completed" {
-		return fmt.Errorf("trade already completed")
+	if err := assertTradeExecutable(trade, txTimestamp); err != nil {
+		return err
 	}
 
-	// Verify buyer has enough TEC to pay
+	// Load both parties once; reads within a transaction do not see its own writes
 	buyer, err := c.GetFactory(ctx, trade.BuyerID)
 	if err != nil {
 		return err
 	}
-	if buyer.CurrencyBalance < trade.TotalPrice {
-		return fmt.Errorf("buyer has insufficient %s balance: has %.2f, needs %.2f",
-			TokenSymbol, buyer.CurrencyBalance, trade.TotalPrice)
-	}
-
-	// Transfer energy from seller to buyer (updates energy balances)
-	err = c.TransferEnergy(ctx, trade.SellerID, trade.BuyerID, trade.Amount)
-	if err != nil {
-		return fmt.Errorf("failed to transfer energy: %v", err)
-	}
-
-	// After successful energy transfer, move TEC from buyer to seller
 	seller, err := c.GetFactory(ctx, trade.SellerID)
 	if err != nil {
 		return err
 	}
-	// Reload buyer to ensure latest state
-	buyer, err = c.GetFactory(ctx, trade.BuyerID)
-	if err != nil {
-		return err
-	}
 
-	buyer.CurrencyBalance -= trade.TotalPrice
-	seller.CurrencyBalance += trade.TotalPrice
-
-	// Persist updated currency balances
-	buyerJSON, err := json.Marshal(buyer)
-	if err != nil {
+	// Only the seller or the buyer may execute the trade
+	if err := assertTradeParty(ctx, seller, buyer); err != nil {
 		return err
 	}
-	if err := ctx.GetStub().PutState(buyer.ID, buyerJSON); err != nil {
+
+	// Hold the buyer's TEC and the seller's energy, leaving the balances reserved by
+	// their offers untouched
+	if err := escrowTrade(seller, buyer, trade, txTimestamp); err != nil {
 		return err
 	}
 
-	sellerJSON, err := json.Marshal(seller)
-	if err != nil {
+	// Persist updated balances
+	if err := putFactory(ctx, buyer); err != nil {
 		return err
 	}
-	if err := ctx.GetStub().PutState(seller.ID, sellerJSON); err != nil {
+	if err := putFactory(ctx, seller); err != nil {
 		return err
 	}
 
-	// Update trade status
-	trade.Status = "completed"
-
 	// Save updated trade
-	tradeJSON, err = json.Marshal(trade)
-	if err != nil {
+	if err := putTrade(ctx, trade); err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(tradeID, tradeJSON)
+	return emitEvent(ctx, events.TradeExecuted, events.TradeExecutedEvent{
+		TradeID:          trade.TradeID,
+		SellerID:         trade.SellerID,
+		BuyerID:          trade.BuyerID,
+		Amount:           trade.Amount,
+		TotalPrice:       trade.TotalPrice,
+		Status:           trade.Status,
+		DeliveryDeadline: trade.DeliveryDeadline,
+		Timestamp:        txTimestamp,
+	})
 }
 
 // GetFactory - Retrieve factory information from the ledger
 func (c *EnergyTokenContract) GetFactory(ctx contractapi.TransactionContextInterface,
 	factoryID string) (*Factory, error) {
 
-	factoryJSON, err := ctx.GetStub().GetState(factoryID)
+	key, err := factoryKey(ctx, factoryID)
+	if err != nil {
+		return nil, err
+	}
+	factoryJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read factory: %v", err)
 	}
@@ -359,13 +570,16 @@ func (c *EnergyTokenContract) GetFactory(ctx contractapi.TransactionContextInter
 	if err != nil {
 		return nil, err
 	}
+	if err := checkSchemaVersion("factory", factoryID, factory.SchemaVersion); err != nil {
+		return nil, err
+	}
 
 	return &factory, nil
 }
 
 // GetEnergyBalance - Get the energy token balance of a factory
 func (c *EnergyTokenContract) GetEnergyBalance(ctx contractapi.TransactionContextInterface,
-	factoryID string) (float64, error) {
+	factoryID string) (Amount, error) {
 
 	factory, err := c.GetFactory(ctx, factoryID)
 	if err != nil {
@@ -377,7 +591,7 @@ func (c *EnergyTokenContract) GetEnergyBalance(ctx contractapi.TransactionContex
 
 // GetCurrencyBalance - Get the TEC balance of a factory
 func (c *EnergyTokenContract) GetCurrencyBalance(ctx contractapi.TransactionContextInterface,
-	factoryID string) (float64, error) {
+	factoryID string) (Amount, error) {
 
 	factory, err := c.GetFactory(ctx, factoryID)
 	if err != nil {
@@ -389,7 +603,7 @@ func (c *EnergyTokenContract) GetCurrencyBalance(ctx contractapi.TransactionCont
 
 // GetAvailableEnergy - Get the available energy of a factory
 func (c *EnergyTokenContract) GetAvailableEnergy(ctx contractapi.TransactionContextInterface,
-	factoryID string) (float64, error) {
+	factoryID string) (Amount, error) {
 
 	factory, err := c.GetFactory(ctx, factoryID)
 	if err != nil {
@@ -409,7 +623,10 @@ func (c *EnergyTokenContract) GetEnergyStatus(ctx contractapi.TransactionContext
 	}
 
 	// Calculate surplus or deficit
-	difference := factory.AvailableEnergy - factory.DailyConsumption
+	difference, err := energySurplus(factory)
+	if err != nil {
+		return nil, err
+	}
 	var status string
 
 	if difference > 0 {
@@ -434,7 +651,7 @@ func (c *EnergyTokenContract) GetEnergyStatus(ctx contractapi.TransactionContext
 
 // UpdateAvailableEnergy - Update the available energy of a factory
 func (c *EnergyTokenContract) UpdateAvailableEnergy(ctx contractapi.TransactionContextInterface,
-	factoryID string, newAvailableEnergy float64) error {
+	factoryID string, newAvailableEnergy Amount) error {
 
 	// Validate amount
 	if newAvailableEnergy < 0 {
@@ -446,22 +663,20 @@ func (c *EnergyTokenContract) UpdateAvailableEnergy(ctx contractapi.TransactionC
 	if err != nil {
 		return err
 	}
+	if err := assertFactoryOwner(ctx, factory); err != nil {
+		return err
+	}
 
 	// Update available energy
 	factory.AvailableEnergy = newAvailableEnergy
 
 	// Update factory on ledger
-	factoryJSON, err := json.Marshal(factory)
-	if err != nil {
-		return err
-	}
-
-	return ctx.GetStub().PutState(factoryID, factoryJSON)
+	return putFactory(ctx, factory)
 }
 
 // UpdateDailyConsumption - Update the daily consumption of a factory
 func (c *EnergyTokenContract) UpdateDailyConsumption(ctx contractapi.TransactionContextInterface,
-	factoryID string, newDailyConsumption float64) error {
+	factoryID string, newDailyConsumption Amount) error {
 
 	// Validate amount
 	if newDailyConsumption < 0 {
@@ -473,24 +688,26 @@ func (c *EnergyTokenContract) UpdateDailyConsumption(ctx contractapi.Transaction
 	if err != nil {
 		return err
 	}
+	if err := assertFactoryOwner(ctx, factory); err != nil {
+		return err
+	}
 
 	// Update daily consumption
 	factory.DailyConsumption = newDailyConsumption
 
 	// Update factory on ledger
-	factoryJSON, err := json.Marshal(factory)
-	if err != nil {
-		return err
-	}
-
-	return ctx.GetStub().PutState(factoryID, factoryJSON)
+	return putFactory(ctx, factory)
 }
 
 // GetTrade - Retrieve trade information from the ledger
 func (c *EnergyTokenContract) GetTrade(ctx contractapi.TransactionContextInterface,
 	tradeID string) (*EnergyTrade, error) {
 
-	tradeJSON, err := ctx.GetStub().GetState(tradeID)
+	key, err := tradeKey(ctx, tradeID)
+	if err != nil {
+		return nil, err
+	}
+	tradeJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read trade: %v", err)
 	}
@@ -503,14 +720,17 @@ func (c *EnergyTokenContract) GetTrade(ctx contractapi.TransactionContextInterfa
 	if err != nil {
 		return nil, err
 	}
+	if err := checkSchemaVersion("trade", tradeID, trade.SchemaVersion); err != nil {
+		return nil, err
+	}
 
 	return &trade, nil
 }
 
 // GetAllFactories - Query all factories in the industrial zone
 func (c *EnergyTokenContract) GetAllFactories(ctx contractapi.TransactionContextInterface) ([]*Factory, error) {
-	// Query all factories using range query - use empty strings to get all keys
-	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	// Query every key in the factory namespace
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeFactory, []string{})
 	if err != nil {
 		return nil, err
 	}
@@ -526,14 +746,9 @@ func (c *EnergyTokenContract) GetAllFactories(ctx contractapi.TransactionContext
 		var factory Factory
 		err = json.Unmarshal(queryResponse.Value, &factory)
 		if err != nil {
-			// Skip entries that aren't factories (like trades)
-			continue
-		}
-
-		// Only include if it has the Factory struct signature (has ID and Name fields)
-		if factory.ID != "" && factory.Name != "" {
-			factories = append(factories, &factory)
+			return nil, err
 		}
+		factories = append(factories, &factory)
 	}
 
 	return factories, nil
@@ -543,7 +758,11 @@ func (c *EnergyTokenContract) GetAllFactories(ctx contractapi.TransactionContext
 func (c *EnergyTokenContract) FactoryExists(ctx contractapi.TransactionContextInterface,
 	factoryID string) (bool, error) {
 
-	factoryJSON, err := ctx.GetStub().GetState(factoryID)
+	key, err := factoryKey(ctx, factoryID)
+	if err != nil {
+		return false, err
+	}
+	factoryJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return false, fmt.Errorf("failed to read from world state: %v", err)
 	}
@@ -551,53 +770,45 @@ func (c *EnergyTokenContract) FactoryExists(ctx contractapi.TransactionContextIn
 	return factoryJSON != nil, nil
 }
 
-// GetFactoryHistory - Get the transaction history of a factory
+// GetFactoryHistory - Get the transaction history of a factory (auditor only)
 func (c *EnergyTokenContract) GetFactoryHistory(ctx contractapi.TransactionContextInterface,
 	factoryID string) (string, error) {
 
-	resultsIterator, err := ctx.GetStub().GetHistoryForKey(factoryID)
-	if err != nil {
+	if err := assertRole(ctx, RoleAuditor); err != nil {
 		return "", err
 	}
-	defer resultsIterator.Close()
-
-	var history []map[string]interface{}
-	for resultsIterator.HasNext() {
-		response, err := resultsIterator.Next()
-		if err != nil {
-			return "", err
-		}
-
-		var factory Factory
-		if len(response.Value) > 0 {
-			err = json.Unmarshal(response.Value, &factory)
-			if err != nil {
-				return "", err
-			}
-		}
-
-		record := map[string]interface{}{
-			"txId":      response.TxId,
-			"value":     factory,
-			"timestamp": response.Timestamp,
-			"isDelete":  response.IsDelete,
-		}
-		history = append(history, record)
-	}
 
-	historyJSON, err := json.Marshal(history)
+	key, err := factoryKey(ctx, factoryID)
 	if err != nil {
 		return "", err
 	}
-
-	return string(historyJSON), nil
+	return getKeyHistory(ctx, key)
 }
 
-// RegisterFactoryWithAuth - Register a new factory with authentication credentials
+// RegisterFactoryWithAuth - Register a new factory with authentication credentials (zone operator only)
+// The email, password hash and contact information are passed as FactoryPrivateDetails JSON
+// under the "factory_details" transient key and stored in the private data collection of the
+// caller's organization, which owns the factory; emails are unique within an organization.
 func (c *EnergyTokenContract) RegisterFactoryWithAuth(ctx contractapi.TransactionContextInterface,
-	factoryID string, name string, email string, passwordHash string, localisation string,
-	fiscalMatricule string, energyCapacity float64, contactInfo string, energySource string,
-	initialBalance float64, currencyBalance float64) error {
+	factoryID string, name string, localisation string, fiscalMatricule string,
+	energyCapacity Amount, energySource string, initialBalance Amount, currencyBalance Amount) error {
+
+	if err := assertRole(ctx, RoleOperator); err != nil {
+		return err
+	}
+	if energyCapacity < 0 || initialBalance < 0 || currencyBalance < 0 {
+		return fmt.Errorf("capacity and balances cannot be negative")
+	}
+	if err := assertEnergySource(energySource); err != nil {
+		return err
+	}
+
+	// Read sensitive details from the transient map so they never reach the public ledger
+	details, err := readTransientFactoryDetails(ctx)
+	if err != nil {
+		return err
+	}
+	details.FactoryID = factoryID
 
 	// Check if factory already exists
 	exists, err := c.FactoryExists(ctx, factoryID)
@@ -608,28 +819,33 @@ func (c *EnergyTokenContract) RegisterFactoryWithAuth(ctx contractapi.Transactio
 		return fmt.Errorf("factory %s already exists", factoryID)
 	}
 
-	// Check if email is already registered
-	emailKey := "email_" + email
-	existingFactory, err := ctx.GetStub().GetState(emailKey)
+	// The registering identity owns the factory until SetFactoryOwner hands it over, and its
+	// organization's collection holds the private details
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Check if email is already registered with the organization
+	existingFactory, err := getEmailIndex(ctx, caller.MSPID, details.Email)
 	if err != nil {
-		return fmt.Errorf("failed to check email: %v", err)
+		return err
 	}
-	if existingFactory != nil {
-		return fmt.Errorf("email %s is already registered", email)
+	if existingFactory != "" {
+		return fmt.Errorf("email %s is already registered", details.Email)
 	}
 
 	// Check if fiscal matricule is already registered
-	fiscalKey := "fiscal_" + fiscalMatricule
-	existingFiscal, err := ctx.GetStub().GetState(fiscalKey)
+	existingFiscal, err := getIndex(ctx, indexFiscal, fiscalMatricule)
 	if err != nil {
-		return fmt.Errorf("failed to check fiscal matricule: %v", err)
+		return err
 	}
-	if existingFiscal != nil {
+	if existingFiscal != "" {
 		return fmt.Errorf("fiscal matricule %s is already registered", fiscalMatricule)
 	}
 
 	// Get timestamp
-	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	txTimestamp, err := getTxTimestamp(ctx)
 	if err != nil {
 		return err
 	}
@@ -643,133 +859,187 @@ func (c *EnergyTokenContract) RegisterFactoryWithAuth(ctx contractapi.Transactio
 		CurrencyBalance:    currencyBalance,
 		DailyConsumption:   0,
 		AvailableEnergy:    initialBalance,
-		Email:              email,
-		PasswordHash:       passwordHash,
 		Localisation:       localisation,
 		FiscalMatricule:    fiscalMatricule,
 		EnergyCapacity:     energyCapacity,
-		ContactInfo:        contactInfo,
 		CurrentGeneration:  0,
 		CurrentConsumption: 0,
-		CreatedAt:          txTimestamp.String(),
+		CreatedAt:          txTimestamp,
+		OwnerMSP:           caller.MSPID,
+		OwnerID:            caller.ID,
+		SchemaVersion:      currentSchemaVersion,
 	}
 
-	// Marshal factory to JSON
-	factoryJSON, err := json.Marshal(factory)
+	// Save private details (with the email index for login lookup) and keep their hash publicly
+	factory.PrivateDetailsHash, err = putFactoryPrivateDetails(ctx, factory.OwnerMSP, details)
 	if err != nil {
 		return err
 	}
 
 	// Save factory to ledger
-	err = ctx.GetStub().PutState(factoryID, factoryJSON)
-	if err != nil {
-		return err
-	}
-
-	// Create email index for login lookup
-	err = ctx.GetStub().PutState(emailKey, []byte(factoryID))
+	err = putFactory(ctx, &factory)
 	if err != nil {
 		return err
 	}
 
 	// Create fiscal matricule index
-	err = ctx.GetStub().PutState(fiscalKey, []byte(factoryID))
+	err = putIndex(ctx, indexFiscal, fiscalMatricule, factoryID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return emitFactoryRegistered(ctx, &factory)
 }
 
 // GetFactoryByEmail - Get factory ID by email for authentication
+// The email index lives in the private collection of the caller's organization, so only factories
+// it registered are found and the query must target one of its peers.
 func (c *EnergyTokenContract) GetFactoryByEmail(ctx contractapi.TransactionContextInterface,
 	email string) (*Factory, error) {
 
-	emailKey := "email_" + email
-	factoryIDBytes, err := ctx.GetStub().GetState(emailKey)
+	caller, err := getCallerIdentity(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read email index: %v", err)
+		return nil, err
+	}
+	factoryID, err := getEmailIndex(ctx, caller.MSPID, email)
+	if err != nil {
+		return nil, err
 	}
-	if factoryIDBytes == nil {
+	if factoryID == "" {
 		return nil, fmt.Errorf("no factory found with email %s", email)
 	}
 
-	factoryID := string(factoryIDBytes)
 	return c.GetFactory(ctx, factoryID)
 }
 
-// UpdateFactoryEnergy - Update energy-related fields of a factory
+// UpdateFactoryEnergy - Update energy-related fields of a factory from meter readings (meter oracle only)
+// The energy balance cannot drop below the energy the factory holds in reserve.
 func (c *EnergyTokenContract) UpdateFactoryEnergy(ctx contractapi.TransactionContextInterface,
-	factoryID string, energyBalance float64, currentGeneration float64, currentConsumption float64) error {
+	factoryID string, energyBalance Amount, currentGeneration Amount, currentConsumption Amount) error {
+
+	if err := assertRole(ctx, RoleOracle); err != nil {
+		return err
+	}
+	if energyBalance < 0 || currentGeneration < 0 || currentConsumption < 0 {
+		return fmt.Errorf("energy readings cannot be negative")
+	}
 
 	factory, err := c.GetFactory(ctx, factoryID)
 	if err != nil {
 		return err
 	}
+	if energyBalance < factory.ReservedEnergy {
+		return fmt.Errorf("energy balance of factory %s cannot drop below the %d Wh it holds in reserve",
+			factoryID, factory.ReservedEnergy)
+	}
 
 	factory.EnergyBalance = energyBalance
 	factory.CurrentGeneration = currentGeneration
 	factory.CurrentConsumption = currentConsumption
 
-	factoryJSON, err := json.Marshal(factory)
-	if err != nil {
-		return err
-	}
-
-	return ctx.GetStub().PutState(factoryID, factoryJSON)
+	return putFactory(ctx, factory)
 }
 
 // CreateOffer - Create a new energy offer
+// A sell offer reserves the advertised energy and a buy offer reserves its TEC value
+// until the offer is no longer active. A buy offer may list the energy sources it
+// accepts, comma-separated ("" for any source).
 func (c *EnergyTokenContract) CreateOffer(ctx contractapi.TransactionContextInterface,
-	offerID string, factoryID string, offerType string, energyAmount float64, pricePerKwh float64) error {
+	offerID string, factoryID string, offerType string, energyAmount Amount, pricePerKwh Amount,
+	deliveryStart string, deliveryEnd string, validUntil string, acceptedSources string) error {
 
-	// Verify factory exists
-	_, err := c.GetFactory(ctx, factoryID)
+	// Validate offer type and amounts
+	if offerType != OfferTypeBuy && offerType != OfferTypeSell {
+		return fmt.Errorf("offer type must be %s or %s", OfferTypeBuy, OfferTypeSell)
+	}
+	if energyAmount <= 0 {
+		return fmt.Errorf("offer energy amount must be positive")
+	}
+	if pricePerKwh < 0 {
+		return fmt.Errorf("price cannot be negative")
+	}
+	sources, err := offerSources(offerType, acceptedSources)
 	if err != nil {
 		return err
 	}
 
-	// Check if offer already exists
-	offerKey := "offer_" + offerID
-	existingOffer, err := ctx.GetStub().GetState(offerKey)
+	// Verify factory exists and belongs to the caller
+	factory, err := c.GetFactory(ctx, factoryID)
 	if err != nil {
-		return fmt.Errorf("failed to read offer: %v", err)
+		return err
 	}
-	if existingOffer != nil {
-		return fmt.Errorf("offer %s already exists", offerID)
+	if err := assertFactoryOwner(ctx, factory); err != nil {
+		return err
+	}
+
+	// Check if offer already exists
+	if err := assertNewOffer(ctx, offerID); err != nil {
+		return err
 	}
 
 	// Get timestamp
-	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	deliveryStart, deliveryEnd, err = deliveryWindow(txTimestamp, deliveryStart, deliveryEnd)
+	if err != nil {
+		return err
+	}
+	validUntil, err = offerValidity(txTimestamp, validUntil, deliveryStart)
 	if err != nil {
 		return err
 	}
 
 	offer := Offer{
-		ID:           offerID,
-		FactoryID:    factoryID,
-		OfferType:    offerType,
-		EnergyAmount: energyAmount,
-		PricePerKwh:  pricePerKwh,
-		Status:       "active",
-		CreatedAt:    txTimestamp.String(),
-		UpdatedAt:    txTimestamp.String(),
+		ID:              offerID,
+		FactoryID:       factoryID,
+		OfferType:       offerType,
+		EnergyType:      factory.EnergyType,
+		EnergyAmount:    energyAmount,
+		PricePerKwh:     pricePerKwh,
+		Status:          OfferStatusActive,
+		DeliveryStart:   deliveryStart,
+		DeliveryEnd:     deliveryEnd,
+		ValidUntil:      validUntil,
+		AcceptedSources: sources,
+		CreatedAt:       txTimestamp,
+		UpdatedAt:       txTimestamp,
+		SchemaVersion:   currentSchemaVersion,
+	}
+
+	// Lock the energy or TEC the offer promises
+	if err := reserveOffer(factory, &offer); err != nil {
+		return err
 	}
-
-	offerJSON, err := json.Marshal(offer)
-	if err != nil {
+	if err := putFactory(ctx, factory); err != nil {
+		return err
+	}
+	if err := putOffer(ctx, &offer); err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(offerKey, offerJSON)
+	return emitEvent(ctx, events.OfferCreated, events.OfferCreatedEvent{
+		OfferID:         offer.ID,
+		FactoryID:       offer.FactoryID,
+		OfferType:       offer.OfferType,
+		EnergyType:      offer.EnergyType,
+		AcceptedSources: offer.AcceptedSources,
+		EnergyAmount:    offer.EnergyAmount,
+		PricePerKwh:     offer.PricePerKwh,
+		Timestamp:       offer.CreatedAt,
+	})
 }
 
 // GetOffer - Get an offer by ID
 func (c *EnergyTokenContract) GetOffer(ctx contractapi.TransactionContextInterface,
 	offerID string) (*Offer, error) {
 
-	offerKey := "offer_" + offerID
-	offerJSON, err := ctx.GetStub().GetState(offerKey)
+	key, err := offerKey(ctx, offerID)
+	if err != nil {
+		return nil, err
+	}
+	offerJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read offer: %v", err)
 	}
@@ -782,11 +1052,16 @@ func (c *EnergyTokenContract) GetOffer(ctx contractapi.TransactionContextInterfa
 	if err != nil {
 		return nil, err
 	}
+	if err := checkSchemaVersion("offer", offerID, offer.SchemaVersion); err != nil {
+		return nil, err
+	}
 
 	return &offer, nil
 }
 
 // UpdateOfferStatus - Update the status of an offer
+// Only the transitions in offerTransitions are allowed. Leaving the active status releases
+// the offer's reservation; reactivating it reserves again.
 func (c *EnergyTokenContract) UpdateOfferStatus(ctx contractapi.TransactionContextInterface,
 	offerID string, status string) error {
 
@@ -795,27 +1070,90 @@ func (c *EnergyTokenContract) UpdateOfferStatus(ctx contractapi.TransactionConte
 		return err
 	}
 
+	// Only the owner of the offering factory may change its offer
+	factory, err := c.GetFactory(ctx, offer.FactoryID)
+	if err != nil {
+		return err
+	}
+	if err := assertFactoryOwner(ctx, factory); err != nil {
+		return err
+	}
+
 	// Get timestamp
-	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	txTimestamp, err := getTxTimestamp(ctx)
 	if err != nil {
 		return err
 	}
 
+	if err := assertOfferTransition(offer.Status, status); err != nil {
+		return err
+	}
+
+	// Book and auction orders cannot return once withdrawn, and auction orders are frozen
+	// at gate closure
+	if (offer.BookPriority != "" || offer.IntervalID != "") && offer.Status != OfferStatusActive && status == OfferStatusActive {
+		return fmt.Errorf("order %s cannot be reactivated; place a new order instead", offerID)
+	}
+	if offer.IntervalID != "" {
+		auction, err := c.GetAuction(ctx, offer.IntervalID)
+		if err != nil {
+			return err
+		}
+		if err := assertAuctionOpen(auction, txTimestamp); err != nil {
+			return err
+		}
+	}
+
+	previousStatus := offer.Status
 	offer.Status = status
-	offer.UpdatedAt = txTimestamp.String()
+	offer.UpdatedAt = txTimestamp
 
-	offerKey := "offer_" + offerID
-	offerJSON, err := json.Marshal(offer)
-	if err != nil {
+	if (previousStatus == OfferStatusActive || previousStatus == OfferStatusPending) && status != OfferStatusActive {
+		if err := releaseOffer(factory, offer); err != nil {
+			return err
+		}
+		if err := removeFromBook(ctx, offer); err != nil {
+			return err
+		}
+		if err := removeFromAuction(ctx, offer); err != nil {
+			return err
+		}
+	} else if previousStatus != OfferStatusActive && status == OfferStatusActive {
+		if err := assertSlotOpen(txTimestamp, offer.DeliveryStart); err != nil {
+			return err
+		}
+		if offerExpired(offer, txTimestamp) {
+			return fmt.Errorf("offer %s expired at %s", offerID, offer.ValidUntil)
+		}
+		if err := reserveOffer(factory, offer); err != nil {
+			return err
+		}
+	}
+
+	if err := putFactory(ctx, factory); err != nil {
+		return err
+	}
+	if err := putOffer(ctx, offer); err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(offerKey, offerJSON)
+	return emitEvent(ctx, events.OfferStatusChanged, events.OfferStatusChangedEvent{
+		OfferID:        offer.ID,
+		FactoryID:      offer.FactoryID,
+		PreviousStatus: previousStatus,
+		Status:         offer.Status,
+		Timestamp:      offer.UpdatedAt,
+	})
 }
 
-// GetAllOffers - Get all active offers
+// GetAllOffers - Get all active offers that have not expired
 func (c *EnergyTokenContract) GetAllOffers(ctx contractapi.TransactionContextInterface) ([]*Offer, error) {
-	resultsIterator, err := ctx.GetStub().GetStateByRange("offer_", "offer_~")
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeOffer, []string{})
 	if err != nil {
 		return nil, err
 	}
@@ -831,11 +1169,11 @@ func (c *EnergyTokenContract) GetAllOffers(ctx contractapi.TransactionContextInt
 		var offer Offer
 		err = json.Unmarshal(queryResponse.Value, &offer)
 		if err != nil {
-			continue
+			return nil, err
 		}
 
-		// Only include active offers
-		if offer.Status == "active" {
+		// Only include active offers still within their validity
+		if offerLive(&offer, txTimestamp) {
 			offers = append(offers, &offer)
 		}
 	}
@@ -843,9 +1181,9 @@ func (c *EnergyTokenContract) GetAllOffers(ctx contractapi.TransactionContextInt
 	return offers, nil
 }
 
-// GetAllTrades - Get all trades (optionally filtered by factory)
+// GetAllTrades - Get all trades
 func (c *EnergyTokenContract) GetAllTrades(ctx contractapi.TransactionContextInterface) ([]*EnergyTrade, error) {
-	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeTrade, []string{})
 	if err != nil {
 		return nil, err
 	}
@@ -858,26 +1196,12 @@ func (c *EnergyTokenContract) GetAllTrades(ctx contractapi.TransactionContextInt
 			return nil, err
 		}
 
-		// Skip keys that are clearly not trades (indexes and offers)
-		key := queryResponse.Key
-		if len(key) > 6 && (key[:6] == "email_" || key[:6] == "offer_") {
-			continue
-		}
-		if len(key) > 7 && key[:7] == "fiscal_" {
-			continue
-		}
-
 		var trade EnergyTrade
 		err = json.Unmarshal(queryResponse.Value, &trade)
 		if err != nil {
-			continue
-		}
-
-		// Verify this is a valid trade by checking for required trade-specific fields
-		// Trades must have TradeID, SellerID, BuyerID, and Status
-		if trade.TradeID != "" && trade.SellerID != "" && trade.BuyerID != "" && trade.Status != "" {
-			trades = append(trades, &trade)
+			return nil, err
 		}
+		trades = append(trades, &trade)
 	}
 
 	return trades, nil
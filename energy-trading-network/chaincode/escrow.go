@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+)
+
+// spendableEnergy - Energy a factory can move without touching reservations (Wh)
+func spendableEnergy(factory *Factory) Amount {
+	return factory.EnergyBalance - factory.ReservedEnergy
+}
+
+// spendableCurrency - TEC a factory can move without touching reservations (millimes)
+func spendableCurrency(factory *Factory) Amount {
+	return factory.CurrencyBalance - factory.ReservedCurrency
+}
+
+// offerReservation - Energy (Wh) and TEC (millimes) an active offer must hold for its remainder
+// A sell offer holds the energy it still advertises; a buy offer holds the most its
+// remaining fills can cost, which is what they cost at its limit price (see fillValue).
+func offerReservation(offer *Offer) (Amount, Amount, error) {
+	switch offer.OfferType {
+	case OfferTypeSell:
+		return offerRemaining(offer), 0, nil
+	case OfferTypeBuy:
+		currency, err := fillValue(offer, offerRemaining(offer), offer.PricePerKwh)
+		return 0, currency, err
+	}
+	return 0, 0, fmt.Errorf("offer type must be %s or %s", OfferTypeBuy, OfferTypeSell)
+}
+
+// fillValue - Value in millimes of filling quantity Wh of an offer at a price (millimes per kWh)
+// Fills are valued on the offer's running notional rather than one by one: a fill is worth
+// the rounded value of everything filled so far, itself included, less the rounded value of
+// the earlier fills. However an offer is split, its fills then add up to the value of the
+// whole, so they never cost more than the offer reserved.
+func fillValue(offer *Offer, quantity Amount, pricePerKwh Amount) (Amount, error) {
+	notional, err := mulDivAmount(quantity, pricePerKwh, 1)
+	if err != nil {
+		return 0, err
+	}
+	if notional, err = addAmount(offer.FilledNotional, notional); err != nil {
+		return 0, err
+	}
+	before, err := mulDivAmount(offer.FilledNotional, 1, WhPerKwh)
+	if err != nil {
+		return 0, err
+	}
+	after, err := mulDivAmount(notional, 1, WhPerKwh)
+	if err != nil {
+		return 0, err
+	}
+	return after - before, nil
+}
+
+// reserveFunds - Lock part of a factory's unreserved balances
+func reserveFunds(factory *Factory, energy Amount, currency Amount) error {
+	if spendableEnergy(factory) < energy {
+		return fmt.Errorf("factory %s has insufficient unreserved energy: has %d Wh, needs %d Wh",
+			factory.ID, spendableEnergy(factory), energy)
+	}
+	if spendableCurrency(factory) < currency {
+		return fmt.Errorf("factory %s has insufficient unreserved %s balance: has %d millimes, needs %d millimes",
+			factory.ID, TokenSymbol, spendableCurrency(factory), currency)
+	}
+
+	var err error
+	if factory.ReservedEnergy, err = addAmount(factory.ReservedEnergy, energy); err != nil {
+		return err
+	}
+	factory.ReservedCurrency, err = addAmount(factory.ReservedCurrency, currency)
+	return err
+}
+
+// releaseFunds - Unlock previously reserved balances of a factory
+func releaseFunds(factory *Factory, energy Amount, currency Amount) error {
+	if energy < 0 || currency < 0 || factory.ReservedEnergy < energy || factory.ReservedCurrency < currency {
+		return fmt.Errorf("factory %s does not hold the reservation being released", factory.ID)
+	}
+
+	factory.ReservedEnergy -= energy
+	factory.ReservedCurrency -= currency
+	return nil
+}
+
+// offerRemaining - Energy of an offer still open for filling (Wh)
+func offerRemaining(offer *Offer) Amount {
+	return offer.EnergyAmount - offer.FilledAmount
+}
+
+// reserveOffer - Lock the funds an active offer needs and record them on the offer
+func reserveOffer(factory *Factory, offer *Offer) error {
+	energy, currency, err := offerReservation(offer)
+	if err != nil {
+		return err
+	}
+	if err := reserveFunds(factory, energy, currency); err != nil {
+		return err
+	}
+
+	offer.ReservedEnergy = energy
+	offer.ReservedCurrency = currency
+	return nil
+}
+
+// releaseOffer - Unlock whatever an offer still holds
+func releaseOffer(factory *Factory, offer *Offer) error {
+	if err := releaseFunds(factory, offer.ReservedEnergy, offer.ReservedCurrency); err != nil {
+		return err
+	}
+
+	offer.ReservedEnergy = 0
+	offer.ReservedCurrency = 0
+	return nil
+}
+
+// fillOffer - Record a fill of quantity Wh at a price (millimes per kWh) on an offer and
+// release the reservation backing it
+// The offer keeps exactly the reservation its remaining energy needs, and is completed once
+// nothing remains. Returns the fill's value (see fillValue); the released funds are then
+// held by escrowTrade.
+func fillOffer(factory *Factory, offer *Offer, quantity Amount, pricePerKwh Amount) (Amount, error) {
+	if quantity <= 0 || quantity > offerRemaining(offer) {
+		return 0, fmt.Errorf("quantity must be between 1 and %d Wh", offerRemaining(offer))
+	}
+	value, err := fillValue(offer, quantity, pricePerKwh)
+	if err != nil {
+		return 0, err
+	}
+
+	notional, err := mulDivAmount(quantity, pricePerKwh, 1)
+	if err != nil {
+		return 0, err
+	}
+	if offer.FilledNotional, err = addAmount(offer.FilledNotional, notional); err != nil {
+		return 0, err
+	}
+	offer.FilledAmount += quantity
+	energy, currency, err := offerReservation(offer)
+	if err != nil {
+		return 0, err
+	}
+
+	// Fills below a buy offer's limit price leave part of its reservation unused
+	if err := releaseFunds(factory, offer.ReservedEnergy-energy, offer.ReservedCurrency-currency); err != nil {
+		return 0, err
+	}
+	offer.ReservedEnergy = energy
+	offer.ReservedCurrency = currency
+
+	if offerRemaining(offer) == 0 {
+		offer.Status = OfferStatusCompleted
+	}
+	return value, nil
+}
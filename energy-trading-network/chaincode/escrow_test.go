@@ -0,0 +1,148 @@
+package main
+
+import "testing"
+
+func TestOfferReservation(t *testing.T) {
+	tests := []struct {
+		name         string
+		offer        *Offer
+		wantEnergy   Amount
+		wantCurrency Amount
+		wantErr      bool
+	}{
+		{name: "sell holds energy", offer: &Offer{OfferType: OfferTypeSell, EnergyAmount: 5000, PricePerKwh: 300}, wantEnergy: 5000},
+		{name: "sell holds its remainder", offer: &Offer{OfferType: OfferTypeSell, EnergyAmount: 5000, FilledAmount: 2000, PricePerKwh: 300}, wantEnergy: 3000},
+		{name: "buy holds its cost", offer: &Offer{OfferType: OfferTypeBuy, EnergyAmount: 5000, PricePerKwh: 300}, wantCurrency: 1500},
+		{name: "buy cost rounds half up", offer: &Offer{OfferType: OfferTypeBuy, EnergyAmount: 3, PricePerKwh: 500}, wantCurrency: 2},
+		// 1 Wh filled at 500 was paid 1 millime (0.5 rounded up); the whole 3 Wh are worth 2
+		{name: "buy remainder after a rounded up fill", offer: &Offer{OfferType: OfferTypeBuy, EnergyAmount: 3, FilledAmount: 1, FilledNotional: 500, PricePerKwh: 500}, wantCurrency: 1},
+		{name: "buy remainder after a fill below its limit", offer: &Offer{OfferType: OfferTypeBuy, EnergyAmount: 3000, FilledAmount: 1000, FilledNotional: 200000, PricePerKwh: 300}, wantCurrency: 600},
+		{name: "unknown type", offer: &Offer{OfferType: "swap", EnergyAmount: 5000, PricePerKwh: 300}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			energy, currency, err := offerReservation(tt.offer)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if energy != tt.wantEnergy || currency != tt.wantCurrency {
+				t.Errorf("got %d Wh, %d millimes, want %d Wh, %d millimes", energy, currency, tt.wantEnergy, tt.wantCurrency)
+			}
+		})
+	}
+}
+
+func TestReserveFunds(t *testing.T) {
+	tests := []struct {
+		name     string
+		energy   Amount
+		currency Amount
+		wantErr  bool
+	}{
+		{name: "within unreserved balances", energy: 600, currency: 300},
+		{name: "all unreserved balances", energy: 700, currency: 400},
+		{name: "more energy than unreserved", energy: 701, wantErr: true},
+		{name: "more TEC than unreserved", currency: 401, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			factory := &Factory{ID: "F1", EnergyBalance: 1000, ReservedEnergy: 300, CurrencyBalance: 500, ReservedCurrency: 100}
+			err := reserveFunds(factory, tt.energy, tt.currency)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				if factory.ReservedEnergy != 300 || factory.ReservedCurrency != 100 {
+					t.Errorf("failed reservation changed the factory: %+v", factory)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if factory.ReservedEnergy != 300+tt.energy || factory.ReservedCurrency != 100+tt.currency {
+				t.Errorf("reserved %d Wh, %d millimes", factory.ReservedEnergy, factory.ReservedCurrency)
+			}
+			if err := releaseFunds(factory, tt.energy, tt.currency); err != nil {
+				t.Fatal(err)
+			}
+			if factory.ReservedEnergy != 300 || factory.ReservedCurrency != 100 {
+				t.Errorf("release left %d Wh, %d millimes reserved", factory.ReservedEnergy, factory.ReservedCurrency)
+			}
+		})
+	}
+}
+
+func TestFillOfferReleasesReservation(t *testing.T) {
+	// 3 Wh at 500 millimes/kWh holds 2 millimes (1.5 rounded up), all the factory has. The
+	// fills cost 1, 0 and 1 millimes, so each is paid from what the offer releases.
+	factory := &Factory{ID: "F1", CurrencyBalance: 2}
+	offer := &Offer{ID: "O1", OfferType: OfferTypeBuy, EnergyAmount: 3, PricePerKwh: 500, Status: OfferStatusActive}
+	if err := reserveOffer(factory, offer); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		wantValue    Amount
+		wantReserved Amount
+		wantStatus   string
+	}{
+		{wantValue: 1, wantReserved: 1, wantStatus: OfferStatusActive},
+		{wantValue: 0, wantReserved: 1, wantStatus: OfferStatusActive},
+		{wantValue: 1, wantReserved: 0, wantStatus: OfferStatusCompleted},
+	}
+	for i, step := range steps {
+		value, err := fillOffer(factory, offer, 1, offer.PricePerKwh)
+		if err != nil {
+			t.Fatalf("fill %d: %v", i+1, err)
+		}
+		if value != step.wantValue {
+			t.Errorf("fill %d: worth %d millimes, want %d", i+1, value, step.wantValue)
+		}
+		if offer.ReservedCurrency != step.wantReserved {
+			t.Errorf("fill %d: offer holds %d millimes, want %d", i+1, offer.ReservedCurrency, step.wantReserved)
+		}
+		if offer.Status != step.wantStatus {
+			t.Errorf("fill %d: status %s, want %s", i+1, offer.Status, step.wantStatus)
+		}
+
+		// The trade escrow holds the fill's value out of what was released
+		if err := reserveFunds(factory, 0, value); err != nil {
+			t.Fatalf("fill %d: %v", i+1, err)
+		}
+	}
+	if factory.ReservedCurrency != factory.CurrencyBalance {
+		t.Errorf("escrow holds %d of %d millimes", factory.ReservedCurrency, factory.CurrencyBalance)
+	}
+
+	if _, err := fillOffer(factory, offer, 1, offer.PricePerKwh); err == nil {
+		t.Error("filling a completed offer should fail")
+	}
+}
+
+func TestFillOfferBelowLimit(t *testing.T) {
+	// 2000 Wh at up to 300 millimes/kWh hold 600 millimes; a fill of half at 200 costs 200
+	// and leaves 300 held for the other half, so 100 return to the factory
+	factory := &Factory{ID: "F1", CurrencyBalance: 600}
+	offer := &Offer{ID: "O1", OfferType: OfferTypeBuy, EnergyAmount: 2000, PricePerKwh: 300, Status: OfferStatusActive}
+	if err := reserveOffer(factory, offer); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := fillOffer(factory, offer, 1000, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 200 || offer.ReservedCurrency != 300 || factory.ReservedCurrency != 300 {
+		t.Errorf("fill worth %d, offer holds %d, factory holds %d millimes; want 200, 300, 300",
+			value, offer.ReservedCurrency, factory.ReservedCurrency)
+	}
+}
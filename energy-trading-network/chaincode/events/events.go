@@ -0,0 +1,333 @@
+// Package events defines the chaincode events emitted by the energy token contract.
+//
+// Client applications subscribe to chaincode events on the channel and decode the
+// payload of each event into the struct named after it. Fabric keeps a single event
+// per transaction, so every transaction emits at most one of these events.
+// Energy amounts are in Wh, TEC amounts in millimes and prices in millimes per kWh.
+package events
+
+// Event names passed to SetEvent
+const (
+	FactoryRegistered      = "FactoryRegistered"
+	TokensMinted           = "TokensMinted"
+	EnergyTransferred      = "EnergyTransferred"
+	TradeCreated           = "TradeCreated"
+	TradeAccepted          = "TradeAccepted"
+	TradeExecuted          = "TradeExecuted"
+	DeliveryConfirmed      = "DeliveryConfirmed"
+	TradeStatusChanged     = "TradeStatusChanged"
+	TradesExpired          = "TradesExpired"
+	TradesRefunded         = "TradesRefunded"
+	OfferCreated           = "OfferCreated"
+	OfferStatusChanged     = "OfferStatusChanged"
+	OfferAccepted          = "OfferAccepted"
+	OfferAmended           = "OfferAmended"
+	OffersExpired          = "OffersExpired"
+	FeeScheduleSet         = "FeeScheduleSet"
+	TreasuryWithdrawn      = "TreasuryWithdrawn"
+	TaxRateSet             = "TaxRateSet"
+	ImbalanceMultiplierSet = "ImbalanceMultiplierSet"
+	BatchSettled           = "BatchSettled"
+	BatchDelivered         = "BatchDelivered"
+	OrderPlaced            = "OrderPlaced"
+	AuctionOpened          = "AuctionOpened"
+	AuctionCleared         = "AuctionCleared"
+	LotOpened              = "LotOpened"
+	BidCommitted           = "BidCommitted"
+	BidRevealed            = "BidRevealed"
+	LotSettled             = "LotSettled"
+)
+
+// FactoryRegisteredEvent - A factory joined the industrial zone
+type FactoryRegisteredEvent struct {
+	FactoryID       string `json:"factoryId"`       // Registered factory
+	Name            string `json:"name"`            // Factory name
+	EnergyType      string `json:"energyType"`      // Type of energy source
+	EnergyBalance   int64  `json:"energyBalance"`   // Initial energy balance in Wh
+	CurrencyBalance int64  `json:"currencyBalance"` // Initial TEC balance in millimes
+	OwnerMSP        string `json:"ownerMsp"`        // MSP ID of the owning identity
+	Timestamp       string `json:"timestamp"`       // Transaction timestamp
+}
+
+// TokensMintedEvent - Energy tokens were minted for a factory
+type TokensMintedEvent struct {
+	FactoryID     string `json:"factoryId"`     // Credited factory
+	Amount        int64  `json:"amount"`        // Minted energy in Wh
+	EnergyBalance int64  `json:"energyBalance"` // Energy balance after minting in Wh
+	Timestamp     string `json:"timestamp"`     // Transaction timestamp
+}
+
+// EnergyTransferredEvent - Energy tokens moved between factories outside a trade
+type EnergyTransferredEvent struct {
+	FromFactoryID string `json:"fromFactoryId"` // Debited factory
+	ToFactoryID   string `json:"toFactoryId"`   // Credited factory
+	Amount        int64  `json:"amount"`        // Transferred energy in Wh
+	Timestamp     string `json:"timestamp"`     // Transaction timestamp
+}
+
+// TradeCreatedEvent - A trade between two factories was recorded
+type TradeCreatedEvent struct {
+	TradeID      string `json:"tradeId"`      // Trade identifier
+	SellerID     string `json:"sellerId"`     // Factory selling energy
+	BuyerID      string `json:"buyerId"`      // Factory buying energy
+	Amount       int64  `json:"amount"`       // Energy in Wh
+	PricePerUnit int64  `json:"pricePerUnit"` // Price per kWh in millimes
+	TotalPrice   int64  `json:"totalPrice"`   // Trade value in millimes
+	Status       string `json:"status"`       // Trade status after creation
+	ProposedBy   string `json:"proposedBy"`   // Side that proposed the trade (seller or buyer)
+	Timestamp    string `json:"timestamp"`    // Transaction timestamp
+}
+
+// TradeAcceptedEvent - A party accepted a proposed trade
+type TradeAcceptedEvent struct {
+	TradeID   string   `json:"tradeId"`   // Trade identifier
+	Sides     []string `json:"sides"`     // Sides accepted by this transaction (seller, buyer)
+	MSPID     string   `json:"mspId"`     // MSP ID of the accepting identity
+	ClientID  string   `json:"clientId"`  // Certificate ID of the accepting identity
+	Accepted  bool     `json:"accepted"`  // Whether both sides have now accepted
+	Timestamp string   `json:"timestamp"` // Transaction timestamp
+}
+
+// TradeExecutedEvent - A trade was executed; the buyer's TEC is held in escrow until delivery is confirmed
+type TradeExecutedEvent struct {
+	TradeID          string `json:"tradeId"`          // Trade identifier
+	SellerID         string `json:"sellerId"`         // Factory that delivers energy
+	BuyerID          string `json:"buyerId"`          // Factory that pays
+	Amount           int64  `json:"amount"`           // Energy in Wh
+	TotalPrice       int64  `json:"totalPrice"`       // Gross trade value held in escrow in millimes
+	Status           string `json:"status"`           // Trade status after execution
+	DeliveryDeadline string `json:"deliveryDeadline"` // Last moment delivery can be confirmed
+	Timestamp        string `json:"timestamp"`        // Transaction timestamp
+}
+
+// DeliveryConfirmedEvent - A meter or oracle confirmed delivery of an escrowed trade, which settled
+// A shortfall is settled as an imbalance (see GetImbalance).
+type DeliveryConfirmedEvent struct {
+	TradeID         string `json:"tradeId"`         // Trade identifier
+	SellerID        string `json:"sellerId"`        // Factory that delivered energy
+	BuyerID         string `json:"buyerId"`         // Factory that paid
+	Amount          int64  `json:"amount"`          // Energy in Wh
+	TotalPrice      int64  `json:"totalPrice"`      // Gross trade value in millimes
+	Fee             int64  `json:"fee"`             // Platform fee taken from the seller's proceeds in millimes
+	NetAmount       int64  `json:"netAmount"`       // Value received by the seller in millimes
+	InvoiceNumber   string `json:"invoiceNumber"`   // Tax invoice issued for the delivered energy
+	DeliveredAmount int64  `json:"deliveredAmount"` // Energy metered as delivered in Wh
+	Shortfall       int64  `json:"shortfall"`       // Energy not delivered in Wh
+	Refund          int64  `json:"refund"`          // Contracted value of the shortfall returned to the buyer in millimes
+	Compensation    int64  `json:"compensation"`    // Imbalance compensation paid by the seller to the buyer in millimes
+	Outstanding     int64  `json:"outstanding"`     // Imbalance penalty the seller still owes the buyer in millimes
+	DebtCollected   int64  `json:"debtCollected"`   // Penalties of earlier imbalances collected from the seller in millimes
+	MSPID           string `json:"mspId"`           // MSP ID of the confirming identity
+	ClientID        string `json:"clientId"`        // Certificate ID of the confirming identity
+	Timestamp       string `json:"timestamp"`       // Transaction timestamp
+}
+
+// TradeStatusChangedEvent - A pending trade was cancelled by its seller or rejected by its buyer
+type TradeStatusChangedEvent struct {
+	TradeID        string `json:"tradeId"`        // Trade identifier
+	SellerID       string `json:"sellerId"`       // Selling factory
+	BuyerID        string `json:"buyerId"`        // Buying factory
+	PreviousStatus string `json:"previousStatus"` // Status before the change
+	Status         string `json:"status"`         // Status after the change
+	Timestamp      string `json:"timestamp"`      // Transaction timestamp
+}
+
+// TradesExpiredEvent - Pending trades passed their expiry and were marked expired
+type TradesExpiredEvent struct {
+	TradeIDs  []string `json:"tradeIds"`  // Expired trades
+	Timestamp string   `json:"timestamp"` // Transaction timestamp
+}
+
+// TradesRefundedEvent - Escrowed trades passed their delivery deadline and were refunded
+type TradesRefundedEvent struct {
+	TradeIDs  []string `json:"tradeIds"`  // Refunded trades
+	Timestamp string   `json:"timestamp"` // Transaction timestamp
+}
+
+// OfferCreatedEvent - An offer was published on the marketplace
+type OfferCreatedEvent struct {
+	OfferID         string   `json:"offerId"`                   // Offer identifier
+	FactoryID       string   `json:"factoryId"`                 // Offering factory
+	OfferType       string   `json:"offerType"`                 // buy or sell
+	EnergyType      string   `json:"energyType"`                // Energy source of the offering factory
+	AcceptedSources []string `json:"acceptedSources,omitempty"` // Energy sources a buy offer takes (empty for any)
+	EnergyAmount    int64    `json:"energyAmount"`              // Energy in Wh
+	PricePerKwh     int64    `json:"pricePerKwh"`               // Price per kWh in millimes
+	Timestamp       string   `json:"timestamp"`                 // Transaction timestamp
+}
+
+// OfferStatusChangedEvent - An offer moved to a new status
+type OfferStatusChangedEvent struct {
+	OfferID        string `json:"offerId"`        // Offer identifier
+	FactoryID      string `json:"factoryId"`      // Offering factory
+	PreviousStatus string `json:"previousStatus"` // Status before the change
+	Status         string `json:"status"`         // Status after the change
+	Timestamp      string `json:"timestamp"`      // Transaction timestamp
+}
+
+// OfferAcceptedEvent - An offer was filled, fully or in part, and the resulting trade settled
+type OfferAcceptedEvent struct {
+	OfferID         string `json:"offerId"`         // Filled offer
+	TradeID         string `json:"tradeId"`         // Trade created by the fill
+	SellerID        string `json:"sellerId"`        // Factory that delivered energy
+	BuyerID         string `json:"buyerId"`         // Factory that paid
+	EnergySource    string `json:"energySource"`    // Energy source of the seller
+	Amount          int64  `json:"amount"`          // Energy filled in Wh
+	PricePerKwh     int64  `json:"pricePerKwh"`     // Offer price per kWh in millimes
+	TotalPrice      int64  `json:"totalPrice"`      // Gross trade value held in escrow in millimes
+	TradeStatus     string `json:"tradeStatus"`     // Trade status after the fill
+	RemainingAmount int64  `json:"remainingAmount"` // Energy still open on the offer in Wh
+	OfferStatus     string `json:"offerStatus"`     // Offer status after the fill
+	Timestamp       string `json:"timestamp"`       // Transaction timestamp
+}
+
+// OrderPlacedEvent - An order was matched against the book and any remainder rested
+type OrderPlacedEvent struct {
+	OrderID           string   `json:"orderId"`           // Placed order
+	FactoryID         string   `json:"factoryId"`         // Factory placing the order
+	OfferType         string   `json:"offerType"`         // Side of the order (buy/sell)
+	OrderType         string   `json:"orderType"`         // Order type (limit, market, stop, stop-limit)
+	TimeInForce       string   `json:"timeInForce"`       // Time in force (GTC, IOC, FOK)
+	EnergyAmount      int64    `json:"energyAmount"`      // Ordered energy in Wh
+	PricePerKwh       int64    `json:"pricePerKwh"`       // Limit price per kWh in millimes (0 for market orders)
+	StopPrice         int64    `json:"stopPrice"`         // Stop price per kWh in millimes (0 for non-stop orders)
+	FilledAmount      int64    `json:"filledAmount"`      // Energy matched on placement in Wh
+	RemainingAmount   int64    `json:"remainingAmount"`   // Energy left unfilled in Wh
+	TradeIDs          []string `json:"tradeIds"`          // Trades produced by matching, including triggered stops
+	TriggeredOrderIDs []string `json:"triggeredOrderIds"` // Stop orders triggered by those trades
+	Status            string   `json:"status"`            // Order status after matching
+	Timestamp         string   `json:"timestamp"`         // Transaction timestamp
+}
+
+// AuctionOpenedEvent - A delivery interval opened for auction orders
+type AuctionOpenedEvent struct {
+	IntervalID    string `json:"intervalId"`    // Auction interval
+	DeliveryStart string `json:"deliveryStart"` // Start of delivery (RFC 3339)
+	DeliveryEnd   string `json:"deliveryEnd"`   // End of delivery (RFC 3339)
+	GateClosure   string `json:"gateClosure"`   // Deadline for orders (RFC 3339)
+	Timestamp     string `json:"timestamp"`     // Transaction timestamp
+}
+
+// AuctionClearedEvent - An auction interval cleared at a uniform price
+type AuctionClearedEvent struct {
+	IntervalID    string   `json:"intervalId"`    // Auction interval
+	ClearingPrice int64    `json:"clearingPrice"` // Uniform price per kWh in millimes (0 if nothing traded)
+	ClearedVolume int64    `json:"clearedVolume"` // Energy traded in Wh
+	TradeIDs      []string `json:"tradeIds"`      // Trades produced by clearing
+	Timestamp     string   `json:"timestamp"`     // Transaction timestamp
+}
+
+// LotOpenedEvent - A factory put surplus energy up for a sealed-bid auction
+type LotOpenedEvent struct {
+	LotID          string `json:"lotId"`          // Lot identifier
+	SellerID       string `json:"sellerId"`       // Selling factory
+	EnergyAmount   int64  `json:"energyAmount"`   // Energy sold in Wh
+	ReservePrice   int64  `json:"reservePrice"`   // Lowest acceptable price per kWh in millimes
+	Pricing        string `json:"pricing"`        // first-price or second-price
+	Deposit        int64  `json:"deposit"`        // Deposit per bidder in millimes
+	CommitDeadline string `json:"commitDeadline"` // End of the commit phase (RFC 3339)
+	RevealDeadline string `json:"revealDeadline"` // End of the reveal phase (RFC 3339)
+	Timestamp      string `json:"timestamp"`      // Transaction timestamp
+}
+
+// BidCommittedEvent - A sealed bid was committed and its deposit escrowed
+type BidCommittedEvent struct {
+	LotID      string `json:"lotId"`      // Lot bid on
+	BidderID   string `json:"bidderId"`   // Bidding factory
+	Commitment string `json:"commitment"` // Hex SHA-256 of the sealed bid
+	Deposit    int64  `json:"deposit"`    // Escrowed deposit in millimes
+	Timestamp  string `json:"timestamp"`  // Transaction timestamp
+}
+
+// BidRevealedEvent - A sealed bid was revealed and matched its commitment
+type BidRevealedEvent struct {
+	LotID       string `json:"lotId"`       // Lot bid on
+	BidderID    string `json:"bidderId"`    // Bidding factory
+	PricePerKwh int64  `json:"pricePerKwh"` // Revealed price per kWh in millimes
+	Timestamp   string `json:"timestamp"`   // Transaction timestamp
+}
+
+// LotSettledEvent - A sealed-bid lot was settled
+type LotSettledEvent struct {
+	LotID            string `json:"lotId"`            // Settled lot
+	Status           string `json:"status"`           // sold or unsold
+	WinnerID         string `json:"winnerId"`         // Winning bidder, if sold
+	ClearingPrice    int64  `json:"clearingPrice"`    // Price per kWh paid by the winner in millimes
+	TradeID          string `json:"tradeId"`          // Trade settling the lot, if sold
+	ForfeitedDeposit int64  `json:"forfeitedDeposit"` // Deposits paid to the seller in millimes
+	Timestamp        string `json:"timestamp"`        // Transaction timestamp
+}
+
+// OfferAmendedEvent - An offer's amount or price was amended by its owner
+type OfferAmendedEvent struct {
+	OfferID              string `json:"offerId"`              // Amended offer
+	FactoryID            string `json:"factoryId"`            // Offering factory
+	Revision             int    `json:"revision"`             // Revision number after the amendment
+	PreviousEnergyAmount int64  `json:"previousEnergyAmount"` // Energy before the amendment in Wh
+	PreviousPricePerKwh  int64  `json:"previousPricePerKwh"`  // Price before the amendment in millimes per kWh
+	EnergyAmount         int64  `json:"energyAmount"`         // Energy after the amendment in Wh
+	PricePerKwh          int64  `json:"pricePerKwh"`          // Price after the amendment in millimes per kWh
+	MSPID                string `json:"mspId"`                // MSP ID of the amending identity
+	ClientID             string `json:"clientId"`             // Certificate ID of the amending identity
+	Timestamp            string `json:"timestamp"`            // Transaction timestamp
+}
+
+// OffersExpiredEvent - Active offers past their validity were expired by a sweep
+type OffersExpiredEvent struct {
+	OfferIDs  []string `json:"offerIds"`  // Offers marked expired
+	Timestamp string   `json:"timestamp"` // Transaction timestamp
+}
+
+// FeeScheduleSetEvent - The zone operator changed the platform fee
+type FeeScheduleSetEvent struct {
+	RateBps   int64  `json:"rateBps"`   // Percentage fee in basis points of the gross value
+	FlatFee   int64  `json:"flatFee"`   // Fixed fee per trade in millimes
+	Timestamp string `json:"timestamp"` // Transaction timestamp
+}
+
+// TreasuryWithdrawnEvent - The zone operator withdrew TEC from the treasury
+type TreasuryWithdrawnEvent struct {
+	Amount    int64  `json:"amount"`    // TEC withdrawn in millimes
+	FactoryID string `json:"factoryId"` // Factory credited, or "" when paid out off-chain
+	Balance   int64  `json:"balance"`   // Treasury balance left in millimes
+	MSPID     string `json:"mspId"`     // MSP of the withdrawing operator
+	ClientID  string `json:"clientId"`  // Certificate ID of the withdrawing operator
+	Timestamp string `json:"timestamp"` // Transaction timestamp
+}
+
+// TaxRateSetEvent - The regulator changed the TVA rate applied at settlement
+type TaxRateSetEvent struct {
+	RateBps   int64  `json:"rateBps"`   // TVA rate in basis points
+	Timestamp string `json:"timestamp"` // Transaction timestamp
+}
+
+// BatchSettledEvent - A batch of trades was executed into escrow with multilateral netting
+type BatchSettledEvent struct {
+	BatchID    string   `json:"batchId"`    // Transaction ID of the settlement
+	TradeIDs   []string `json:"tradeIds"`   // Trades marked escrowed
+	FactoryIDs []string `json:"factoryIds"` // Factories whose reservations changed
+	Value      int64    `json:"value"`      // Gross value of the trades held in escrow in millimes
+	Fees       int64    `json:"fees"`       // Platform fees set on the trades in millimes
+	MSPID      string   `json:"mspId"`      // MSP of the settling operator
+	ClientID   string   `json:"clientId"`   // Certificate ID of the settling operator
+	Timestamp  string   `json:"timestamp"`  // Transaction timestamp
+}
+
+// BatchDeliveredEvent - A meter or oracle confirmed full delivery of a settlement batch, which settled
+type BatchDeliveredEvent struct {
+	BatchID       string   `json:"batchId"`       // Transaction ID of the settlement
+	TradeIDs      []string `json:"tradeIds"`      // Trades settled
+	FactoryIDs    []string `json:"factoryIds"`    // Factories whose balances changed
+	Value         int64    `json:"value"`         // Gross value of the trades in millimes
+	Fees          int64    `json:"fees"`          // Platform fees taken from the sellers' proceeds in millimes
+	DebtCollected int64    `json:"debtCollected"` // Penalties of earlier imbalances collected in millimes
+	MSPID         string   `json:"mspId"`         // MSP ID of the confirming identity
+	ClientID      string   `json:"clientId"`      // Certificate ID of the confirming identity
+	Timestamp     string   `json:"timestamp"`     // Transaction timestamp
+}
+
+// ImbalanceMultiplierSetEvent - The regulator changed the imbalance price multiple
+type ImbalanceMultiplierSetEvent struct {
+	MultiplierBps int64  `json:"multiplierBps"` // Imbalance price as a multiple of the trade price in basis points
+	Timestamp     string `json:"timestamp"`     // Transaction timestamp
+}
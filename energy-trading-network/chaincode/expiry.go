@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
+)
+
+// offerValidity - Normalize the requested validUntil of an offer created at now (both RFC 3339)
+// An empty validUntil lets the offer live until its delivery slot's gate closure, or forever
+// for offers without a slot. A validity in the past or beyond gate closure is rejected.
+func offerValidity(now string, validUntil string, deliveryStart string) (string, error) {
+	var gateClosure string
+	if deliveryStart != "" {
+		var err error
+		if gateClosure, err = slotGateClosure(deliveryStart); err != nil {
+			return "", err
+		}
+	}
+	if validUntil == "" {
+		return gateClosure, nil
+	}
+
+	validUntil, err := normalizeTimestamp("validity", validUntil)
+	if err != nil {
+		return "", err
+	}
+	if validUntil <= now {
+		return "", fmt.Errorf("validity %s is not in the future", validUntil)
+	}
+	if gateClosure != "" && validUntil > gateClosure {
+		return "", fmt.Errorf("validity %s is after the delivery slot's gate closure at %s", validUntil, gateClosure)
+	}
+	return validUntil, nil
+}
+
+// offerExpired - Whether an offer's validity has run out at now
+func offerExpired(offer *Offer, now string) bool {
+	return offer.ValidUntil != "" && now > offer.ValidUntil
+}
+
+// offerLive - Whether an offer is active and still valid at now
+func offerLive(offer *Offer, now string) bool {
+	return offer.Status == OfferStatusActive && !offerExpired(offer, now)
+}
+
+// restrictToLive - Add the condition excluding offers whose validity has run out at now
+func restrictToLive(selector map[string]interface{}, now string) map[string]interface{} {
+	selector["$or"] = []interface{}{
+		map[string]interface{}{"validUntil": map[string]interface{}{"$exists": false}},
+		map[string]interface{}{"validUntil": map[string]interface{}{"$gte": now}},
+	}
+	return selector
+}
+
+// expireOffer - Close an active or pending offer as expired, releasing its reservation and its
+// order book or auction entry
+// The factory is updated in memory and must be written by the caller with the offer.
+func expireOffer(ctx contractapi.TransactionContextInterface, factory *Factory, offer *Offer, now string) error {
+	if err := releaseOffer(factory, offer); err != nil {
+		return err
+	}
+	if err := removeFromBook(ctx, offer); err != nil {
+		return err
+	}
+	if err := removeFromAuction(ctx, offer); err != nil {
+		return err
+	}
+	offer.Status = OfferStatusExpired
+	offer.UpdatedAt = now
+	return nil
+}
+
+// SweepExpiredOffers - Mark every active or pending offer whose validity has run out as expired
+// Their reservations and order book or auction entries are released. Expiry is judged
+// against the transaction timestamp, so any client may run the sweep. Returns the IDs of
+// the offers that were expired.
+func (c *EnergyTokenContract) SweepExpiredOffers(ctx contractapi.TransactionContextInterface) ([]string, error) {
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := buildQuery(map[string]interface{}{
+		"docType":    docTypeOffer,
+		"status":     map[string]interface{}{"$in": []string{OfferStatusActive, OfferStatusPending}},
+		"validUntil": map[string]interface{}{"$lt": txTimestamp},
+	}, indexStatus)
+	if err != nil {
+		return nil, err
+	}
+	stale, err := queryOffers(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load each factory once; reads within a transaction do not see its own writes
+	factories := make(map[string]*Factory)
+	var expired []*Offer
+	for _, candidate := range stale {
+		// Re-read each offer so it is part of the read set and checked at commit
+		offer, err := c.GetOffer(ctx, candidate.ID)
+		if err != nil {
+			return nil, err
+		}
+		if (offer.Status != OfferStatusActive && offer.Status != OfferStatusPending) || !offerExpired(offer, txTimestamp) {
+			continue
+		}
+
+		factory, ok := factories[offer.FactoryID]
+		if !ok {
+			if factory, err = c.GetFactory(ctx, offer.FactoryID); err != nil {
+				return nil, err
+			}
+			factories[offer.FactoryID] = factory
+		}
+		if err := expireOffer(ctx, factory, offer, txTimestamp); err != nil {
+			return nil, err
+		}
+		expired = append(expired, offer)
+	}
+
+	var offerIDs []string
+	for _, offer := range expired {
+		if err := putOffer(ctx, offer); err != nil {
+			return nil, err
+		}
+		offerIDs = append(offerIDs, offer.ID)
+	}
+	factoryIDs := make([]string, 0, len(factories))
+	for factoryID := range factories {
+		factoryIDs = append(factoryIDs, factoryID)
+	}
+	sort.Strings(factoryIDs)
+	for _, factoryID := range factoryIDs {
+		if err := putFactory(ctx, factories[factoryID]); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(offerIDs) == 0 {
+		return offerIDs, nil
+	}
+
+	return offerIDs, emitEvent(ctx, events.OffersExpired, events.OffersExpiredEvent{
+		OfferIDs:  offerIDs,
+		Timestamp: txTimestamp,
+	})
+}
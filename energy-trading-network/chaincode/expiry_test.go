@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestExpireOfferLeavesAuction(t *testing.T) {
+	ctx := newTestContext(t, "2026-01-01T12:00:00Z")
+	factory := &Factory{ID: "F1", CurrencyBalance: 10000}
+	offer := &Offer{ID: "O1", FactoryID: "F1", OfferType: OfferTypeBuy, EnergyAmount: 5000, PricePerKwh: 300,
+		Status: OfferStatusActive, IntervalID: "I1"}
+	if err := reserveOffer(factory, offer); err != nil {
+		t.Fatal(err)
+	}
+	key, err := auctionOrderKey(ctx, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.GetStub().PutState(key, []byte(offer.ID)); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, ctx)
+
+	if err := expireOffer(ctx, factory, offer, "2026-01-01T12:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	if offer.Status != OfferStatusExpired || factory.ReservedCurrency != 0 {
+		t.Errorf("offer is %s with %d millimes still reserved", offer.Status, factory.ReservedCurrency)
+	}
+	commit(t, ctx)
+	entry, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != nil {
+		t.Error("expired order is still in its auction interval")
+	}
+}
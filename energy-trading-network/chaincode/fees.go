@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
+)
+
+// configFeeSchedule - Config entry holding the platform fee schedule
+const configFeeSchedule = "feeSchedule"
+
+// maxFeeRateBps - Highest percentage fee, in basis points (100%)
+const maxFeeRateBps = 10000
+
+// Treasury entry kinds
+const (
+	TreasuryEntryFee        = "fee"        // Fee collected from a settled trade
+	TreasuryEntryWithdrawal = "withdrawal" // TEC withdrawn by the zone operator
+)
+
+// FeeSchedule - Platform fee charged on every settled trade
+// The fee is taken from the seller's proceeds: the buyer pays the gross trade value and
+// the seller receives it net of the fee.
+type FeeSchedule struct {
+	DocType   string `json:"docType"`                                  // Record namespace ("config")
+	RateBps   Amount `json:"rateBps"`                                  // Percentage fee in basis points of the gross value (100 = 1%)
+	FlatFee   Amount `json:"flatFee"`                                  // Fixed fee per trade in millimes
+	UpdatedAt string `json:"updatedAt,omitempty" metadata:",optional"` // Last update timestamp
+}
+
+// TreasuryEntry - One movement of the zone treasury
+// Each fee and withdrawal is its own record, so that trades settling concurrently never
+// write the same key.
+type TreasuryEntry struct {
+	DocType   string `json:"docType"`                                  // Record namespace ("treasury")
+	Kind      string `json:"kind"`                                     // Entry kind (fee, withdrawal)
+	ID        string `json:"id"`                                       // Trade ID for fees, transaction ID for withdrawals
+	Amount    Amount `json:"amount"`                                   // TEC in millimes, positive for fees and negative for withdrawals
+	FactoryID string `json:"factoryId,omitempty" metadata:",optional"` // Seller that paid the fee, or factory credited by a withdrawal
+	Timestamp string `json:"timestamp"`                                // Transaction timestamp
+}
+
+// Treasury - Balance of the zone treasury
+type Treasury struct {
+	Balance   Amount `json:"balance"`   // TEC available in millimes
+	Collected Amount `json:"collected"` // Fees collected in millimes
+	Withdrawn Amount `json:"withdrawn"` // TEC withdrawn in millimes
+	Entries   int    `json:"entries"`   // Number of treasury entries
+}
+
+// feeScheduleKey - Ledger key of the fee schedule
+func feeScheduleKey(ctx contractapi.TransactionContextInterface) (string, error) {
+	return makeKey(ctx, docTypeConfig, configFeeSchedule)
+}
+
+// getFeeSchedule - Read the fee schedule (no fee until one is set)
+func getFeeSchedule(ctx contractapi.TransactionContextInterface) (*FeeSchedule, error) {
+	key, err := feeScheduleKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scheduleJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fee schedule: %v", err)
+	}
+
+	schedule := FeeSchedule{DocType: docTypeConfig}
+	if scheduleJSON != nil {
+		if err := json.Unmarshal(scheduleJSON, &schedule); err != nil {
+			return nil, err
+		}
+	}
+	return &schedule, nil
+}
+
+// tradeFee - Fee in millimes on a gross trade value (millimes)
+// The percentage part is rounded half up like any trade value; the total never exceeds
+// the gross value.
+func tradeFee(schedule *FeeSchedule, gross Amount) (Amount, error) {
+	fee, err := mulDivAmount(gross, schedule.RateBps, maxFeeRateBps)
+	if err != nil {
+		return 0, err
+	}
+	if fee, err = addAmount(fee, schedule.FlatFee); err != nil {
+		return 0, err
+	}
+	if fee > gross {
+		fee = gross
+	}
+	return fee, nil
+}
+
+// treasuryKey - Ledger key of a treasury entry
+func treasuryKey(ctx contractapi.TransactionContextInterface, kind string, id string) (string, error) {
+	return makeKey(ctx, docTypeTreasury, kind, id)
+}
+
+// putTreasuryEntry - Save a treasury entry under its composite key
+func putTreasuryEntry(ctx contractapi.TransactionContextInterface, entry *TreasuryEntry) error {
+	key, err := treasuryKey(ctx, entry.Kind, entry.ID)
+	if err != nil {
+		return err
+	}
+	entry.DocType = docTypeTreasury
+	return putRecord(ctx, key, entry)
+}
+
+// settleMarketTrade - Settle a trade between two factories, charge the platform fee and invoice it
+// The buyer pays the trade's gross TotalPrice; the seller receives it less the fee, which
+// is credited to the treasury. The fee, net amount and invoice number are recorded on the
+// trade. The factories are updated in memory and must be written by the caller.
+func settleMarketTrade(ctx contractapi.TransactionContextInterface, seller *Factory, buyer *Factory,
+	trade *EnergyTrade) error {
+
+	if err := settleTrade(seller, buyer, trade.Amount, trade.TotalPrice); err != nil {
+		return err
+	}
+	return chargeTrade(ctx, seller, buyer, trade, trade.Amount, trade.TotalPrice)
+}
+
+// chargeTrade - Charge the platform fee on the energy (Wh) and value (millimes) a trade settled
+// and invoice them. The value must already have reached the seller, who is updated in memory
+// and must be written by the caller.
+func chargeTrade(ctx contractapi.TransactionContextInterface, seller *Factory, buyer *Factory,
+	trade *EnergyTrade, energy Amount, value Amount) error {
+
+	schedule, err := getFeeSchedule(ctx)
+	if err != nil {
+		return err
+	}
+	fee, err := tradeFee(schedule, value)
+	if err != nil {
+		return err
+	}
+	return chargeTradeFee(ctx, seller, buyer, trade, energy, value, fee)
+}
+
+// chargeTradeFee - Charge a trade a fee (millimes) set in advance, as chargeTrade does
+// Batch trades have their fees set when the batch is escrowed, so that the holds cover them.
+func chargeTradeFee(ctx contractapi.TransactionContextInterface, seller *Factory, buyer *Factory,
+	trade *EnergyTrade, energy Amount, value Amount, fee Amount) error {
+
+	var err error
+	if seller.CurrencyBalance, err = subAmount(seller.CurrencyBalance, fee); err != nil {
+		return err
+	}
+	trade.Fee = fee
+	trade.NetAmount = value - fee
+
+	if fee > 0 {
+		txTimestamp, err := getTxTimestamp(ctx)
+		if err != nil {
+			return err
+		}
+		if err := putTreasuryEntry(ctx, &TreasuryEntry{
+			Kind:      TreasuryEntryFee,
+			ID:        trade.TradeID,
+			Amount:    fee,
+			FactoryID: seller.ID,
+			Timestamp: txTimestamp,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return issueInvoice(ctx, seller, buyer, trade, energy, value)
+}
+
+// SetFeeSchedule - Set the platform fee charged on every settled trade (zone operator only)
+// rateBps is the percentage part in basis points of the gross value (0 to 10000) and
+// flatFee a fixed amount in millimes per trade; either may be 0.
+func (c *EnergyTokenContract) SetFeeSchedule(ctx contractapi.TransactionContextInterface,
+	rateBps Amount, flatFee Amount) error {
+
+	if err := assertRole(ctx, RoleOperator); err != nil {
+		return err
+	}
+	if rateBps < 0 || rateBps > maxFeeRateBps {
+		return fmt.Errorf("fee rate must be between 0 and %d basis points", maxFeeRateBps)
+	}
+	if flatFee < 0 {
+		return fmt.Errorf("flat fee cannot be negative")
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := feeScheduleKey(ctx)
+	if err != nil {
+		return err
+	}
+	schedule := FeeSchedule{DocType: docTypeConfig, RateBps: rateBps, FlatFee: flatFee, UpdatedAt: txTimestamp}
+	if err := putRecord(ctx, key, &schedule); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.FeeScheduleSet, events.FeeScheduleSetEvent{
+		RateBps:   schedule.RateBps,
+		FlatFee:   schedule.FlatFee,
+		Timestamp: txTimestamp,
+	})
+}
+
+// GetFeeSchedule - Get the platform fee charged on every settled trade
+func (c *EnergyTokenContract) GetFeeSchedule(ctx contractapi.TransactionContextInterface) (*FeeSchedule, error) {
+	return getFeeSchedule(ctx)
+}
+
+// readTreasury - Sum every treasury entry into the treasury balance
+func readTreasury(ctx contractapi.TransactionContextInterface) (*Treasury, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeTreasury, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var treasury Treasury
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var entry TreasuryEntry
+		if err := json.Unmarshal(queryResponse.Value, &entry); err != nil {
+			return nil, err
+		}
+
+		treasury.Entries++
+		if entry.Amount >= 0 {
+			if treasury.Collected, err = addAmount(treasury.Collected, entry.Amount); err != nil {
+				return nil, err
+			}
+		} else if treasury.Withdrawn, err = subAmount(treasury.Withdrawn, entry.Amount); err != nil {
+			return nil, err
+		}
+	}
+
+	treasury.Balance = treasury.Collected - treasury.Withdrawn
+	return &treasury, nil
+}
+
+// GetTreasuryBalance - Get the zone treasury balance with its collected and withdrawn totals
+func (c *EnergyTokenContract) GetTreasuryBalance(ctx contractapi.TransactionContextInterface) (*Treasury, error) {
+	return readTreasury(ctx)
+}
+
+// WithdrawTreasury - Withdraw TEC from the zone treasury (zone operator only)
+// amount is in millimes. The TEC is credited to factoryID, or leaves the ledger (e.g. paid
+// out off-chain) when factoryID is "".
+func (c *EnergyTokenContract) WithdrawTreasury(ctx contractapi.TransactionContextInterface,
+	amount Amount, factoryID string) error {
+
+	if err := assertRole(ctx, RoleOperator); err != nil {
+		return err
+	}
+	if amount <= 0 {
+		return fmt.Errorf("withdrawal amount must be positive")
+	}
+
+	treasury, err := readTreasury(ctx)
+	if err != nil {
+		return err
+	}
+	if treasury.Balance < amount {
+		return fmt.Errorf("treasury has insufficient balance: has %d millimes, needs %d millimes",
+			treasury.Balance, amount)
+	}
+
+	if factoryID != "" {
+		factory, err := c.GetFactory(ctx, factoryID)
+		if err != nil {
+			return err
+		}
+		if factory.CurrencyBalance, err = addAmount(factory.CurrencyBalance, amount); err != nil {
+			return err
+		}
+		if err := putFactory(ctx, factory); err != nil {
+			return err
+		}
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	if err := putTreasuryEntry(ctx, &TreasuryEntry{
+		Kind:      TreasuryEntryWithdrawal,
+		ID:        ctx.GetStub().GetTxID(),
+		Amount:    -amount,
+		FactoryID: factoryID,
+		Timestamp: txTimestamp,
+	}); err != nil {
+		return err
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.TreasuryWithdrawn, events.TreasuryWithdrawnEvent{
+		Amount:    amount,
+		FactoryID: factoryID,
+		Balance:   treasury.Balance - amount,
+		MSPID:     caller.MSPID,
+		ClientID:  caller.ID,
+		Timestamp: txTimestamp,
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTradeFee(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule FeeSchedule
+		gross    Amount
+		want     Amount
+		wantErr  bool
+	}{
+		{name: "no fee", gross: 12000, want: 0},
+		{name: "percentage", schedule: FeeSchedule{RateBps: 25}, gross: 100000, want: 250},
+		{name: "half a millime rounds up", schedule: FeeSchedule{RateBps: 50}, gross: 100, want: 1},
+		{name: "percentage plus flat fee", schedule: FeeSchedule{RateBps: 25, FlatFee: 100}, gross: 100000, want: 350},
+		{name: "flat fee capped at the gross value", schedule: FeeSchedule{FlatFee: 500}, gross: 300, want: 300},
+		{name: "full rate plus flat fee capped", schedule: FeeSchedule{RateBps: maxFeeRateBps, FlatFee: 1}, gross: 300, want: 300},
+		{name: "free trade pays nothing", schedule: FeeSchedule{RateBps: 25, FlatFee: 100}, gross: 0, want: 0},
+		{name: "overflow", schedule: FeeSchedule{RateBps: maxFeeRateBps, FlatFee: 1}, gross: math.MaxInt64, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tradeFee(&tt.schedule, tt.gross)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("tradeFee(%d) = %d, want an error", tt.gross, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tradeFee(%d): %v", tt.gross, err)
+			}
+			if got != tt.want {
+				t.Errorf("tradeFee(%d) = %d, want %d", tt.gross, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
+)
+
+// configImbalance - Config entry holding the imbalance pricing
+const configImbalance = "imbalance"
+
+// defaultImbalanceMultiplierBps - Imbalance price as a multiple of the trade price, in basis
+// points, until the regulator sets one (1.5x)
+const defaultImbalanceMultiplierBps = 15000
+
+// ImbalanceSettings - Pricing of energy a seller fails to deliver
+type ImbalanceSettings struct {
+	DocType       string `json:"docType"`                                  // Record namespace ("config")
+	MultiplierBps Amount `json:"multiplierBps"`                            // Imbalance price as a multiple of the trade price in basis points (15000 = 1.5x)
+	UpdatedAt     string `json:"updatedAt,omitempty" metadata:",optional"` // Last update timestamp
+}
+
+// Imbalance - Settlement of the energy a seller failed to deliver on a trade
+// The buyer is refunded the contracted value of the shortfall from escrow and the seller
+// pays it the difference to the imbalance price as compensation. What the seller cannot pay
+// at once is collected when it is next paid for a sale.
+type Imbalance struct {
+	DocType          string `json:"docType"`                                      // Record namespace ("imbalance")
+	ID               string `json:"id"`                                           // Imbalance identifier (transaction that confirmed the delivery)
+	TradeID          string `json:"tradeId"`                                      // Trade the imbalance settled
+	SellerID         string `json:"sellerId"`                                     // Factory that under-delivered
+	BuyerID          string `json:"buyerId"`                                      // Factory compensated
+	ContractedAmount Amount `json:"contractedAmount"`                             // Energy sold in Wh
+	DeliveredAmount  Amount `json:"deliveredAmount"`                              // Energy metered as delivered in Wh
+	Shortfall        Amount `json:"shortfall"`                                    // Energy not delivered in Wh
+	PricePerKwh      Amount `json:"pricePerKwh"`                                  // Trade price per kWh in millimes
+	MultiplierBps    Amount `json:"multiplierBps"`                                // Imbalance multiple applied in basis points
+	ImbalancePrice   Amount `json:"imbalancePrice"`                               // Price per kWh of the shortfall in millimes
+	Refund           Amount `json:"refund"`                                       // Contracted value of the shortfall returned to the buyer in millimes
+	Penalty          Amount `json:"penalty"`                                      // Shortfall value at the imbalance price above the refund, owed by the seller in millimes
+	Compensation     Amount `json:"compensation"`                                 // Part of the penalty paid to the buyer so far in millimes
+	Outstanding      Amount `json:"outstanding"`                                  // Part of the penalty the seller still owes in millimes
+	Timestamp        string `json:"timestamp"`                                    // Settlement timestamp
+	SchemaVersion    int    `json:"schemaVersion,omitempty" metadata:",optional"` // Record layout version
+}
+
+// imbalanceSettingsKey - Ledger key of the imbalance pricing
+func imbalanceSettingsKey(ctx contractapi.TransactionContextInterface) (string, error) {
+	return makeKey(ctx, docTypeConfig, configImbalance)
+}
+
+// getImbalanceSettings - Read the imbalance pricing (the default multiple until one is set)
+func getImbalanceSettings(ctx contractapi.TransactionContextInterface) (*ImbalanceSettings, error) {
+	key, err := imbalanceSettingsKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settingsJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read imbalance settings: %v", err)
+	}
+
+	settings := ImbalanceSettings{DocType: docTypeConfig, MultiplierBps: defaultImbalanceMultiplierBps}
+	if settingsJSON != nil {
+		if err := json.Unmarshal(settingsJSON, &settings); err != nil {
+			return nil, err
+		}
+	}
+	return &settings, nil
+}
+
+// imbalanceKey - Ledger key of a trade's imbalance
+func imbalanceKey(ctx contractapi.TransactionContextInterface, tradeID string) (string, error) {
+	return makeKey(ctx, docTypeImbalance, tradeID)
+}
+
+// deliveredValue - Value in millimes of the energy a trade delivered, at most what the trade costs
+// Order fills are valued on their offer's notional (see fillValue), so a trade may cost
+// slightly less than its amount at its price.
+func deliveredValue(trade *EnergyTrade, delivered Amount) (Amount, error) {
+	value, err := tradeValue(delivered, trade.PricePerUnit)
+	if err != nil {
+		return 0, err
+	}
+	if value > trade.TotalPrice {
+		value = trade.TotalPrice
+	}
+	return value, nil
+}
+
+// settleShortfall - Settle an escrowed trade whose seller delivered less than it sold
+// The buyer pays for the delivered energy only, which is charged and invoiced as usual. The
+// seller then pays the buyer the shortfall's value at the imbalance price less the refund,
+// as far as its unreserved TEC allows, and owes the rest as imbalance debt. The escrow must
+// already be released; the factories and trade are updated in memory and must be written by
+// the caller.
+func settleShortfall(ctx contractapi.TransactionContextInterface, seller *Factory, buyer *Factory,
+	trade *EnergyTrade, delivered Amount, timestamp string) (*Imbalance, error) {
+
+	value, err := deliveredValue(trade, delivered)
+	if err != nil {
+		return nil, err
+	}
+	if err := settleTrade(seller, buyer, delivered, value); err != nil {
+		return nil, err
+	}
+	if delivered > 0 {
+		if err := chargeTrade(ctx, seller, buyer, trade, delivered, value); err != nil {
+			return nil, err
+		}
+	}
+
+	settings, err := getImbalanceSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	imbalance := Imbalance{
+		DocType:          docTypeImbalance,
+		ID:               ctx.GetStub().GetTxID(),
+		TradeID:          trade.TradeID,
+		SellerID:         trade.SellerID,
+		BuyerID:          trade.BuyerID,
+		ContractedAmount: trade.Amount,
+		DeliveredAmount:  delivered,
+		Shortfall:        trade.Amount - delivered,
+		PricePerKwh:      trade.PricePerUnit,
+		MultiplierBps:    settings.MultiplierBps,
+		Refund:           trade.TotalPrice - value,
+		Timestamp:        timestamp,
+		SchemaVersion:    currentSchemaVersion,
+	}
+	if imbalance.ImbalancePrice, err = mulDivAmount(trade.PricePerUnit, settings.MultiplierBps, BpsPerUnit); err != nil {
+		return nil, err
+	}
+	charge, err := tradeValue(imbalance.Shortfall, imbalance.ImbalancePrice)
+	if err != nil {
+		return nil, err
+	}
+	if charge > imbalance.Refund {
+		imbalance.Penalty = charge - imbalance.Refund
+	}
+
+	imbalance.Compensation = imbalance.Penalty
+	if spendable := spendableCurrency(seller); spendable < imbalance.Compensation {
+		imbalance.Compensation = spendable
+		if imbalance.Compensation < 0 {
+			imbalance.Compensation = 0
+		}
+	}
+	imbalance.Outstanding = imbalance.Penalty - imbalance.Compensation
+	if seller.CurrencyBalance, err = subAmount(seller.CurrencyBalance, imbalance.Compensation); err != nil {
+		return nil, err
+	}
+	if buyer.CurrencyBalance, err = addAmount(buyer.CurrencyBalance, imbalance.Compensation); err != nil {
+		return nil, err
+	}
+	if imbalance.Outstanding > 0 {
+		if seller.ImbalanceDebt, err = addAmount(seller.ImbalanceDebt, imbalance.Outstanding); err != nil {
+			return nil, err
+		}
+		seller.ImbalancesOwed = append(seller.ImbalancesOwed, trade.TradeID)
+	}
+	trade.ImbalanceID = imbalance.ID
+
+	key, err := imbalanceKey(ctx, trade.TradeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := putRecord(ctx, key, &imbalance); err != nil {
+		return nil, err
+	}
+	return &imbalance, nil
+}
+
+// collectImbalanceDebt - Pay a seller's outstanding imbalance penalties from its unreserved TEC,
+// oldest first, to the buyers they are owed to
+// Factories are taken from and added to the cache; the caller writes them. Returns the TEC
+// collected in millimes.
+func (c *EnergyTokenContract) collectImbalanceDebt(ctx contractapi.TransactionContextInterface,
+	seller *Factory, factories map[string]*Factory) (Amount, error) {
+
+	var collected Amount
+	for len(seller.ImbalancesOwed) > 0 && spendableCurrency(seller) > 0 {
+		imbalance, err := c.GetImbalance(ctx, seller.ImbalancesOwed[0])
+		if err != nil {
+			return 0, err
+		}
+		buyer, ok := factories[imbalance.BuyerID]
+		if !ok {
+			if buyer, err = c.GetFactory(ctx, imbalance.BuyerID); err != nil {
+				return 0, err
+			}
+			factories[imbalance.BuyerID] = buyer
+		}
+
+		payment := imbalance.Outstanding
+		if spendable := spendableCurrency(seller); spendable < payment {
+			payment = spendable
+		}
+		if err := settleTrade(buyer, seller, 0, payment); err != nil {
+			return 0, err
+		}
+		imbalance.Compensation += payment
+		imbalance.Outstanding -= payment
+		seller.ImbalanceDebt -= payment
+		collected += payment
+
+		if imbalance.Outstanding == 0 {
+			seller.ImbalancesOwed = seller.ImbalancesOwed[1:]
+		}
+		key, err := imbalanceKey(ctx, imbalance.TradeID)
+		if err != nil {
+			return 0, err
+		}
+		if err := putRecord(ctx, key, imbalance); err != nil {
+			return 0, err
+		}
+	}
+	if len(seller.ImbalancesOwed) == 0 {
+		seller.ImbalancesOwed = nil
+	}
+
+	return collected, nil
+}
+
+// SetImbalanceMultiplier - Set the imbalance price as a multiple of the trade price (regulator only)
+// multiplierBps is in basis points and at least 10000 (1x), so that under-delivering never
+// costs the seller less than delivering. Imbalances already settled keep their multiple.
+func (c *EnergyTokenContract) SetImbalanceMultiplier(ctx contractapi.TransactionContextInterface,
+	multiplierBps Amount) error {
+
+	if err := assertRole(ctx, RoleRegulator); err != nil {
+		return err
+	}
+	if multiplierBps < BpsPerUnit {
+		return fmt.Errorf("imbalance multiplier must be at least %d basis points", BpsPerUnit)
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := imbalanceSettingsKey(ctx)
+	if err != nil {
+		return err
+	}
+	settings := ImbalanceSettings{DocType: docTypeConfig, MultiplierBps: multiplierBps, UpdatedAt: txTimestamp}
+	if err := putRecord(ctx, key, &settings); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.ImbalanceMultiplierSet, events.ImbalanceMultiplierSetEvent{
+		MultiplierBps: settings.MultiplierBps,
+		Timestamp:     txTimestamp,
+	})
+}
+
+// GetImbalanceSettings - Get the imbalance price multiple applied to delivery shortfalls
+func (c *EnergyTokenContract) GetImbalanceSettings(ctx contractapi.TransactionContextInterface) (*ImbalanceSettings, error) {
+	return getImbalanceSettings(ctx)
+}
+
+// GetImbalance - Get the imbalance settled on a trade whose seller under-delivered
+func (c *EnergyTokenContract) GetImbalance(ctx contractapi.TransactionContextInterface,
+	tradeID string) (*Imbalance, error) {
+
+	key, err := imbalanceKey(ctx, tradeID)
+	if err != nil {
+		return nil, err
+	}
+	imbalanceJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read imbalance: %v", err)
+	}
+	if imbalanceJSON == nil {
+		return nil, fmt.Errorf("trade %s has no imbalance", tradeID)
+	}
+
+	var imbalance Imbalance
+	if err := json.Unmarshal(imbalanceJSON, &imbalance); err != nil {
+		return nil, err
+	}
+	return &imbalance, nil
+}
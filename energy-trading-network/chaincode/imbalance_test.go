@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSettleShortfall(t *testing.T) {
+	tests := []struct {
+		name             string
+		multiplierBps    Amount
+		delivered        Amount
+		sellerCurrency   Amount
+		sellerReserved   Amount
+		wantRefund       Amount
+		wantPenalty      Amount
+		wantCompensation Amount
+		wantOutstanding  Amount
+	}{
+		{
+			// 4000 Wh short at 450 millimes/kWh is 1800, of which 1200 is refunded
+			name: "partial delivery", delivered: 6000, sellerCurrency: 10000,
+			wantRefund: 1200, wantPenalty: 600, wantCompensation: 600,
+		},
+		{
+			name: "nothing delivered", delivered: 0, sellerCurrency: 10000,
+			wantRefund: 3000, wantPenalty: 1500, wantCompensation: 1500,
+		},
+		{
+			name: "penalty beyond unreserved TEC", delivered: 0, sellerCurrency: 1000, sellerReserved: 400,
+			wantRefund: 3000, wantPenalty: 1500, wantCompensation: 600, wantOutstanding: 900,
+		},
+		{
+			name: "seller already overcommitted", delivered: 0, sellerCurrency: 300, sellerReserved: 400,
+			wantRefund: 3000, wantPenalty: 1500, wantOutstanding: 1500,
+		},
+		{
+			name: "multiplier of one only refunds", multiplierBps: BpsPerUnit, delivered: 6000, sellerCurrency: 10000,
+			wantRefund: 1200,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newTestContext(t, "2026-01-01T12:00:00Z")
+			if tt.multiplierBps != 0 {
+				key, err := imbalanceSettingsKey(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := putRecord(ctx, key, &ImbalanceSettings{DocType: docTypeConfig, MultiplierBps: tt.multiplierBps}); err != nil {
+					t.Fatal(err)
+				}
+				commit(t, ctx)
+			}
+
+			// The escrow is already released: the seller holds the energy and the buyer the payment
+			seller := &Factory{ID: "F1", EnergyBalance: 10000, CurrencyBalance: tt.sellerCurrency, ReservedCurrency: tt.sellerReserved}
+			buyer := &Factory{ID: "F2", CurrencyBalance: 10000}
+			trade := &EnergyTrade{TradeID: "T1", SellerID: "F1", BuyerID: "F2", Amount: 10000, PricePerUnit: 300, TotalPrice: 3000}
+
+			imbalance, err := settleShortfall(ctx, seller, buyer, trade, tt.delivered, "2026-01-01T12:00:00Z")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imbalance.Shortfall != 10000-tt.delivered || imbalance.Refund != tt.wantRefund ||
+				imbalance.Penalty != tt.wantPenalty || imbalance.Compensation != tt.wantCompensation ||
+				imbalance.Outstanding != tt.wantOutstanding {
+				t.Errorf("got shortfall %d Wh, refund %d, penalty %d, compensation %d, outstanding %d; "+
+					"want %d Wh, %d, %d, %d, %d",
+					imbalance.Shortfall, imbalance.Refund, imbalance.Penalty, imbalance.Compensation, imbalance.Outstanding,
+					10000-tt.delivered, tt.wantRefund, tt.wantPenalty, tt.wantCompensation, tt.wantOutstanding)
+			}
+
+			if seller.ImbalanceDebt != tt.wantOutstanding {
+				t.Errorf("seller owes %d millimes, want %d", seller.ImbalanceDebt, tt.wantOutstanding)
+			}
+			if owes := len(seller.ImbalancesOwed) == 1 && seller.ImbalancesOwed[0] == "T1"; owes != (tt.wantOutstanding > 0) {
+				t.Errorf("seller owes imbalances of trades %v", seller.ImbalancesOwed)
+			}
+			if trade.ImbalanceID != imbalance.ID || imbalance.ID == "" {
+				t.Errorf("trade links imbalance %q, want %q", trade.ImbalanceID, imbalance.ID)
+			}
+
+			paid := trade.TotalPrice - tt.wantRefund
+			if seller.EnergyBalance != 10000-tt.delivered || buyer.EnergyBalance != tt.delivered {
+				t.Errorf("seller has %d Wh, buyer %d Wh after %d Wh delivered", seller.EnergyBalance, buyer.EnergyBalance, tt.delivered)
+			}
+			if want := tt.sellerCurrency + paid - tt.wantCompensation; seller.CurrencyBalance != want {
+				t.Errorf("seller has %d millimes, want %d", seller.CurrencyBalance, want)
+			}
+			if want := 10000 - paid + tt.wantCompensation; buyer.CurrencyBalance != want {
+				t.Errorf("buyer has %d millimes, want %d", buyer.CurrencyBalance, want)
+			}
+
+			commit(t, ctx)
+			stored, err := new(EnergyTokenContract).GetImbalance(ctx, "T1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Outstanding != tt.wantOutstanding {
+				t.Errorf("stored imbalance has %d millimes outstanding, want %d", stored.Outstanding, tt.wantOutstanding)
+			}
+		})
+	}
+}
+
+func TestCollectImbalanceDebt(t *testing.T) {
+	tests := []struct {
+		name          string
+		spendable     Amount
+		wantCollected Amount
+		wantPaid      map[string]Amount
+		wantOwed      []string
+	}{
+		{name: "nothing spendable", spendable: 0, wantOwed: []string{"T1", "T2"}},
+		{name: "part of the oldest", spendable: 300, wantCollected: 300, wantPaid: map[string]Amount{"B1": 300}, wantOwed: []string{"T1", "T2"}},
+		{name: "oldest in full", spendable: 900, wantCollected: 900, wantPaid: map[string]Amount{"B1": 500, "B2": 400}, wantOwed: []string{"T2"}},
+		{name: "all debt", spendable: 2000, wantCollected: 1300, wantPaid: map[string]Amount{"B1": 500, "B2": 800}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newTestContext(t, "2026-01-01T12:00:00Z")
+			seedFactories(t, ctx, &Factory{ID: "B1"}, &Factory{ID: "B2"})
+			for _, imbalance := range []*Imbalance{
+				{TradeID: "T1", SellerID: "F1", BuyerID: "B1", Penalty: 500, Outstanding: 500},
+				{TradeID: "T2", SellerID: "F1", BuyerID: "B2", Penalty: 900, Compensation: 100, Outstanding: 800},
+			} {
+				key, err := imbalanceKey(ctx, imbalance.TradeID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := putRecord(ctx, key, imbalance); err != nil {
+					t.Fatal(err)
+				}
+			}
+			commit(t, ctx)
+			seller := &Factory{ID: "F1", CurrencyBalance: tt.spendable + 100, ReservedCurrency: 100,
+				ImbalanceDebt: 1300, ImbalancesOwed: []string{"T1", "T2"}}
+
+			c := new(EnergyTokenContract)
+			factories := map[string]*Factory{seller.ID: seller}
+			collected, err := c.collectImbalanceDebt(ctx, seller, factories)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if collected != tt.wantCollected || seller.ImbalanceDebt != 1300-tt.wantCollected {
+				t.Errorf("collected %d millimes leaving %d owed, want %d", collected, seller.ImbalanceDebt, tt.wantCollected)
+			}
+			if seller.CurrencyBalance != tt.spendable+100-tt.wantCollected {
+				t.Errorf("seller has %d millimes left", seller.CurrencyBalance)
+			}
+			if !reflect.DeepEqual(seller.ImbalancesOwed, tt.wantOwed) {
+				t.Errorf("seller owes imbalances of trades %v, want %v", seller.ImbalancesOwed, tt.wantOwed)
+			}
+
+			for _, buyerID := range []string{"B1", "B2"} {
+				var got Amount
+				if buyer, ok := factories[buyerID]; ok {
+					got = buyer.CurrencyBalance
+				}
+				if got != tt.wantPaid[buyerID] {
+					t.Errorf("%s was paid %d millimes, want %d", buyerID, got, tt.wantPaid[buyerID])
+				}
+			}
+			commit(t, ctx)
+			imbalance, err := c.GetImbalance(ctx, "T2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imbalance.Compensation+imbalance.Outstanding != imbalance.Penalty || imbalance.Compensation != 100+tt.wantPaid["B2"] {
+				t.Errorf("imbalance T2 has %d paid and %d outstanding of %d", imbalance.Compensation, imbalance.Outstanding, imbalance.Penalty)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
+)
+
+// configTaxRate - Config entry holding the TVA rate applied at settlement
+const configTaxRate = "taxRate"
+
+// defaultTaxRateBps - TVA rate in basis points until the regulator sets one (standard rate, 19%)
+const defaultTaxRateBps = 1900
+
+// TaxRate - TVA rate applied to trades at settlement
+type TaxRate struct {
+	DocType   string `json:"docType"`                                  // Record namespace ("config")
+	RateBps   Amount `json:"rateBps"`                                  // TVA rate in basis points (1900 = 19%)
+	UpdatedAt string `json:"updatedAt,omitempty" metadata:",optional"` // Last update timestamp
+}
+
+// Invoice - Tax invoice issued by the seller for a settled trade
+// Trade prices include TVA: the buyer pays the TTC amount, split here into HT and TVA.
+// Invoices are written once and never modified.
+type Invoice struct {
+	DocType        string `json:"docType"`                                       // Record namespace ("invoice")
+	Number         string `json:"number"`                                        // Invoice number, sequential per seller
+	Sequence       int64  `json:"sequence"`                                      // Position in the seller's invoice sequence
+	TradeID        string `json:"tradeId"`                                       // Invoiced trade
+	SellerID       string `json:"sellerId"`                                      // Issuing factory
+	BuyerID        string `json:"buyerId"`                                       // Invoiced factory
+	SellerFiscalID string `json:"sellerFiscalId,omitempty" metadata:",optional"` // Fiscal matricule of the seller
+	BuyerFiscalID  string `json:"buyerFiscalId,omitempty" metadata:",optional"`  // Fiscal matricule of the buyer
+	Amount         Amount `json:"amount"`                                        // Energy invoiced in Wh
+	AmountHT       Amount `json:"amountHT"`                                      // Value excluding TVA in millimes
+	TaxRateBps     Amount `json:"taxRateBps"`                                    // TVA rate applied in basis points
+	AmountTVA      Amount `json:"amountTVA"`                                     // TVA in millimes
+	AmountTTC      Amount `json:"amountTTC"`                                     // Value including TVA in millimes, as paid by the buyer
+	IssuedAt       string `json:"issuedAt"`                                      // Settlement timestamp
+	SchemaVersion  int    `json:"schemaVersion,omitempty" metadata:",optional"`  // Record layout version
+}
+
+// taxRateKey - Ledger key of the TVA rate
+func taxRateKey(ctx contractapi.TransactionContextInterface) (string, error) {
+	return makeKey(ctx, docTypeConfig, configTaxRate)
+}
+
+// getTaxRate - Read the TVA rate (the standard rate until one is set)
+func getTaxRate(ctx contractapi.TransactionContextInterface) (*TaxRate, error) {
+	key, err := taxRateKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rateJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tax rate: %v", err)
+	}
+
+	rate := TaxRate{DocType: docTypeConfig, RateBps: defaultTaxRateBps}
+	if rateJSON != nil {
+		if err := json.Unmarshal(rateJSON, &rate); err != nil {
+			return nil, err
+		}
+	}
+	return &rate, nil
+}
+
+// splitTax - Split a TVA-inclusive value (millimes) into its HT and TVA parts
+// HT is rounded half up and TVA takes the remainder, so HT + TVA always equals TTC.
+func splitTax(ttc Amount, rateBps Amount) (Amount, Amount, error) {
+	ht, err := mulDivAmount(ttc, maxFeeRateBps, maxFeeRateBps+rateBps)
+	if err != nil {
+		return 0, 0, err
+	}
+	return ht, ttc - ht, nil
+}
+
+// invoiceKey - Ledger key of an invoice
+func invoiceKey(ctx contractapi.TransactionContextInterface, number string) (string, error) {
+	return makeKey(ctx, docTypeInvoice, number)
+}
+
+// issueInvoice - Issue the seller's next tax invoice for the energy (Wh) and TVA-inclusive value
+// (millimes) a trade settled
+// The seller's invoice sequence lives on its factory record, which settlement writes anyway;
+// the factory is updated in memory and must be written by the caller.
+func issueInvoice(ctx contractapi.TransactionContextInterface, seller *Factory, buyer *Factory,
+	trade *EnergyTrade, energy Amount, value Amount) error {
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	rate, err := getTaxRate(ctx)
+	if err != nil {
+		return err
+	}
+	ht, tva, err := splitTax(value, rate.RateBps)
+	if err != nil {
+		return err
+	}
+
+	seller.InvoiceSequence++
+	invoice := Invoice{
+		DocType:        docTypeInvoice,
+		Number:         fmt.Sprintf("%s-%06d", seller.ID, seller.InvoiceSequence),
+		Sequence:       seller.InvoiceSequence,
+		TradeID:        trade.TradeID,
+		SellerID:       seller.ID,
+		BuyerID:        buyer.ID,
+		SellerFiscalID: seller.FiscalMatricule,
+		BuyerFiscalID:  buyer.FiscalMatricule,
+		Amount:         energy,
+		AmountHT:       ht,
+		TaxRateBps:     rate.RateBps,
+		AmountTVA:      tva,
+		AmountTTC:      value,
+		IssuedAt:       txTimestamp,
+		SchemaVersion:  currentSchemaVersion,
+	}
+
+	key, err := invoiceKey(ctx, invoice.Number)
+	if err != nil {
+		return err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read invoice: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("invoice %s already exists", invoice.Number)
+	}
+	if err := putRecord(ctx, key, &invoice); err != nil {
+		return err
+	}
+
+	trade.InvoiceNumber = invoice.Number
+	return nil
+}
+
+// SetTaxRate - Set the TVA rate applied to trades at settlement (regulator only)
+// rateBps is in basis points (1900 = 19%). Invoices already issued keep their rate.
+func (c *EnergyTokenContract) SetTaxRate(ctx contractapi.TransactionContextInterface,
+	rateBps Amount) error {
+
+	if err := assertRole(ctx, RoleRegulator); err != nil {
+		return err
+	}
+	if rateBps < 0 || rateBps > maxFeeRateBps {
+		return fmt.Errorf("tax rate must be between 0 and %d basis points", maxFeeRateBps)
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := taxRateKey(ctx)
+	if err != nil {
+		return err
+	}
+	rate := TaxRate{DocType: docTypeConfig, RateBps: rateBps, UpdatedAt: txTimestamp}
+	if err := putRecord(ctx, key, &rate); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.TaxRateSet, events.TaxRateSetEvent{
+		RateBps:   rate.RateBps,
+		Timestamp: txTimestamp,
+	})
+}
+
+// GetTaxRate - Get the TVA rate applied to trades at settlement
+func (c *EnergyTokenContract) GetTaxRate(ctx contractapi.TransactionContextInterface) (*TaxRate, error) {
+	return getTaxRate(ctx)
+}
+
+// GetInvoice - Get a tax invoice by number
+func (c *EnergyTokenContract) GetInvoice(ctx contractapi.TransactionContextInterface,
+	number string) (*Invoice, error) {
+
+	key, err := invoiceKey(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	invoiceJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read invoice: %v", err)
+	}
+	if invoiceJSON == nil {
+		return nil, fmt.Errorf("invoice %s does not exist", number)
+	}
+
+	var invoice Invoice
+	if err := json.Unmarshal(invoiceJSON, &invoice); err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// queryInvoices - Run a rich query and decode the resulting invoices
+func queryInvoices(ctx contractapi.TransactionContextInterface, query string) ([]*Invoice, error) {
+	resultsIterator, err := ctx.GetStub().GetQueryResult(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var invoices []*Invoice
+	err = collectResults(resultsIterator, func(value []byte) error {
+		var invoice Invoice
+		if err := json.Unmarshal(value, &invoice); err != nil {
+			return err
+		}
+		invoices = append(invoices, &invoice)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return invoices, nil
+}
+
+// GetInvoicesByMatricule - Get the invoices a fiscal matricule issued or received, oldest first
+// The RFC 3339 bounds from and to are optional ("" to ignore) and apply to the issue date.
+func (c *EnergyTokenContract) GetInvoicesByMatricule(ctx contractapi.TransactionContextInterface,
+	fiscalMatricule string, from string, to string) ([]*Invoice, error) {
+
+	if fiscalMatricule == "" {
+		return nil, fmt.Errorf("fiscal matricule is required")
+	}
+	issued, err := timeRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if issued == nil {
+		// Constrain issuedAt anyway so that CouchDB uses the index
+		issued = map[string]interface{}{"$gt": ""}
+	}
+
+	// Query each side separately so that both can use an index
+	invoices := []*Invoice{}
+	for _, side := range []struct{ field, index string }{
+		{"sellerFiscalId", indexInvoiceSeller},
+		{"buyerFiscalId", indexInvoiceBuyer},
+	} {
+		selector := map[string]interface{}{
+			"docType":  docTypeInvoice,
+			side.field: fiscalMatricule,
+			"issuedAt": issued,
+		}
+
+		query, err := buildQuery(selector, side.index)
+		if err != nil {
+			return nil, err
+		}
+		found, err := queryInvoices(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, found...)
+	}
+
+	sort.Slice(invoices, func(i, j int) bool {
+		if invoices[i].IssuedAt != invoices[j].IssuedAt {
+			return invoices[i].IssuedAt < invoices[j].IssuedAt
+		}
+		return invoices[i].Number < invoices[j].Number
+	})
+
+	return invoices, nil
+}
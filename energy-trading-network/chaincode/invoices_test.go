@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestSplitTax(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttc     Amount
+		rateBps Amount
+		wantHT  Amount
+		wantTVA Amount
+	}{
+		{name: "exact split", ttc: 11900, rateBps: 1900, wantHT: 10000, wantTVA: 1900},
+		{name: "HT rounds half up", ttc: 100, rateBps: 1900, wantHT: 84, wantTVA: 16},
+		{name: "single millime", ttc: 1, rateBps: 1900, wantHT: 1, wantTVA: 0},
+		{name: "no TVA", ttc: 12345, rateBps: 0, wantHT: 12345, wantTVA: 0},
+		{name: "free trade", ttc: 0, rateBps: 1900, wantHT: 0, wantTVA: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ht, tva, err := splitTax(tt.ttc, tt.rateBps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ht != tt.wantHT || tva != tt.wantTVA {
+				t.Errorf("splitTax(%d, %d) = %d HT + %d TVA, want %d + %d", tt.ttc, tt.rateBps, ht, tva, tt.wantHT, tt.wantTVA)
+			}
+		})
+	}
+}
+
+func TestSplitTaxAddsUp(t *testing.T) {
+	for _, rateBps := range []Amount{0, 700, 1300, 1900} {
+		for ttc := Amount(0); ttc <= 5000; ttc++ {
+			ht, tva, err := splitTax(ttc, rateBps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ht+tva != ttc || ht < 0 || tva < 0 {
+				t.Fatalf("splitTax(%d, %d) = %d HT + %d TVA", ttc, rateBps, ht, tva)
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Composite key namespaces; each record also carries its namespace in a docType field
+const (
+	docTypeFactory   = "factory"   // Factory records, keyed by factory ID
+	docTypeTrade     = "trade"     // Energy trades, keyed by trade ID
+	docTypeOffer     = "offer"     // Marketplace offers, keyed by offer ID
+	docTypeIndex     = "index"     // Lookup indexes, keyed by index name and value
+	docTypeRole      = "role"      // Role assignments, keyed by MSP ID and client ID
+	docTypeConfig    = "config"    // Contract-wide settings, keyed by setting name
+	docTypeBook      = "book"      // Order book entries, keyed by side, price, time priority and offer ID
+	docTypeAuction   = "auction"   // Auction intervals, keyed by interval ID
+	docTypeBid       = "bid"       // Auction order entries, keyed by interval ID, side, factory ID and offer ID
+	docTypeLot       = "lot"       // Sealed-bid lots, keyed by lot ID
+	docTypeSealedBid = "sealedBid" // Sealed bids, keyed by lot ID and bidder factory ID
+	docTypeStop      = "stop"      // Pending stop order entries, keyed by side, stop price, time priority and offer ID
+	docTypeLastPrice = "lastPrice" // Last order book trade price, keyed by delivery slot
+	docTypeTreasury  = "treasury"  // Zone treasury entries, keyed by entry kind and trade or transaction ID
+	docTypeInvoice   = "invoice"   // Tax invoices, keyed by invoice number
+	docTypeImbalance = "imbalance" // Delivery shortfall settlements, keyed by trade ID
+	docTypeBatch     = "batch"     // Netted settlement batches, keyed by batch ID
+)
+
+// Index names stored under the index namespace
+const (
+	indexEmail  = "email"  // Factory email -> factory ID (private collection)
+	indexFiscal = "fiscal" // Fiscal matricule -> factory ID
+)
+
+// makeKey - Build the composite key of a record in a namespace
+func makeKey(ctx contractapi.TransactionContextInterface, objectType string, attributes ...string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s key: %v", objectType, err)
+	}
+	return key, nil
+}
+
+// factoryKey - Ledger key of a factory
+func factoryKey(ctx contractapi.TransactionContextInterface, factoryID string) (string, error) {
+	return makeKey(ctx, docTypeFactory, factoryID)
+}
+
+// tradeKey - Ledger key of a trade
+func tradeKey(ctx contractapi.TransactionContextInterface, tradeID string) (string, error) {
+	return makeKey(ctx, docTypeTrade, tradeID)
+}
+
+// offerKey - Ledger key of an offer
+func offerKey(ctx contractapi.TransactionContextInterface, offerID string) (string, error) {
+	return makeKey(ctx, docTypeOffer, offerID)
+}
+
+// indexKey - Ledger key of an index entry
+func indexKey(ctx contractapi.TransactionContextInterface, index string, value string) (string, error) {
+	return makeKey(ctx, docTypeIndex, index, value)
+}
+
+// putRecord - Marshal a record and save it under a key
+func putRecord(ctx contractapi.TransactionContextInterface, key string, record interface{}) error {
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, recordJSON)
+}
+
+// putFactory - Save a factory under its composite key
+func putFactory(ctx contractapi.TransactionContextInterface, factory *Factory) error {
+	key, err := factoryKey(ctx, factory.ID)
+	if err != nil {
+		return err
+	}
+	factory.DocType = docTypeFactory
+	return putRecord(ctx, key, factory)
+}
+
+// putTrade - Save a trade under its composite key
+func putTrade(ctx contractapi.TransactionContextInterface, trade *EnergyTrade) error {
+	key, err := tradeKey(ctx, trade.TradeID)
+	if err != nil {
+		return err
+	}
+	trade.DocType = docTypeTrade
+	return putRecord(ctx, key, trade)
+}
+
+// putOffer - Save an offer under its composite key
+func putOffer(ctx contractapi.TransactionContextInterface, offer *Offer) error {
+	key, err := offerKey(ctx, offer.ID)
+	if err != nil {
+		return err
+	}
+	offer.DocType = docTypeOffer
+	return putRecord(ctx, key, offer)
+}
+
+// getIndex - Read the factory ID stored in an index entry ("" if absent)
+func getIndex(ctx contractapi.TransactionContextInterface, index string, value string) (string, error) {
+	key, err := indexKey(ctx, index, value)
+	if err != nil {
+		return "", err
+	}
+	target, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s index: %v", index, err)
+	}
+	return string(target), nil
+}
+
+// putIndex - Point an index entry at a factory ID
+func putIndex(ctx contractapi.TransactionContextInterface, index string, value string, target string) error {
+	key, err := indexKey(ctx, index, value)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, []byte(target))
+}
+
+// getTxTimestamp - Timestamp of the current transaction as stored in records
+// Timestamps are RFC 3339 in UTC, so they sort chronologically in range queries.
+func getTxTimestamp(ctx contractapi.TransactionContextInterface) (string, error) {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return "", err
+	}
+	return time.Unix(txTimestamp.GetSeconds(), int64(txTimestamp.GetNanos())).UTC().Format(time.RFC3339), nil
+}
+
+// normalizeTimestamp - Parse a client-supplied RFC 3339 timestamp and format it like stored records
+func normalizeTimestamp(name string, value string) (string, error) {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("%s %s is not RFC 3339: %v", name, value, err)
+	}
+	return parsed.UTC().Format(time.RFC3339), nil
+}
+
+// getKeyHistory - Every committed revision of a key as a JSON array
+func getKeyHistory(ctx contractapi.TransactionContextInterface, key string) (string, error) {
+	resultsIterator, err := ctx.GetStub().GetHistoryForKey(key)
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	var history []map[string]interface{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return "", err
+		}
+
+		// Keep historical values as stored so revisions in older layouts remain readable
+		var value interface{}
+		if len(response.Value) > 0 {
+			value = json.RawMessage(response.Value)
+		}
+
+		record := map[string]interface{}{
+			"txId":      response.TxId,
+			"value":     value,
+			"timestamp": response.Timestamp,
+			"isDelete":  response.IsDelete,
+		}
+		history = append(history, record)
+	}
+
+	historyJSON, err := json.Marshal(history)
+	if err != nil {
+		return "", err
+	}
+
+	return string(historyJSON), nil
+}
+
+// emitEvent - Attach a typed event payload to the transaction
+// Fabric keeps only the last event set by a transaction, so each transaction emits one.
+func emitEvent(ctx contractapi.TransactionContextInterface, name string, payload interface{}) error {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().SetEvent(name, payloadJSON)
+}
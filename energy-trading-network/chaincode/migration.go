@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Key prefixes used before records were namespaced under composite keys
+const (
+	legacyEmailPrefix  = "email_"
+	legacyFiscalPrefix = "fiscal_"
+	legacyOfferPrefix  = "offer_"
+)
+
+// legacyAmountFields - Numeric fields of pre-fixed-point records and their scale
+// Legacy energy was stored in kWh and legacy TEC (and TEC per kWh prices) in whole TEC.
+var legacyAmountFields = map[string]map[string]Amount{
+	docTypeFactory: {
+		"energyBalance":      WhPerKwh,
+		"currencyBalance":    MillimesPerTEC,
+		"dailyConsumption":   WhPerKwh,
+		"availableEnergy":    WhPerKwh,
+		"energyCapacity":     WhPerKwh,
+		"currentGeneration":  WhPerKwh,
+		"currentConsumption": WhPerKwh,
+	},
+	docTypeOffer: {
+		"energyAmount": WhPerKwh,
+		"pricePerKwh":  MillimesPerTEC,
+	},
+	docTypeTrade: {
+		"amount":       WhPerKwh,
+		"pricePerUnit": MillimesPerTEC,
+		"totalPrice":   MillimesPerTEC,
+	},
+}
+
+// legacyTimestampFields - Timestamp fields that earlier versions wrote in protobuf text form
+var legacyTimestampFields = map[string][]string{
+	docTypeFactory: {"createdAt"},
+	docTypeOffer:   {"createdAt", "updatedAt"},
+	docTypeTrade:   {"timestamp"},
+}
+
+// legacyTimestampPattern - Fields of a protobuf text timestamp such as "seconds:1700000000 nanos:5"
+var legacyTimestampPattern = regexp.MustCompile(`(seconds|nanos):\s*(-?\d+)`)
+
+// privateFactoryFields - Public factory fields that moved to the private data collection
+var privateFactoryFields = []string{"email", "passwordHash", "contactInfo"}
+
+// checkSchemaVersion - Reject records that have not been migrated to the current layout
+func checkSchemaVersion(kind string, id string, version int) error {
+	if version != currentSchemaVersion {
+		return fmt.Errorf("%s %s uses a legacy record layout; run MigrateLegacyRecords", kind, id)
+	}
+	return nil
+}
+
+// legacyRecordKind - Classify a legacy JSON record as factory, offer or trade ("" to skip)
+func legacyRecordKind(key string, record map[string]interface{}) string {
+	if strings.HasPrefix(key, legacyOfferPrefix) {
+		return docTypeOffer
+	}
+	if _, ok := record["tradeId"]; ok {
+		return docTypeTrade
+	}
+	if _, ok := record["id"]; ok {
+		if _, ok := record["name"]; ok {
+			return docTypeFactory
+		}
+	}
+	return ""
+}
+
+// convertLegacyAmounts - Convert the floating-point fields of a legacy record in place
+func convertLegacyAmounts(kind string, record map[string]interface{}) error {
+	for field, scale := range legacyAmountFields[kind] {
+		raw, ok := record[field]
+		if !ok {
+			continue
+		}
+		value, ok := raw.(float64)
+		if !ok {
+			return fmt.Errorf("field %s is not a number", field)
+		}
+		amount, err := amountFromDecimal(value, scale)
+		if err != nil {
+			return fmt.Errorf("field %s: %v", field, err)
+		}
+		record[field] = amount
+	}
+	record["schemaVersion"] = currentSchemaVersion
+	return nil
+}
+
+// normalizeLegacyTimestamp - Rewrite a protobuf text timestamp as RFC 3339 (UTC)
+// Empty and RFC 3339 values are returned unchanged.
+func normalizeLegacyTimestamp(value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+	if _, err := time.Parse(time.RFC3339, value); err == nil {
+		return value, nil
+	}
+
+	matches := legacyTimestampPattern.FindAllStringSubmatch(value, -1)
+	if matches == nil {
+		return "", fmt.Errorf("unrecognized timestamp %q", value)
+	}
+	var seconds, nanos int64
+	for _, match := range matches {
+		number, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("unrecognized timestamp %q: %v", value, err)
+		}
+		if match[1] == "seconds" {
+			seconds = number
+		} else {
+			nanos = number
+		}
+	}
+	return time.Unix(seconds, nanos).UTC().Format(time.RFC3339), nil
+}
+
+// convertLegacyTimestamps - Normalize the timestamp fields of a legacy record in place
+func convertLegacyTimestamps(kind string, record map[string]interface{}) error {
+	for _, field := range legacyTimestampFields[kind] {
+		value, ok := record[field].(string)
+		if !ok {
+			continue
+		}
+		normalized, err := normalizeLegacyTimestamp(value)
+		if err != nil {
+			return fmt.Errorf("field %s: %v", field, err)
+		}
+		record[field] = normalized
+	}
+	return nil
+}
+
+// moveLegacyPrivateDetails - Move credentials and contact data found in a public factory
+// record into its owner's private collection, leaving a hash reference. A factory without an
+// owner organization is assigned the caller's, whose collection then holds the details.
+func moveLegacyPrivateDetails(ctx contractapi.TransactionContextInterface, record map[string]interface{}) error {
+	str := func(field string) string {
+		value, _ := record[field].(string)
+		return value
+	}
+
+	found := false
+	for _, field := range privateFactoryFields {
+		if _, ok := record[field]; ok {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	details := FactoryPrivateDetails{
+		FactoryID:    str("id"),
+		Email:        str("email"),
+		PasswordHash: str("passwordHash"),
+		ContactInfo:  str("contactInfo"),
+	}
+	ownerMSP := str("ownerMsp")
+	if ownerMSP == "" {
+		caller, err := getCallerIdentity(ctx)
+		if err != nil {
+			return err
+		}
+		ownerMSP = caller.MSPID
+		record["ownerMsp"] = ownerMSP
+	}
+	hash, err := putFactoryPrivateDetails(ctx, ownerMSP, &details)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range privateFactoryFields {
+		delete(record, field)
+	}
+	record["privateDetailsHash"] = hash
+	return nil
+}
+
+// migrateLegacyEntry - Rewrite one raw-keyed ledger entry under its composite key
+// Factories and offers are collected for the reservation backfill instead of being written.
+// Returns false when the entry is not a record this chaincode wrote.
+func migrateLegacyEntry(ctx contractapi.TransactionContextInterface, key string, value []byte,
+	factories map[string]*Factory, offers map[string]*Offer) (bool, error) {
+	var newKey string
+	var newValue []byte
+	var err error
+
+	switch {
+	case strings.HasPrefix(key, legacyEmailPrefix):
+		// Email indexes now live in the private collection of the migrating organization
+		caller, err := getCallerIdentity(ctx)
+		if err != nil {
+			return false, err
+		}
+		if err := putEmailIndex(ctx, caller.MSPID, strings.TrimPrefix(key, legacyEmailPrefix), string(value)); err != nil {
+			return false, err
+		}
+		return true, ctx.GetStub().DelState(key)
+	case strings.HasPrefix(key, legacyFiscalPrefix):
+		newKey, err = indexKey(ctx, indexFiscal, strings.TrimPrefix(key, legacyFiscalPrefix))
+		newValue = value
+	default:
+		var record map[string]interface{}
+		if json.Unmarshal(value, &record) != nil {
+			return false, nil
+		}
+		kind := legacyRecordKind(key, record)
+		if kind == "" {
+			return false, nil
+		}
+		if _, ok := record["schemaVersion"]; !ok {
+			if err := convertLegacyTimestamps(kind, record); err != nil {
+				return false, fmt.Errorf("failed to migrate %s %s: %v", kind, key, err)
+			}
+			if err := convertLegacyAmounts(kind, record); err != nil {
+				return false, fmt.Errorf("failed to migrate %s %s: %v", kind, key, err)
+			}
+		}
+		if kind == docTypeFactory {
+			if err := moveLegacyPrivateDetails(ctx, record); err != nil {
+				return false, err
+			}
+		}
+		record["docType"] = kind
+
+		newValue, err = json.Marshal(record)
+		if err != nil {
+			return false, err
+		}
+		switch kind {
+		case docTypeFactory:
+			var factory Factory
+			if err := json.Unmarshal(newValue, &factory); err != nil {
+				return false, err
+			}
+			factories[factory.ID] = &factory
+			return true, ctx.GetStub().DelState(key)
+		case docTypeOffer:
+			var offer Offer
+			if err := json.Unmarshal(newValue, &offer); err != nil {
+				return false, err
+			}
+			offers[offer.ID] = &offer
+			return true, ctx.GetStub().DelState(key)
+		}
+		tradeID, _ := record["tradeId"].(string)
+		newKey, err = tradeKey(ctx, tradeID)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := ctx.GetStub().PutState(newKey, newValue); err != nil {
+		return false, err
+	}
+	return true, ctx.GetStub().DelState(key)
+}
+
+// backfillLegacyReservations - Reserve the energy or currency that migrated active offers need
+// Offers written before reservations existed hold nothing, so each is reserved against its
+// factory as CreateOffer would. An offer whose factory is gone or cannot cover it is
+// cancelled. Factories that were not migrated are loaded into factories, to be written with
+// the migrated ones.
+func (c *EnergyTokenContract) backfillLegacyReservations(ctx contractapi.TransactionContextInterface,
+	factories map[string]*Factory, offers map[string]*Offer) error {
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	offerIDs := make([]string, 0, len(offers))
+	for offerID := range offers {
+		offerIDs = append(offerIDs, offerID)
+	}
+	sort.Strings(offerIDs)
+
+	for _, offerID := range offerIDs {
+		offer := offers[offerID]
+		if offer.Status != OfferStatusActive || offer.ReservedEnergy != 0 || offer.ReservedCurrency != 0 {
+			continue
+		}
+
+		factory, ok := factories[offer.FactoryID]
+		if !ok {
+			exists, err := c.FactoryExists(ctx, offer.FactoryID)
+			if err != nil {
+				return err
+			}
+			if exists {
+				if factory, err = c.GetFactory(ctx, offer.FactoryID); err != nil {
+					return err
+				}
+				factories[factory.ID] = factory
+			}
+		}
+		if factory == nil || reserveOffer(factory, offer) != nil {
+			offer.Status = OfferStatusCancelled
+			offer.UpdatedAt = txTimestamp
+		}
+	}
+	return nil
+}
+
+// MigrateLegacyRecords - Move records written by earlier chaincode versions to the
+// current layout (zone operator only)
+// Records stored under raw keys are moved to their composite key namespace,
+// floating-point amounts are converted to fixed point, rounded to the nearest Wh or
+// millime, timestamps are rewritten as RFC 3339, and factory credentials and contact
+// data are moved to the private data collection of the factory's owner. Email indexes
+// move to the caller's organization, which must own the factories registered under them.
+// Active offers are reserved against their factories, or cancelled if they cannot be.
+// Composite keys are never returned by the raw range scan, so the migration can be run
+// repeatedly. Returns the number of entries migrated.
+func (c *EnergyTokenContract) MigrateLegacyRecords(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := assertRole(ctx, RoleOperator); err != nil {
+		return 0, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	factories := make(map[string]*Factory)
+	offers := make(map[string]*Offer)
+	migrated := 0
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		ok, err := migrateLegacyEntry(ctx, queryResponse.Key, queryResponse.Value, factories, offers)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			migrated++
+		}
+	}
+
+	if err := c.backfillLegacyReservations(ctx, factories, offers); err != nil {
+		return 0, err
+	}
+
+	factoryIDs := make([]string, 0, len(factories))
+	for factoryID := range factories {
+		factoryIDs = append(factoryIDs, factoryID)
+	}
+	sort.Strings(factoryIDs)
+	for _, factoryID := range factoryIDs {
+		if err := putFactory(ctx, factories[factoryID]); err != nil {
+			return 0, err
+		}
+	}
+
+	offerIDs := make([]string, 0, len(offers))
+	for offerID := range offers {
+		offerIDs = append(offerIDs, offerID)
+	}
+	sort.Strings(offerIDs)
+	for _, offerID := range offerIDs {
+		if err := putOffer(ctx, offers[offerID]); err != nil {
+			return 0, err
+		}
+	}
+
+	return migrated, nil
+}
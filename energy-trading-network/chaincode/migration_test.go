@@ -0,0 +1,115 @@
+package main
+
+import "testing"
+
+func TestNormalizeLegacyTimestamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "protobuf text", value: "seconds:1700000000 nanos:5", want: "2023-11-14T22:13:20Z"},
+		{name: "spaced fields", value: "seconds: 1700000000", want: "2023-11-14T22:13:20Z"},
+		{name: "zero seconds omitted", value: "nanos:5", want: "1970-01-01T00:00:00Z"},
+		{name: "already RFC 3339", value: "2026-01-01T12:00:00Z", want: "2026-01-01T12:00:00Z"},
+		{name: "empty", value: "", want: ""},
+		{name: "unrecognized", value: "yesterday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeLegacyTimestamp(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("normalizeLegacyTimestamp(%q) = %q, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalizeLegacyTimestamp(%q): %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeLegacyTimestamp(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrateLegacyRecordsBackfillsReservations(t *testing.T) {
+	ctx := newTestContext(t, "2026-01-01T12:00:00Z")
+	operator := serializedIdentity(t, "Org1MSP", "client")
+	seedRoles(t, ctx, submitAs(t, ctx, operator), RoleOperator)
+	seedFactories(t, ctx, &Factory{ID: "F2", CurrencyBalance: 1000})
+
+	legacy := map[string]string{
+		"F1":       `{"id":"F1","name":"Legacy","energyBalance":5,"currencyBalance":1,"createdAt":"seconds:1700000000"}`,
+		"offer_O1": `{"id":"O1","factoryId":"F1","offerType":"sell","energyAmount":3,"pricePerKwh":0.2,"status":"active"}`,
+		"offer_O2": `{"id":"O2","factoryId":"F1","offerType":"buy","energyAmount":2,"pricePerKwh":1,"status":"active"}`,
+		"offer_O3": `{"id":"O3","factoryId":"Gone","offerType":"sell","energyAmount":1,"pricePerKwh":0.2,"status":"active"}`,
+		"offer_O4": `{"id":"O4","factoryId":"F2","offerType":"buy","energyAmount":1,"pricePerKwh":0.5,"status":"active"}`,
+		"offer_O5": `{"id":"O5","factoryId":"F1","offerType":"sell","energyAmount":4,"pricePerKwh":0.2,"status":"completed"}`,
+	}
+	for key, value := range legacy {
+		if err := ctx.GetStub().PutState(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit(t, ctx)
+
+	c := new(EnergyTokenContract)
+	submitAs(t, ctx, operator)
+	migrated, err := c.MigrateLegacyRecords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != len(legacy) {
+		t.Errorf("migrated %d entries, want %d", migrated, len(legacy))
+	}
+	commit(t, ctx)
+
+	for factoryID, reserved := range map[string][2]Amount{"F1": {3000, 0}, "F2": {0, 500}} {
+		factory, err := c.GetFactory(ctx, factoryID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if factory.ReservedEnergy != reserved[0] || factory.ReservedCurrency != reserved[1] {
+			t.Errorf("factory %s reserves %d Wh and %d millimes; want %d Wh and %d millimes",
+				factoryID, factory.ReservedEnergy, factory.ReservedCurrency, reserved[0], reserved[1])
+		}
+	}
+	want := map[string]struct {
+		status           string
+		energy, currency Amount
+	}{
+		"O1": {OfferStatusActive, 3000, 0},
+		"O2": {OfferStatusCancelled, 0, 0},
+		"O3": {OfferStatusCancelled, 0, 0},
+		"O4": {OfferStatusActive, 0, 500},
+		"O5": {OfferStatusCompleted, 0, 0},
+	}
+	for offerID, w := range want {
+		offer, err := c.GetOffer(ctx, offerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offer.Status != w.status || offer.ReservedEnergy != w.energy || offer.ReservedCurrency != w.currency {
+			t.Errorf("offer %s is %s holding %d Wh and %d millimes; want %s holding %d Wh and %d millimes",
+				offerID, offer.Status, offer.ReservedEnergy, offer.ReservedCurrency, w.status, w.energy, w.currency)
+		}
+	}
+
+	factory, err := c.GetFactory(ctx, "F1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if factory.EnergyBalance != 5000 || factory.CurrencyBalance != 1000 {
+		t.Errorf("legacy balances migrated as %d Wh and %d millimes", factory.EnergyBalance, factory.CurrencyBalance)
+	}
+	if factory.CreatedAt != "2023-11-14T22:13:20Z" {
+		t.Errorf("legacy timestamp migrated as %q", factory.CreatedAt)
+	}
+	if migrated, err := c.MigrateLegacyRecords(ctx); err != nil || migrated != 0 {
+		t.Errorf("second migration moved %d entries (%v), want none", migrated, err)
+	}
+}
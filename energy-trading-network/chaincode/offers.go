@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
+)
+
+// assertNewOffer - Reject an offer ID that is already taken
+func assertNewOffer(ctx contractapi.TransactionContextInterface, offerID string) error {
+	key, err := offerKey(ctx, offerID)
+	if err != nil {
+		return err
+	}
+	existingOffer, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read offer: %v", err)
+	}
+	if existingOffer != nil {
+		return fmt.Errorf("offer %s already exists", offerID)
+	}
+	return nil
+}
+
+// offerTransitions - Statuses an offer may be moved to by its owner, per current status
+// Completed and expired offers are final; only fills complete an offer, so an owner cannot
+// close one as completed without trading it.
+var offerTransitions = map[string][]string{
+	OfferStatusActive:    {OfferStatusCancelled},
+	OfferStatusCancelled: {OfferStatusActive},
+	OfferStatusPending:   {OfferStatusCancelled},
+}
+
+// assertOfferTransition - Reject an offer status change that is not a legal transition
+func assertOfferTransition(from string, to string) error {
+	for _, allowed := range offerTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("offer status cannot change from %s to %s", from, to)
+}
+
+// AmendOffer - Change the amount and price of an active offer (factory owner only)
+// energyAmount is the new total in Wh and must exceed what was already filled. The offer's
+// reservation is recomputed and its revision number incremented; every revision stays
+// readable through GetOfferHistory. Book and auction orders cannot be amended.
+func (c *EnergyTokenContract) AmendOffer(ctx contractapi.TransactionContextInterface,
+	offerID string, energyAmount Amount, pricePerKwh Amount) error {
+
+	offer, err := c.GetOffer(ctx, offerID)
+	if err != nil {
+		return err
+	}
+	factory, err := c.GetFactory(ctx, offer.FactoryID)
+	if err != nil {
+		return err
+	}
+	if err := assertFactoryOwner(ctx, factory); err != nil {
+		return err
+	}
+
+	if offer.OfferType != OfferTypeBuy && offer.OfferType != OfferTypeSell {
+		return fmt.Errorf("offer type must be %s or %s", OfferTypeBuy, OfferTypeSell)
+	}
+	if offer.Status != OfferStatusActive {
+		return fmt.Errorf("offer %s is %s", offerID, offer.Status)
+	}
+	if offer.BookPriority != "" || offer.IntervalID != "" {
+		return fmt.Errorf("order %s cannot be amended; cancel it and place a new order instead", offerID)
+	}
+	if energyAmount <= offer.FilledAmount {
+		return fmt.Errorf("offer energy amount must exceed the %d Wh already filled", offer.FilledAmount)
+	}
+	if pricePerKwh < 0 {
+		return fmt.Errorf("price cannot be negative")
+	}
+	if energyAmount == offer.EnergyAmount && pricePerKwh == offer.PricePerKwh {
+		return fmt.Errorf("amendment does not change offer %s", offerID)
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	if err := assertSlotOpen(txTimestamp, offer.DeliveryStart); err != nil {
+		return err
+	}
+	if offerExpired(offer, txTimestamp) {
+		return fmt.Errorf("offer %s expired at %s", offerID, offer.ValidUntil)
+	}
+
+	// Swap the old reservation for the one the amended offer needs
+	previousAmount, previousPrice := offer.EnergyAmount, offer.PricePerKwh
+	if err := releaseOffer(factory, offer); err != nil {
+		return err
+	}
+	offer.EnergyAmount = energyAmount
+	offer.PricePerKwh = pricePerKwh
+	if err := reserveOffer(factory, offer); err != nil {
+		return err
+	}
+	offer.Revision++
+	offer.UpdatedAt = txTimestamp
+
+	if err := putFactory(ctx, factory); err != nil {
+		return err
+	}
+	if err := putOffer(ctx, offer); err != nil {
+		return err
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.OfferAmended, events.OfferAmendedEvent{
+		OfferID:              offer.ID,
+		FactoryID:            offer.FactoryID,
+		Revision:             offer.Revision,
+		PreviousEnergyAmount: previousAmount,
+		PreviousPricePerKwh:  previousPrice,
+		EnergyAmount:         offer.EnergyAmount,
+		PricePerKwh:          offer.PricePerKwh,
+		MSPID:                caller.MSPID,
+		ClientID:             caller.ID,
+		Timestamp:            txTimestamp,
+	})
+}
+
+// GetOfferHistory - Get every revision of an offer (offering factory owner or auditor)
+func (c *EnergyTokenContract) GetOfferHistory(ctx contractapi.TransactionContextInterface,
+	offerID string) (string, error) {
+
+	offer, err := c.GetOffer(ctx, offerID)
+	if err != nil {
+		return "", err
+	}
+	auditor, err := callerHasRole(ctx, RoleAuditor)
+	if err != nil {
+		return "", err
+	}
+	if !auditor {
+		factory, err := c.GetFactory(ctx, offer.FactoryID)
+		if err != nil {
+			return "", err
+		}
+		if err := assertFactoryOwner(ctx, factory); err != nil {
+			return "", err
+		}
+	}
+
+	key, err := offerKey(ctx, offerID)
+	if err != nil {
+		return "", err
+	}
+	return getKeyHistory(ctx, key)
+}
+
+// AcceptOffer - Fill all or part of an active offer on behalf of a counterparty factory
+// The resulting trade references the offer and is executed in the same transaction: the
+// buyer's TEC at the offer's price and the seller's energy are held in escrow until delivery
+// is confirmed, the offer's remaining amount shrinks by quantity (Wh) and the offer is
+// completed once fully filled. The offer itself stands for the maker's consent, so the
+// trade records the taker's acceptance only. Order book and auction orders only trade
+// through their venue.
+func (c *EnergyTokenContract) AcceptOffer(ctx contractapi.TransactionContextInterface,
+	offerID string, factoryID string, quantity Amount) (*EnergyTrade, error) {
+
+	offer, err := c.GetOffer(ctx, offerID)
+	if err != nil {
+		return nil, err
+	}
+	if offer.Status != OfferStatusActive {
+		return nil, fmt.Errorf("offer %s is %s", offerID, offer.Status)
+	}
+	if offer.IntervalID != "" {
+		return nil, fmt.Errorf("offer %s is an order in auction %s", offerID, offer.IntervalID)
+	}
+	if offer.BookPriority != "" {
+		return nil, fmt.Errorf("offer %s is an order in the book; use PlaceOrder", offerID)
+	}
+	if offer.FactoryID == factoryID {
+		return nil, fmt.Errorf("a factory cannot accept its own offer")
+	}
+
+	// Load both parties once; reads within a transaction do not see its own writes
+	maker, err := c.GetFactory(ctx, offer.FactoryID)
+	if err != nil {
+		return nil, err
+	}
+	taker, err := c.GetFactory(ctx, factoryID)
+	if err != nil {
+		return nil, err
+	}
+	if err := assertFactoryOwner(ctx, taker); err != nil {
+		return nil, err
+	}
+	if offer.OfferType == OfferTypeBuy && !sourceAccepted(offer, taker.EnergyType) {
+		return nil, fmt.Errorf("offer %s only accepts %s energy", offerID, strings.Join(offer.AcceptedSources, ", "))
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := assertSlotOpen(txTimestamp, offer.DeliveryStart); err != nil {
+		return nil, err
+	}
+	if offerExpired(offer, txTimestamp) {
+		return nil, fmt.Errorf("offer %s expired at %s", offerID, offer.ValidUntil)
+	}
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	acceptance := &TradeAcceptance{MSPID: caller.MSPID, ClientID: caller.ID, AcceptedAt: txTimestamp}
+
+	// Release the maker's reservation for the filled quantity, then escrow the trade
+	totalPrice, err := fillOffer(maker, offer, quantity, offer.PricePerKwh)
+	if err != nil {
+		return nil, err
+	}
+	offer.UpdatedAt = txTimestamp
+
+	trade := EnergyTrade{
+		TradeID:       newTradeID(ctx, 1),
+		Amount:        quantity,
+		PricePerUnit:  offer.PricePerKwh,
+		TotalPrice:    totalPrice,
+		Timestamp:     txTimestamp,
+		OfferID:       offer.ID,
+		DeliveryStart: offer.DeliveryStart,
+		DeliveryEnd:   offer.DeliveryEnd,
+		SchemaVersion: currentSchemaVersion,
+	}
+	seller, buyer := maker, taker
+	if offer.OfferType == OfferTypeSell {
+		trade.ProposedBy = TradeSideSeller
+		trade.BuyerAcceptance = acceptance
+	} else {
+		seller, buyer = taker, maker
+		trade.ProposedBy = TradeSideBuyer
+		trade.SellerAcceptance = acceptance
+	}
+	trade.SellerID = seller.ID
+	trade.BuyerID = buyer.ID
+	trade.EnergySource = seller.EnergyType
+
+	if err := escrowTrade(seller, buyer, &trade, txTimestamp); err != nil {
+		return nil, err
+	}
+
+	// Persist both parties, the offer and the trade
+	if err := putFactory(ctx, maker); err != nil {
+		return nil, err
+	}
+	if err := putFactory(ctx, taker); err != nil {
+		return nil, err
+	}
+	if err := putOffer(ctx, offer); err != nil {
+		return nil, err
+	}
+	if offer.Status != OfferStatusActive {
+		if err := removeFromBook(ctx, offer); err != nil {
+			return nil, err
+		}
+	}
+	if err := putTrade(ctx, &trade); err != nil {
+		return nil, err
+	}
+
+	return &trade, emitEvent(ctx, events.OfferAccepted, events.OfferAcceptedEvent{
+		OfferID:         offer.ID,
+		TradeID:         trade.TradeID,
+		SellerID:        trade.SellerID,
+		BuyerID:         trade.BuyerID,
+		EnergySource:    trade.EnergySource,
+		Amount:          trade.Amount,
+		PricePerKwh:     trade.PricePerUnit,
+		TotalPrice:      trade.TotalPrice,
+		TradeStatus:     trade.Status,
+		RemainingAmount: offerRemaining(offer),
+		OfferStatus:     offer.Status,
+		Timestamp:       txTimestamp,
+	})
+}
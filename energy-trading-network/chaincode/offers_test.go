@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestAssertOfferTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		wantErr  bool
+	}{
+		{from: OfferStatusActive, to: OfferStatusCancelled},
+		{from: OfferStatusCancelled, to: OfferStatusActive},
+		{from: OfferStatusPending, to: OfferStatusCancelled},
+		{from: OfferStatusActive, to: OfferStatusCompleted, wantErr: true},
+		{from: OfferStatusPending, to: OfferStatusActive, wantErr: true},
+		{from: OfferStatusCompleted, to: OfferStatusActive, wantErr: true},
+		{from: OfferStatusExpired, to: OfferStatusActive, wantErr: true},
+		{from: OfferStatusActive, to: "bogus", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			err := assertOfferTransition(tt.from, tt.to)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("assertOfferTransition(%s, %s) = %v, want error %v", tt.from, tt.to, err, tt.wantErr)
+			}
+		})
+	}
+}
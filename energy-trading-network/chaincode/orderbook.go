@@ -0,0 +1,607 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
+)
+
+// PriceLevel - Aggregated resting orders at one price
+type PriceLevel struct {
+	PricePerKwh Amount `json:"pricePerKwh"` // Price per kWh in millimes
+	Quantity    Amount `json:"quantity"`    // Remaining energy at this price in Wh
+	Orders      int    `json:"orders"`      // Number of resting orders at this price
+}
+
+// OrderBook - Best price levels on each side of the order book
+type OrderBook struct {
+	Bids []*PriceLevel `json:"bids"` // Buy levels, highest price first
+	Asks []*PriceLevel `json:"asks"` // Sell levels, lowest price first
+}
+
+// OrderResult - Outcome of placing an order
+type OrderResult struct {
+	Order     *Offer         `json:"order"`                                    // The order after matching
+	Trades    []*EnergyTrade `json:"trades,omitempty" metadata:",optional"`    // Trades produced by matching
+	Triggered []*Offer       `json:"triggered,omitempty" metadata:",optional"` // Stop orders triggered by those trades
+}
+
+// bookPriceKey - Sortable price component of a book key
+// Bids are stored with the price inverted so that both sides iterate best price first.
+func bookPriceKey(offerType string, price Amount) string {
+	if offerType == OfferTypeBuy {
+		price = math.MaxInt64 - price
+	}
+	return fmt.Sprintf("%019d", price)
+}
+
+// bookKey - Ledger key of an order's entry in the book
+// Each delivery slot has its own book. Within a slot, keys sort by side, then best price,
+// then time priority, giving price-time priority.
+func bookKey(ctx contractapi.TransactionContextInterface, offer *Offer) (string, error) {
+	return makeKey(ctx, docTypeBook, offer.DeliveryStart, offer.DeliveryEnd, offer.OfferType,
+		bookPriceKey(offer.OfferType, offer.PricePerKwh), offer.BookPriority, offer.ID)
+}
+
+// addToBook - Rest an order in the book
+func addToBook(ctx contractapi.TransactionContextInterface, offer *Offer) error {
+	key, err := bookKey(ctx, offer)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, []byte(offer.ID))
+}
+
+// removeFromBook - Take an order out of the book, or a pending stop order out of the stops
+// It is a no-op for offers outside the book.
+func removeFromBook(ctx contractapi.TransactionContextInterface, offer *Offer) error {
+	if offer.BookPriority == "" {
+		return nil
+	}
+	key, err := bookKey(ctx, offer)
+	if stopPending(offer) {
+		key, err = stopKey(ctx, offer)
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// bookPriority - Time priority of an order placed by this transaction
+// Orders rank by transaction time, and orders placed at the same time by transaction ID.
+// Unlike a shared counter, it reads nothing, so concurrent orders do not conflict.
+func bookPriority(ctx contractapi.TransactionContextInterface) (string, error) {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	nanos := time.Unix(txTimestamp.GetSeconds(), int64(txTimestamp.GetNanos())).UnixNano()
+	return fmt.Sprintf("%019d-%s", nanos, ctx.GetStub().GetTxID()), nil
+}
+
+// bookOrderLess - Whether resting order a ranks before b on their side of the book
+func bookOrderLess(a *Offer, b *Offer) bool {
+	priceA, priceB := bookPriceKey(a.OfferType, a.PricePerKwh), bookPriceKey(b.OfferType, b.PricePerKwh)
+	if priceA != priceB {
+		return priceA < priceB
+	}
+	if a.BookPriority != b.BookPriority {
+		return a.BookPriority < b.BookPriority
+	}
+	return a.ID < b.ID
+}
+
+// oppositeSide - Offer type an order of the given type matches against
+func oppositeSide(offerType string) string {
+	if offerType == OfferTypeBuy {
+		return OfferTypeSell
+	}
+	return OfferTypeBuy
+}
+
+// acceptsPrice - Whether an order's limit price allows trading at a price
+func acceptsPrice(order *Offer, price Amount) bool {
+	if marketOrder(order) {
+		return true
+	}
+	if order.OfferType == OfferTypeBuy {
+		return price <= order.PricePerKwh
+	}
+	return price >= order.PricePerKwh
+}
+
+// restingOrders - Resting orders an order may trade with, best price then earliest first
+// Orders of the order's own factory, and orders whose buy side does not accept the sell
+// side's energy source, are skipped. Offers are taken from and added to the cache, so
+// orders already filled in this transaction are skipped too. Orders rested earlier in
+// this transaction are not in the book it reads, so they are taken from the cache.
+func (c *EnergyTokenContract) restingOrders(ctx contractapi.TransactionContextInterface,
+	order *Offer, offers map[string]*Offer) ([]*Offer, error) {
+
+	side := oppositeSide(order.OfferType)
+	tradable := func(resting *Offer) bool {
+		return resting.Status == OfferStatusActive && resting.FactoryID != order.FactoryID &&
+			sourcesMatch(order, resting)
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeBook,
+		[]string{order.DeliveryStart, order.DeliveryEnd, side})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var candidates []*Offer
+	listed := make(map[string]bool)
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		resting, ok := offers[string(queryResponse.Value)]
+		if !ok {
+			if resting, err = c.GetOffer(ctx, string(queryResponse.Value)); err != nil {
+				return nil, err
+			}
+			offers[resting.ID] = resting
+		}
+		listed[resting.ID] = true
+		if !acceptsPrice(order, resting.PricePerKwh) {
+			break
+		}
+		if tradable(resting) {
+			candidates = append(candidates, resting)
+		}
+	}
+
+	// An active book order of the side that the book did not list was rested in this
+	// transaction
+	for _, resting := range offers {
+		if listed[resting.ID] || resting.BookPriority == "" || resting.OfferType != side ||
+			resting.DeliveryStart != order.DeliveryStart || resting.DeliveryEnd != order.DeliveryEnd {
+			continue
+		}
+		if acceptsPrice(order, resting.PricePerKwh) && tradable(resting) {
+			candidates = append(candidates, resting)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return bookOrderLess(candidates[i], candidates[j])
+	})
+
+	return candidates, nil
+}
+
+// fillQuantity - Energy (Wh) an order can take from a resting order given the buyer's budget
+// Only market buys are limited by budget; every other order has reserved what it trades.
+func fillQuantity(order *Offer, resting *Offer, left Amount, budget Amount) (Amount, error) {
+	quantity := left
+	if offerRemaining(resting) < quantity {
+		quantity = offerRemaining(resting)
+	}
+	if marketOrder(order) && order.OfferType == OfferTypeBuy {
+		affordable, err := affordableQuantity(order, budget, resting.PricePerKwh)
+		if err != nil {
+			return 0, err
+		}
+		if affordable < quantity {
+			quantity = affordable
+		}
+	}
+	return quantity, nil
+}
+
+// fillableQuantity - Energy (Wh) an order would fill against the resting orders right now
+// The fills are tried on copies of the order and its factory, which are left unchanged.
+func fillableQuantity(order *Offer, candidates []*Offer, factory *Factory, timestamp string) (Amount, error) {
+	trialOrder, trialFactory := *order, *factory
+	for _, resting := range candidates {
+		if offerRemaining(&trialOrder) == 0 {
+			break
+		}
+		if offerExpired(resting, timestamp) {
+			continue
+		}
+
+		quantity, err := fillQuantity(&trialOrder, resting, offerRemaining(&trialOrder), spendableCurrency(&trialFactory))
+		if err != nil {
+			return 0, err
+		}
+		if quantity == 0 {
+			break
+		}
+		value, err := fillOffer(&trialFactory, &trialOrder, quantity, resting.PricePerKwh)
+		if err != nil {
+			return 0, err
+		}
+		if order.OfferType == OfferTypeBuy {
+			if err := reserveFunds(&trialFactory, 0, value); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return trialOrder.FilledAmount - order.FilledAmount, nil
+}
+
+// matchOrder - Match an order against resting orders, in the order given
+// Each match trades at the resting order's price. Factories and offers are taken from and
+// added to the caches; the caller writes them and the returned trades, which extend trades.
+func (c *EnergyTokenContract) matchOrder(ctx contractapi.TransactionContextInterface,
+	order *Offer, candidates []*Offer, factories map[string]*Factory, trades []*EnergyTrade,
+	timestamp string) ([]*EnergyTrade, error) {
+
+	orderFactory := factories[order.FactoryID]
+	for _, resting := range candidates {
+		if offerRemaining(order) == 0 {
+			break
+		}
+
+		restingFactory, ok := factories[resting.FactoryID]
+		if !ok {
+			var err error
+			if restingFactory, err = c.GetFactory(ctx, resting.FactoryID); err != nil {
+				return nil, err
+			}
+			factories[resting.FactoryID] = restingFactory
+		}
+
+		// Orders past their validity leave the book instead of trading
+		if offerExpired(resting, timestamp) {
+			if err := expireOffer(ctx, restingFactory, resting, timestamp); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		quantity, err := fillQuantity(order, resting, offerRemaining(order), spendableCurrency(orderFactory))
+		if err != nil {
+			return nil, err
+		}
+		if quantity == 0 {
+			break
+		}
+		// Release both reservations for the matched quantity, then escrow the trade. The buy
+		// side's fills are valued on its notional, so they stay within its reservation.
+		restingValue, err := fillOffer(restingFactory, resting, quantity, resting.PricePerKwh)
+		if err != nil {
+			return nil, err
+		}
+		totalPrice, err := fillOffer(orderFactory, order, quantity, resting.PricePerKwh)
+		if err != nil {
+			return nil, err
+		}
+		resting.UpdatedAt = timestamp
+
+		trade := &EnergyTrade{
+			TradeID:       newTradeID(ctx, len(trades)+1),
+			Amount:        quantity,
+			PricePerUnit:  resting.PricePerKwh,
+			TotalPrice:    totalPrice,
+			Timestamp:     timestamp,
+			OfferID:       resting.ID,
+			TakerOfferID:  order.ID,
+			DeliveryStart: order.DeliveryStart,
+			DeliveryEnd:   order.DeliveryEnd,
+			SchemaVersion: currentSchemaVersion,
+		}
+		seller, buyer := restingFactory, orderFactory
+		trade.ProposedBy = TradeSideSeller
+		if resting.OfferType == OfferTypeBuy {
+			seller, buyer = orderFactory, restingFactory
+			trade.ProposedBy = TradeSideBuyer
+			trade.TotalPrice = restingValue
+		}
+		trade.SellerID = seller.ID
+		trade.BuyerID = buyer.ID
+		trade.EnergySource = seller.EnergyType
+
+		if err := escrowTrade(seller, buyer, trade, timestamp); err != nil {
+			return nil, err
+		}
+
+		if resting.Status != OfferStatusActive {
+			if err := removeFromBook(ctx, resting); err != nil {
+				return nil, err
+			}
+		}
+		trades = append(trades, trade)
+	}
+
+	return trades, nil
+}
+
+// executeOrder - Match an active order and apply its time in force to the remainder
+// A fill-or-kill order that cannot be filled entirely is cancelled without trading. What
+// is left of a GTC order rests in the book; what is left of any other order is cancelled.
+func (c *EnergyTokenContract) executeOrder(ctx contractapi.TransactionContextInterface,
+	order *Offer, factories map[string]*Factory, offers map[string]*Offer, trades []*EnergyTrade,
+	timestamp string) ([]*EnergyTrade, error) {
+
+	factory := factories[order.FactoryID]
+	candidates, err := c.restingOrders(ctx, order, offers)
+	if err != nil {
+		return nil, err
+	}
+
+	if order.TimeInForce == TimeInForceFOK {
+		fillable, err := fillableQuantity(order, candidates, factory, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if fillable < offerRemaining(order) {
+			return trades, cancelOrder(factory, order, timestamp)
+		}
+	}
+
+	if trades, err = c.matchOrder(ctx, order, candidates, factories, trades, timestamp); err != nil {
+		return nil, err
+	}
+	if order.Status != OfferStatusActive {
+		return trades, nil
+	}
+	if order.TimeInForce == TimeInForceGTC || order.TimeInForce == "" {
+		return trades, addToBook(ctx, order)
+	}
+	return trades, cancelOrder(factory, order, timestamp)
+}
+
+// cancelOrder - Cancel the unfilled remainder of an order, releasing its reservation
+func cancelOrder(factory *Factory, order *Offer, timestamp string) error {
+	if err := releaseOffer(factory, order); err != nil {
+		return err
+	}
+	order.Status = OfferStatusCancelled
+	order.UpdatedAt = timestamp
+	return nil
+}
+
+// PlaceOrder - Place an order in the order book of a delivery slot (factory owner only)
+// The order is matched right away against the best opposite orders of the same slot by
+// price, then by time; each match produces a trade at the resting order's price, held in
+// escrow until its delivery is confirmed. orderType is limit, market, stop or stop-limit
+// and timeInForce GTC, IOC or FOK ("" for the defaults); any GTC remainder rests in the
+// book as an active offer holding its reservation. Stop orders wait as pending until the
+// slot's last traded price crosses stopPrice. A buy order only matches sell orders from the
+// energy sources it lists, comma-separated ("" for any source). Empty delivery bounds
+// select the book of orders without a delivery slot.
+func (c *EnergyTokenContract) PlaceOrder(ctx contractapi.TransactionContextInterface,
+	orderID string, factoryID string, offerType string, energyAmount Amount, pricePerKwh Amount,
+	deliveryStart string, deliveryEnd string, orderType string, timeInForce string,
+	stopPrice Amount, acceptedSources string) (*OrderResult, error) {
+
+	if offerType != OfferTypeBuy && offerType != OfferTypeSell {
+		return nil, fmt.Errorf("offer type must be %s or %s", OfferTypeBuy, OfferTypeSell)
+	}
+	if energyAmount <= 0 {
+		return nil, fmt.Errorf("order energy amount must be positive")
+	}
+	orderType, timeInForce, err := orderTerms(orderType, timeInForce, pricePerKwh, stopPrice)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := offerSources(offerType, acceptedSources)
+	if err != nil {
+		return nil, err
+	}
+
+	factory, err := c.GetFactory(ctx, factoryID)
+	if err != nil {
+		return nil, err
+	}
+	if err := assertFactoryOwner(ctx, factory); err != nil {
+		return nil, err
+	}
+
+	if err := assertNewOffer(ctx, orderID); err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deliveryStart, deliveryEnd, err = deliveryWindow(txTimestamp, deliveryStart, deliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+	validUntil, err := offerValidity(txTimestamp, "", deliveryStart)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := bookPriority(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order := Offer{
+		ID:              orderID,
+		FactoryID:       factoryID,
+		OfferType:       offerType,
+		EnergyType:      factory.EnergyType,
+		EnergyAmount:    energyAmount,
+		PricePerKwh:     pricePerKwh,
+		Status:          OfferStatusActive,
+		BookPriority:    priority,
+		OrderType:       orderType,
+		TimeInForce:     timeInForce,
+		StopPrice:       stopPrice,
+		DeliveryStart:   deliveryStart,
+		DeliveryEnd:     deliveryEnd,
+		ValidUntil:      validUntil,
+		AcceptedSources: sources,
+		CreatedAt:       txTimestamp,
+		UpdatedAt:       txTimestamp,
+		SchemaVersion:   currentSchemaVersion,
+	}
+
+	// Lock the full order up front; fills release what they consume. Market buys have no
+	// limit price to reserve at and are held to the unreserved balance when they trade.
+	if err := reserveOffer(factory, &order); err != nil {
+		return nil, err
+	}
+
+	// Load each factory and offer once; reads within a transaction do not see its own writes
+	factories := map[string]*Factory{factoryID: factory}
+	offers := map[string]*Offer{orderID: &order}
+	var trades []*EnergyTrade
+	var triggered []*Offer
+
+	lastPrice, err := readLastPrice(ctx, deliveryStart, deliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+	if order.StopPrice > 0 && !stopTriggered(&order, lastPrice) {
+		order.Status = OfferStatusPending
+		if err := addToStops(ctx, &order); err != nil {
+			return nil, err
+		}
+	} else {
+		if order.StopPrice > 0 {
+			order.TriggeredAt = txTimestamp
+		}
+		if trades, err = c.executeOrder(ctx, &order, factories, offers, trades, txTimestamp); err != nil {
+			return nil, err
+		}
+		if triggered, trades, err = c.triggerStops(ctx, deliveryStart, deliveryEnd, factories, offers, trades, txTimestamp); err != nil {
+			return nil, err
+		}
+	}
+
+	factoryIDs := make([]string, 0, len(factories))
+	for factoryID := range factories {
+		factoryIDs = append(factoryIDs, factoryID)
+	}
+	sort.Strings(factoryIDs)
+	for _, factoryID := range factoryIDs {
+		if err := putFactory(ctx, factories[factoryID]); err != nil {
+			return nil, err
+		}
+	}
+	offerIDs := make([]string, 0, len(offers))
+	for offerID := range offers {
+		offerIDs = append(offerIDs, offerID)
+	}
+	sort.Strings(offerIDs)
+	for _, offerID := range offerIDs {
+		if err := putOffer(ctx, offers[offerID]); err != nil {
+			return nil, err
+		}
+	}
+	tradeIDs := []string{}
+	for _, trade := range trades {
+		if err := putTrade(ctx, trade); err != nil {
+			return nil, err
+		}
+		tradeIDs = append(tradeIDs, trade.TradeID)
+	}
+	if len(trades) > 0 {
+		if err := putLastPrice(ctx, trades[len(trades)-1]); err != nil {
+			return nil, err
+		}
+	}
+	triggeredIDs := []string{}
+	for _, stop := range triggered {
+		triggeredIDs = append(triggeredIDs, stop.ID)
+	}
+
+	result := &OrderResult{Order: &order, Trades: trades, Triggered: triggered}
+	return result, emitEvent(ctx, events.OrderPlaced, events.OrderPlacedEvent{
+		OrderID:           order.ID,
+		FactoryID:         order.FactoryID,
+		OfferType:         order.OfferType,
+		OrderType:         order.OrderType,
+		TimeInForce:       order.TimeInForce,
+		EnergyAmount:      order.EnergyAmount,
+		PricePerKwh:       order.PricePerKwh,
+		StopPrice:         order.StopPrice,
+		FilledAmount:      order.FilledAmount,
+		RemainingAmount:   offerRemaining(&order),
+		TradeIDs:          tradeIDs,
+		TriggeredOrderIDs: triggeredIDs,
+		Status:            order.Status,
+		Timestamp:         txTimestamp,
+	})
+}
+
+// GetOrderBook - Get the best depth price levels on each side of a delivery slot's order book
+// Empty delivery bounds select the book of orders without a delivery slot.
+func (c *EnergyTokenContract) GetOrderBook(ctx contractapi.TransactionContextInterface,
+	deliveryStart string, deliveryEnd string, depth int) (*OrderBook, error) {
+
+	if depth <= 0 || depth > maxPageSize {
+		return nil, fmt.Errorf("depth must be between 1 and %d", maxPageSize)
+	}
+	deliveryStart, deliveryEnd, err := parseDeliveryWindow(deliveryStart, deliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	book := OrderBook{}
+	for _, side := range []string{OfferTypeBuy, OfferTypeSell} {
+		levels, err := c.bookLevels(ctx, []string{deliveryStart, deliveryEnd, side}, depth)
+		if err != nil {
+			return nil, err
+		}
+		if side == OfferTypeBuy {
+			book.Bids = levels
+		} else {
+			book.Asks = levels
+		}
+	}
+
+	return &book, nil
+}
+
+// bookLevels - Aggregate the resting orders of one side into at most depth price levels
+// side holds the delivery start, delivery end and offer type of the book side.
+func (c *EnergyTokenContract) bookLevels(ctx contractapi.TransactionContextInterface,
+	side []string, depth int) ([]*PriceLevel, error) {
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeBook, side)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	levels := []*PriceLevel{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		offer, err := c.GetOffer(ctx, string(queryResponse.Value))
+		if err != nil {
+			return nil, err
+		}
+		if offerExpired(offer, txTimestamp) {
+			continue
+		}
+
+		last := len(levels) - 1
+		if last < 0 || levels[last].PricePerKwh != offer.PricePerKwh {
+			if len(levels) == depth {
+				break
+			}
+			levels = append(levels, &PriceLevel{PricePerKwh: offer.PricePerKwh})
+			last++
+		}
+		if levels[last].Quantity, err = addAmount(levels[last].Quantity, offerRemaining(offer)); err != nil {
+			return nil, err
+		}
+		levels[last].Orders++
+	}
+
+	return levels, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import "testing"
+
+func TestBookPriceKeyOrder(t *testing.T) {
+	tests := []struct {
+		name        string
+		offerType   string
+		better      Amount
+		worse       Amount
+		description string
+	}{
+		{name: "asks", offerType: OfferTypeSell, better: 99, worse: 100, description: "lower ask first"},
+		{name: "asks across digit counts", offerType: OfferTypeSell, better: 9, worse: 10, description: "lower ask first"},
+		{name: "bids", offerType: OfferTypeBuy, better: 100, worse: 99, description: "higher bid first"},
+		{name: "bids across digit counts", offerType: OfferTypeBuy, better: 10, worse: 9, description: "higher bid first"},
+		{name: "free energy bid", offerType: OfferTypeBuy, better: 1, worse: 0, description: "higher bid first"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			better := bookPriceKey(tt.offerType, tt.better)
+			worse := bookPriceKey(tt.offerType, tt.worse)
+			if better >= worse {
+				t.Errorf("%s: key %q for %d does not sort before %q for %d",
+					tt.description, better, tt.better, worse, tt.worse)
+			}
+		})
+	}
+}
+
+func TestAcceptsPrice(t *testing.T) {
+	tests := []struct {
+		name  string
+		order *Offer
+		price Amount
+		want  bool
+	}{
+		{name: "bid at its limit", order: &Offer{OfferType: OfferTypeBuy, PricePerKwh: 300}, price: 300, want: true},
+		{name: "bid below its limit", order: &Offer{OfferType: OfferTypeBuy, PricePerKwh: 300}, price: 250, want: true},
+		{name: "bid above its limit", order: &Offer{OfferType: OfferTypeBuy, PricePerKwh: 300}, price: 301},
+		{name: "ask at its limit", order: &Offer{OfferType: OfferTypeSell, PricePerKwh: 300}, price: 300, want: true},
+		{name: "ask below its limit", order: &Offer{OfferType: OfferTypeSell, PricePerKwh: 300}, price: 299},
+		{name: "market bid", order: &Offer{OfferType: OfferTypeBuy, OrderType: OrderTypeMarket}, price: 100000, want: true},
+		{name: "market ask", order: &Offer{OfferType: OfferTypeSell, OrderType: OrderTypeMarket}, price: 0, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := acceptsPrice(tt.order, tt.price); got != tt.want {
+				t.Errorf("acceptsPrice(%d) = %v, want %v", tt.price, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFillQuantity(t *testing.T) {
+	resting := &Offer{OfferType: OfferTypeSell, EnergyAmount: 5000, FilledAmount: 1000, PricePerKwh: 300}
+	tests := []struct {
+		name   string
+		order  *Offer
+		left   Amount
+		budget Amount
+		want   Amount
+	}{
+		{name: "order smaller than resting", order: &Offer{OfferType: OfferTypeBuy, OrderType: OrderTypeLimit}, left: 2000, want: 2000},
+		{name: "resting remainder limits", order: &Offer{OfferType: OfferTypeBuy, OrderType: OrderTypeLimit}, left: 9000, want: 4000},
+		{name: "limit buy ignores budget", order: &Offer{OfferType: OfferTypeBuy, OrderType: OrderTypeLimit}, left: 2000, budget: 0, want: 2000},
+		{name: "market buy limited by budget", order: &Offer{OfferType: OfferTypeBuy, OrderType: OrderTypeMarket}, left: 9000, budget: 600, want: 2001},
+		{name: "market buy value rounds into budget", order: &Offer{OfferType: OfferTypeBuy, OrderType: OrderTypeMarket}, left: 9000, budget: 601, want: 2004},
+		{name: "market buy without budget", order: &Offer{OfferType: OfferTypeBuy, OrderType: OrderTypeMarket}, left: 9000, budget: 0, want: 0},
+		// 1 Wh at 300 was paid 0 millimes (0.3 rounded down); 2001 Wh more would bring the total to 600.6
+		{name: "market buy budget counts earlier rounding", order: &Offer{OfferType: OfferTypeBuy, OrderType: OrderTypeMarket, FilledAmount: 1, FilledNotional: 300}, left: 9000, budget: 600, want: 2000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fillQuantity(tt.order, resting, tt.left, tt.budget)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("fillQuantity = %d Wh, want %d Wh", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceOrderTriggersStopAgainstOrderRestedInTransaction(t *testing.T) {
+	// The ask trades with the resting bid, which triggers the buy stop. The ask's remainder
+	// only rests in the book in this transaction, yet the stop must find and take it.
+	ctx := newTestContext(t, "2026-01-01T12:00:00Z")
+	seller, bidder, stopper := serializedIdentity(t, "Org1MSP", "client"),
+		serializedIdentity(t, "Org1MSP", "client"), serializedIdentity(t, "Org1MSP", "client")
+	seedFactories(t, ctx,
+		ownFactory(t, ctx, seller, &Factory{ID: "S1", EnergyType: "solar", EnergyBalance: 2000}),
+		ownFactory(t, ctx, bidder, &Factory{ID: "B1", CurrencyBalance: 1000}),
+		ownFactory(t, ctx, stopper, &Factory{ID: "B2", CurrencyBalance: 1000}))
+
+	c := new(EnergyTokenContract)
+	submitAs(t, ctx, bidder)
+	if _, err := c.PlaceOrder(ctx, "BID", "B1", OfferTypeBuy, 1000, 300, "", "", "", "", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, ctx)
+	submitAs(t, ctx, stopper)
+	if _, err := c.PlaceOrder(ctx, "STOP", "B2", OfferTypeBuy, 1000, 0, "", "", OrderTypeStop, "", 300, ""); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, ctx)
+
+	submitAs(t, ctx, seller)
+	result, err := c.PlaceOrder(ctx, "ASK", "S1", OfferTypeSell, 2000, 300, "", "", "", "", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Trades) != 2 || len(result.Triggered) != 1 || result.Triggered[0].ID != "STOP" {
+		t.Fatalf("got %d trades and %d triggered stops, want 2 and the stop", len(result.Trades), len(result.Triggered))
+	}
+	if stop := result.Trades[1]; stop.BuyerID != "B2" || stop.OfferID != "ASK" || stop.Amount != 1000 {
+		t.Errorf("stop bought %d Wh from offer %s as %s, want 1000 Wh from ASK as B2", stop.Amount, stop.OfferID, stop.BuyerID)
+	}
+	commit(t, ctx)
+
+	for _, offerID := range []string{"BID", "STOP", "ASK"} {
+		offer, err := c.GetOffer(ctx, offerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offer.Status != OfferStatusCompleted {
+			t.Errorf("offer %s is %s, want completed", offerID, offer.Status)
+		}
+	}
+	book, err := c.GetOrderBook(ctx, "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Bids) != 0 || len(book.Asks) != 0 {
+		t.Errorf("book still holds %d bid and %d ask levels", len(book.Bids), len(book.Asks))
+	}
+	factory, err := c.GetFactory(ctx, "S1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if factory.ReservedEnergy != 2000 {
+		t.Errorf("seller holds %d Wh in escrow, want 2000", factory.ReservedEnergy)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Order types
+const (
+	OrderTypeLimit     = "limit"      // Trades at the limit price or better
+	OrderTypeMarket    = "market"     // Trades at any price, sweeping the best prices first
+	OrderTypeStop      = "stop"       // Becomes a market order once the stop price is crossed
+	OrderTypeStopLimit = "stop-limit" // Becomes a limit order once the stop price is crossed
+)
+
+// Times in force
+const (
+	TimeInForceGTC = "GTC" // Good till cancelled: the remainder rests in the book until gate closure
+	TimeInForceIOC = "IOC" // Immediate or cancel: the remainder is cancelled after matching
+	TimeInForceFOK = "FOK" // Fill or kill: the order is cancelled unless it can be filled entirely
+)
+
+// LastPrice - Price of the latest order book trade of a delivery slot
+type LastPrice struct {
+	DocType       string `json:"docType"`                                      // Record namespace ("lastPrice")
+	DeliveryStart string `json:"deliveryStart,omitempty" metadata:",optional"` // Start of the delivery slot (RFC 3339)
+	DeliveryEnd   string `json:"deliveryEnd,omitempty" metadata:",optional"`   // End of the delivery slot (RFC 3339)
+	PricePerKwh   Amount `json:"pricePerKwh"`                                  // Price per kWh in millimes
+	TradeID       string `json:"tradeId"`                                      // Trade that set the price
+	Timestamp     string `json:"timestamp"`                                    // Trade timestamp
+	SchemaVersion int    `json:"schemaVersion,omitempty" metadata:",optional"` // Record layout version
+}
+
+// orderTerms - Validate an order type and time in force, applying their defaults
+// Market and stop orders take no limit price and never rest in the book, so they default
+// to IOC; limit and stop-limit orders default to GTC. Only stop orders take a stop price.
+func orderTerms(orderType string, timeInForce string, pricePerKwh Amount, stopPrice Amount) (string, string, error) {
+	if orderType == "" {
+		orderType = OrderTypeLimit
+	}
+
+	switch orderType {
+	case OrderTypeLimit, OrderTypeStopLimit:
+		if pricePerKwh < 0 {
+			return "", "", fmt.Errorf("price cannot be negative")
+		}
+		if timeInForce == "" {
+			timeInForce = TimeInForceGTC
+		}
+	case OrderTypeMarket, OrderTypeStop:
+		if pricePerKwh != 0 {
+			return "", "", fmt.Errorf("%s orders take no limit price; pass 0", orderType)
+		}
+		if timeInForce == "" {
+			timeInForce = TimeInForceIOC
+		}
+		if timeInForce == TimeInForceGTC {
+			return "", "", fmt.Errorf("%s orders cannot rest in the book; use %s or %s",
+				orderType, TimeInForceIOC, TimeInForceFOK)
+		}
+	default:
+		return "", "", fmt.Errorf("order type must be %s, %s, %s or %s",
+			OrderTypeLimit, OrderTypeMarket, OrderTypeStop, OrderTypeStopLimit)
+	}
+
+	if timeInForce != TimeInForceGTC && timeInForce != TimeInForceIOC && timeInForce != TimeInForceFOK {
+		return "", "", fmt.Errorf("time in force must be %s, %s or %s", TimeInForceGTC, TimeInForceIOC, TimeInForceFOK)
+	}
+
+	stopOrder := orderType == OrderTypeStop || orderType == OrderTypeStopLimit
+	if stopOrder && stopPrice <= 0 {
+		return "", "", fmt.Errorf("%s orders need a positive stop price", orderType)
+	}
+	if !stopOrder && stopPrice != 0 {
+		return "", "", fmt.Errorf("only stop orders take a stop price")
+	}
+
+	return orderType, timeInForce, nil
+}
+
+// marketOrder - Whether an order trades without a limit price
+func marketOrder(order *Offer) bool {
+	return order.OrderType == OrderTypeMarket || order.OrderType == OrderTypeStop
+}
+
+// stopPending - Whether a stop order is still waiting for its trigger
+func stopPending(order *Offer) bool {
+	return order.StopPrice > 0 && order.TriggeredAt == ""
+}
+
+// stopTriggered - Whether a last traded price crosses a stop order's stop price
+// Buy stops trigger at or above the stop price, sell stops at or below it.
+func stopTriggered(order *Offer, lastPrice *LastPrice) bool {
+	if lastPrice == nil {
+		return false
+	}
+	if order.OfferType == OfferTypeBuy {
+		return lastPrice.PricePerKwh >= order.StopPrice
+	}
+	return lastPrice.PricePerKwh <= order.StopPrice
+}
+
+// affordableQuantity - Most energy (Wh) a budget (millimes) buys for a buy order at a price per kWh
+// Fill values round half up on the order's notional (see fillValue), so the order can take
+// every Wh that keeps the rounded value of its notional within what it already paid plus
+// the budget. An empty budget buys nothing.
+func affordableQuantity(order *Offer, budget Amount, pricePerKwh Amount) (Amount, error) {
+	if budget <= 0 {
+		return 0, nil
+	}
+	if pricePerKwh == 0 {
+		return math.MaxInt64, nil
+	}
+	paid, err := mulDivAmount(order.FilledNotional, 1, WhPerKwh)
+	if err != nil {
+		return 0, err
+	}
+	limit, err := addAmount(paid, budget)
+	if err != nil {
+		return 0, err
+	}
+
+	// Notionals up to limit thousand minus one half still round to at most limit millimes
+	limitNotional, err := mulDivAmount(limit, WhPerKwh, 1)
+	if err == nil {
+		limitNotional, err = addAmount(limitNotional, WhPerKwh/2-1)
+	}
+	if err != nil {
+		// Only a quantity beyond any amount overflows
+		return math.MaxInt64, nil
+	}
+	return (limitNotional - order.FilledNotional) / pricePerKwh, nil
+}
+
+// stopKey - Ledger key of a pending stop order's entry
+// Buy stops sort by rising stop price and sell stops by falling stop price, so that on
+// each side the stops a price move crosses first come first.
+func stopKey(ctx contractapi.TransactionContextInterface, offer *Offer) (string, error) {
+	return makeKey(ctx, docTypeStop, offer.DeliveryStart, offer.DeliveryEnd, offer.OfferType,
+		bookPriceKey(oppositeSide(offer.OfferType), offer.StopPrice), offer.BookPriority, offer.ID)
+}
+
+// addToStops - Park a stop order until its stop price is crossed
+func addToStops(ctx contractapi.TransactionContextInterface, offer *Offer) error {
+	key, err := stopKey(ctx, offer)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, []byte(offer.ID))
+}
+
+// lastPriceKey - Ledger key of a delivery slot's last traded price
+func lastPriceKey(ctx contractapi.TransactionContextInterface, deliveryStart string, deliveryEnd string) (string, error) {
+	return makeKey(ctx, docTypeLastPrice, deliveryStart, deliveryEnd)
+}
+
+// readLastPrice - Read a delivery slot's last traded price (nil before its first trade)
+func readLastPrice(ctx contractapi.TransactionContextInterface, deliveryStart string, deliveryEnd string) (*LastPrice, error) {
+	key, err := lastPriceKey(ctx, deliveryStart, deliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+	priceJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read last price: %v", err)
+	}
+	if priceJSON == nil {
+		return nil, nil
+	}
+
+	var lastPrice LastPrice
+	if err := json.Unmarshal(priceJSON, &lastPrice); err != nil {
+		return nil, err
+	}
+	return &lastPrice, nil
+}
+
+// putLastPrice - Record a trade as the last traded price of its delivery slot
+func putLastPrice(ctx contractapi.TransactionContextInterface, trade *EnergyTrade) error {
+	key, err := lastPriceKey(ctx, trade.DeliveryStart, trade.DeliveryEnd)
+	if err != nil {
+		return err
+	}
+	return putRecord(ctx, key, &LastPrice{
+		DocType:       docTypeLastPrice,
+		DeliveryStart: trade.DeliveryStart,
+		DeliveryEnd:   trade.DeliveryEnd,
+		PricePerKwh:   trade.PricePerUnit,
+		TradeID:       trade.TradeID,
+		Timestamp:     trade.Timestamp,
+		SchemaVersion: currentSchemaVersion,
+	})
+}
+
+// crossedStops - Pending stop orders of a delivery slot triggered by a price, earliest first
+// Offers are taken from and added to the cache; stops already handled in this transaction
+// are skipped.
+func (c *EnergyTokenContract) crossedStops(ctx contractapi.TransactionContextInterface,
+	deliveryStart string, deliveryEnd string, price Amount, offers map[string]*Offer) ([]*Offer, error) {
+
+	lastPrice := &LastPrice{PricePerKwh: price}
+	var crossed []*Offer
+	for _, side := range []string{OfferTypeBuy, OfferTypeSell} {
+		stops, err := c.sideStops(ctx, []string{deliveryStart, deliveryEnd, side}, lastPrice, offers)
+		if err != nil {
+			return nil, err
+		}
+		crossed = append(crossed, stops...)
+	}
+
+	sort.Slice(crossed, func(i, j int) bool {
+		if crossed[i].BookPriority != crossed[j].BookPriority {
+			return crossed[i].BookPriority < crossed[j].BookPriority
+		}
+		return crossed[i].ID < crossed[j].ID
+	})
+	return crossed, nil
+}
+
+// sideStops - Pending stop orders of one side triggered by a last price
+// side holds the delivery start, delivery end and offer type of the stops. Stops parked
+// earlier in this transaction are not in the stops it reads, so they are taken from the
+// cache.
+func (c *EnergyTokenContract) sideStops(ctx contractapi.TransactionContextInterface,
+	side []string, lastPrice *LastPrice, offers map[string]*Offer) ([]*Offer, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeStop, side)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var stops []*Offer
+	listed := make(map[string]bool)
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		stop, ok := offers[string(queryResponse.Value)]
+		if !ok {
+			if stop, err = c.GetOffer(ctx, string(queryResponse.Value)); err != nil {
+				return nil, err
+			}
+			offers[stop.ID] = stop
+		}
+		listed[stop.ID] = true
+		if !stopTriggered(stop, lastPrice) {
+			break
+		}
+		if stop.Status == OfferStatusPending {
+			stops = append(stops, stop)
+		}
+	}
+
+	for _, stop := range offers {
+		if listed[stop.ID] || stop.Status != OfferStatusPending || stop.BookPriority == "" ||
+			stop.DeliveryStart != side[0] || stop.DeliveryEnd != side[1] || stop.OfferType != side[2] {
+			continue
+		}
+		if stopTriggered(stop, lastPrice) {
+			stops = append(stops, stop)
+		}
+	}
+
+	return stops, nil
+}
+
+// triggerStops - Activate and execute the stop orders crossed by the trades of a transaction
+// Trades of triggered stops move the last price in turn, so the check repeats until no
+// further stop is crossed. Returns the triggered stops and all trades.
+func (c *EnergyTokenContract) triggerStops(ctx contractapi.TransactionContextInterface,
+	deliveryStart string, deliveryEnd string, factories map[string]*Factory, offers map[string]*Offer,
+	trades []*EnergyTrade, timestamp string) ([]*Offer, []*EnergyTrade, error) {
+
+	var triggered []*Offer
+	for checked := 0; checked < len(trades); {
+		price := trades[len(trades)-1].PricePerUnit
+		checked = len(trades)
+
+		stops, err := c.crossedStops(ctx, deliveryStart, deliveryEnd, price, offers)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, stop := range stops {
+			if _, ok := factories[stop.FactoryID]; !ok {
+				factory, err := c.GetFactory(ctx, stop.FactoryID)
+				if err != nil {
+					return nil, nil, err
+				}
+				factories[stop.FactoryID] = factory
+			}
+
+			if err := removeFromBook(ctx, stop); err != nil {
+				return nil, nil, err
+			}
+			stop.Status = OfferStatusActive
+			stop.TriggeredAt = timestamp
+			stop.UpdatedAt = timestamp
+
+			if trades, err = c.executeOrder(ctx, stop, factories, offers, trades, timestamp); err != nil {
+				return nil, nil, err
+			}
+			triggered = append(triggered, stop)
+		}
+	}
+
+	return triggered, trades, nil
+}
+
+// GetLastPrice - Get the last order book trade price of a delivery slot
+// Empty delivery bounds select the book of orders without a delivery slot.
+func (c *EnergyTokenContract) GetLastPrice(ctx contractapi.TransactionContextInterface,
+	deliveryStart string, deliveryEnd string) (*LastPrice, error) {
+
+	deliveryStart, deliveryEnd, err := parseDeliveryWindow(deliveryStart, deliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+	lastPrice, err := readLastPrice(ctx, deliveryStart, deliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+	if lastPrice == nil {
+		return nil, fmt.Errorf("no order has traded in this delivery slot yet")
+	}
+	return lastPrice, nil
+}
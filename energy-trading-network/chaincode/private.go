@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// FactoryPrivateCollectionPrefix - Prefix of the private data collections holding factory credentials and contact data
+// Each organization has its own collection named after its MSP ID (e.g.
+// factoryPrivateDetails_Org1MSP), defined in collections_config.json, which must be
+// supplied when approving the chaincode.
+const FactoryPrivateCollectionPrefix = "factoryPrivateDetails_"
+
+// TransientFactoryDetails - Transient map key carrying FactoryPrivateDetails as JSON
+const TransientFactoryDetails = "factory_details"
+
+// FactoryPrivateDetails - Sensitive factory data kept out of the public world state
+type FactoryPrivateDetails struct {
+	DocType      string `json:"docType"`                                    // Record namespace ("factory")
+	FactoryID    string `json:"factoryId"`                                  // Factory the details belong to
+	Email        string `json:"email"`                                      // Factory email for authentication
+	PasswordHash string `json:"passwordHash"`                               // Hashed password for authentication
+	ContactInfo  string `json:"contactInfo,omitempty" metadata:",optional"` // Contact information
+}
+
+// factoryPrivateCollection - Private data collection of an organization
+func factoryPrivateCollection(mspID string) string {
+	return FactoryPrivateCollectionPrefix + mspID
+}
+
+// readTransientFactoryDetails - Read the private factory details passed in the transient map
+func readTransientFactoryDetails(ctx contractapi.TransactionContextInterface) (*FactoryPrivateDetails, error) {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transient map: %v", err)
+	}
+
+	detailsJSON, ok := transientMap[TransientFactoryDetails]
+	if !ok {
+		return nil, fmt.Errorf("%s must be provided in the transient map", TransientFactoryDetails)
+	}
+
+	var details FactoryPrivateDetails
+	if err := json.Unmarshal(detailsJSON, &details); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", TransientFactoryDetails, err)
+	}
+	if details.Email == "" || details.PasswordHash == "" {
+		return nil, fmt.Errorf("email and passwordHash are required")
+	}
+
+	return &details, nil
+}
+
+// putFactoryPrivateDetails - Save private factory details in the owning organization's collection
+// and index the email there for login lookup
+// Returns the hex SHA-256 of the stored details, which the public factory record keeps as
+// a reference.
+func putFactoryPrivateDetails(ctx contractapi.TransactionContextInterface, ownerMSP string,
+	details *FactoryPrivateDetails) (string, error) {
+
+	details.DocType = docTypeFactory
+
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := factoryKey(ctx, details.FactoryID)
+	if err != nil {
+		return "", err
+	}
+	if err := ctx.GetStub().PutPrivateData(factoryPrivateCollection(ownerMSP), key, detailsJSON); err != nil {
+		return "", fmt.Errorf("failed to put private details: %v", err)
+	}
+
+	if details.Email != "" {
+		if err := putEmailIndex(ctx, ownerMSP, details.Email, details.FactoryID); err != nil {
+			return "", err
+		}
+	}
+
+	hash := sha256.Sum256(detailsJSON)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// putEmailIndex - Point an organization's private email index entry at a factory ID
+func putEmailIndex(ctx contractapi.TransactionContextInterface, mspID string, email string, factoryID string) error {
+	key, err := indexKey(ctx, indexEmail, email)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutPrivateData(factoryPrivateCollection(mspID), key, []byte(factoryID)); err != nil {
+		return fmt.Errorf("failed to put email index: %v", err)
+	}
+	return nil
+}
+
+// getEmailIndex - Read the factory ID an organization registered under an email ("" if none)
+func getEmailIndex(ctx contractapi.TransactionContextInterface, mspID string, email string) (string, error) {
+	key, err := indexKey(ctx, indexEmail, email)
+	if err != nil {
+		return "", err
+	}
+	factoryID, err := ctx.GetStub().GetPrivateData(factoryPrivateCollection(mspID), key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read email index: %v", err)
+	}
+	return string(factoryID), nil
+}
+
+// GetFactoryPrivateDetails - Get the credentials and contact data of a factory
+// Only clients of the factory's owning organization may read them.
+func (c *EnergyTokenContract) GetFactoryPrivateDetails(ctx contractapi.TransactionContextInterface,
+	factoryID string) (*FactoryPrivateDetails, error) {
+
+	factory, err := c.GetFactory(ctx, factoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller.MSPID != factory.OwnerMSP {
+		return nil, fmt.Errorf("client from %s is not authorized to read private details of factory %s",
+			caller.MSPID, factoryID)
+	}
+
+	key, err := factoryKey(ctx, factoryID)
+	if err != nil {
+		return nil, err
+	}
+	detailsJSON, err := ctx.GetStub().GetPrivateData(factoryPrivateCollection(factory.OwnerMSP), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private details: %v", err)
+	}
+	if detailsJSON == nil {
+		return nil, fmt.Errorf("factory %s has no private details", factoryID)
+	}
+
+	var details FactoryPrivateDetails
+	if err := json.Unmarshal(detailsJSON, &details); err != nil {
+		return nil, err
+	}
+
+	return &details, nil
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// maxPageSize - Largest page a paginated query may request
+const maxPageSize = 200
+
+// FactoryPage - One page of factories
+type FactoryPage struct {
+	Records      []*Factory `json:"records,omitempty" metadata:",optional"` // Factories on this page
+	FetchedCount int32      `json:"fetchedCount"`                           // Number of records on this page
+	Bookmark     string     `json:"bookmark"`                               // Bookmark to pass for the next page
+}
+
+// TradePage - One page of trades
+type TradePage struct {
+	Records      []*EnergyTrade `json:"records,omitempty" metadata:",optional"` // Trades on this page
+	FetchedCount int32          `json:"fetchedCount"`                           // Number of records on this page
+	Bookmark     string         `json:"bookmark"`                               // Bookmark to pass for the next page
+}
+
+// OfferPage - One page of offers
+type OfferPage struct {
+	Records      []*Offer `json:"records,omitempty" metadata:",optional"` // Offers on this page
+	FetchedCount int32    `json:"fetchedCount"`                           // Number of records on this page
+	Bookmark     string   `json:"bookmark"`                               // Bookmark to pass for the next page
+}
+
+// validatePageSize - Reject page sizes outside 1..maxPageSize
+func validatePageSize(pageSize int32) error {
+	if pageSize <= 0 || pageSize > maxPageSize {
+		return fmt.Errorf("page size must be between 1 and %d", maxPageSize)
+	}
+	return nil
+}
+
+// collectResults - Drain a query iterator, unmarshalling each value with decode
+func collectResults(resultsIterator shim.StateQueryIteratorInterface, decode func(value []byte) error) error {
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		if err := decode(queryResponse.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetFactoriesPage - Query one page of factories, starting at a bookmark ("" for the first page)
+func (c *EnergyTokenContract) GetFactoriesPage(ctx contractapi.TransactionContextInterface,
+	pageSize int32, bookmark string) (*FactoryPage, error) {
+
+	if err := validatePageSize(pageSize); err != nil {
+		return nil, err
+	}
+
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(
+		docTypeFactory, []string{}, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	page := FactoryPage{}
+	err = collectResults(resultsIterator, func(value []byte) error {
+		var factory Factory
+		if err := json.Unmarshal(value, &factory); err != nil {
+			return err
+		}
+		page.Records = append(page.Records, &factory)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page.FetchedCount = metadata.FetchedRecordsCount
+	page.Bookmark = metadata.Bookmark
+	return &page, nil
+}
+
+// GetTradesPage - Query one page of trades, starting at a bookmark ("" for the first page)
+func (c *EnergyTokenContract) GetTradesPage(ctx contractapi.TransactionContextInterface,
+	pageSize int32, bookmark string) (*TradePage, error) {
+
+	if err := validatePageSize(pageSize); err != nil {
+		return nil, err
+	}
+
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(
+		docTypeTrade, []string{}, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	page := TradePage{}
+	err = collectResults(resultsIterator, func(value []byte) error {
+		var trade EnergyTrade
+		if err := json.Unmarshal(value, &trade); err != nil {
+			return err
+		}
+		page.Records = append(page.Records, &trade)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page.FetchedCount = metadata.FetchedRecordsCount
+	page.Bookmark = metadata.Bookmark
+	return &page, nil
+}
+
+// GetOffersPage - Query one page of active offers, starting at a bookmark ("" for the first page)
+// Filtering on status needs a rich query, so this requires CouchDB as the state database.
+func (c *EnergyTokenContract) GetOffersPage(ctx contractapi.TransactionContextInterface,
+	pageSize int32, bookmark string) (*OfferPage, error) {
+
+	if err := validatePageSize(pageSize); err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query, err := buildQuery(restrictToLive(map[string]interface{}{
+		"docType": docTypeOffer,
+		"status":  OfferStatusActive,
+	}, txTimestamp), indexStatus)
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, metadata, err := ctx.GetStub().GetQueryResultWithPagination(query, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	page := OfferPage{}
+	err = collectResults(resultsIterator, func(value []byte) error {
+		var offer Offer
+		if err := json.Unmarshal(value, &offer); err != nil {
+			return err
+		}
+		page.Records = append(page.Records, &offer)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page.FetchedCount = metadata.FetchedRecordsCount
+	page.Bookmark = metadata.Bookmark
+	return &page, nil
+}
+
+// CouchDB indexes shipped in META-INF/statedb/couchdb/indexes
+// Each index lives in a design document named after it with a "Doc" suffix. CouchDB only
+// uses an index when the selector constrains all of its fields.
+const (
+	indexTradeSeller   = "indexTradeSeller"   // docType, sellerId
+	indexTradeBuyer    = "indexTradeBuyer"    // docType, buyerId
+	indexStatus        = "indexStatus"        // docType, status
+	indexOfferFactory  = "indexOfferFactory"  // docType, factoryId
+	indexOfferType     = "indexOfferType"     // docType, offerType, pricePerKwh
+	indexDelivery      = "indexDelivery"      // docType, deliveryStart
+	indexInvoiceSeller = "indexInvoiceSeller" // docType, sellerFiscalId, issuedAt
+	indexInvoiceBuyer  = "indexInvoiceBuyer"  // docType, buyerFiscalId, issuedAt
+)
+
+// buildQuery - Marshal a CouchDB query for a selector, hinting the index to use ("" for none)
+func buildQuery(selector map[string]interface{}, index string) (string, error) {
+	query := map[string]interface{}{"selector": selector}
+	if index != "" {
+		query["use_index"] = []string{"_design/" + index + "Doc", index}
+	}
+
+	queryJSON, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	return string(queryJSON), nil
+}
+
+// restrictSelector - Parse a client-supplied selector and confine it to one record namespace
+// so that rich queries cannot read roles, indexes or other record types.
+func restrictSelector(selectorJSON string, docType string) (map[string]interface{}, error) {
+	var selector map[string]interface{}
+	if err := json.Unmarshal([]byte(selectorJSON), &selector); err != nil {
+		return nil, fmt.Errorf("selector must be a JSON object: %v", err)
+	}
+	if selector == nil {
+		return nil, fmt.Errorf("selector must be a JSON object")
+	}
+
+	return map[string]interface{}{
+		"$and": []interface{}{
+			map[string]interface{}{"docType": docType},
+			selector,
+		},
+	}, nil
+}
+
+// timeRange - Selector condition for timestamps between from and to, inclusive
+// Either bound may be empty; returns nil when both are.
+func timeRange(from string, to string) (map[string]interface{}, error) {
+	condition := map[string]interface{}{}
+	for op, bound := range map[string]string{"$gte": from, "$lte": to} {
+		if bound == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound)
+		if err != nil {
+			return nil, fmt.Errorf("timestamp %s is not RFC 3339: %v", bound, err)
+		}
+		condition[op] = t.UTC().Format(time.RFC3339)
+	}
+
+	if len(condition) == 0 {
+		return nil, nil
+	}
+	return condition, nil
+}
+
+// queryTrades - Run a rich query and decode the resulting trades
+func queryTrades(ctx contractapi.TransactionContextInterface, query string) ([]*EnergyTrade, error) {
+	resultsIterator, err := ctx.GetStub().GetQueryResult(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var trades []*EnergyTrade
+	err = collectResults(resultsIterator, func(value []byte) error {
+		var trade EnergyTrade
+		if err := json.Unmarshal(value, &trade); err != nil {
+			return err
+		}
+		trades = append(trades, &trade)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return trades, nil
+}
+
+// queryOffers - Run a rich query and decode the resulting offers
+func queryOffers(ctx contractapi.TransactionContextInterface, query string) ([]*Offer, error) {
+	resultsIterator, err := ctx.GetStub().GetQueryResult(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var offers []*Offer
+	err = collectResults(resultsIterator, func(value []byte) error {
+		var offer Offer
+		if err := json.Unmarshal(value, &offer); err != nil {
+			return err
+		}
+		offers = append(offers, &offer)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return offers, nil
+}
+
+// QueryTrades - Query trades with a CouchDB selector (e.g. {"status":"pending"})
+func (c *EnergyTokenContract) QueryTrades(ctx contractapi.TransactionContextInterface,
+	selectorJSON string) ([]*EnergyTrade, error) {
+
+	selector, err := restrictSelector(selectorJSON, docTypeTrade)
+	if err != nil {
+		return nil, err
+	}
+	query, err := buildQuery(selector, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return queryTrades(ctx, query)
+}
+
+// QueryOffers - Query offers with a CouchDB selector (e.g. {"offerType":"sell"})
+func (c *EnergyTokenContract) QueryOffers(ctx contractapi.TransactionContextInterface,
+	selectorJSON string) ([]*Offer, error) {
+
+	selector, err := restrictSelector(selectorJSON, docTypeOffer)
+	if err != nil {
+		return nil, err
+	}
+	query, err := buildQuery(selector, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return queryOffers(ctx, query)
+}
+
+// GetTradesByFactory - Get the trades a factory sold or bought, oldest first
+// status and the RFC 3339 bounds from and to are optional filters ("" to ignore).
+func (c *EnergyTokenContract) GetTradesByFactory(ctx contractapi.TransactionContextInterface,
+	factoryID string, status string, from string, to string) ([]*EnergyTrade, error) {
+
+	timestamps, err := timeRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// Query each side separately so that both can use an index
+	var trades []*EnergyTrade
+	for field, index := range map[string]string{"sellerId": indexTradeSeller, "buyerId": indexTradeBuyer} {
+		selector := map[string]interface{}{
+			"docType": docTypeTrade,
+			field:     factoryID,
+		}
+		if status != "" {
+			selector["status"] = status
+		}
+		if timestamps != nil {
+			selector["timestamp"] = timestamps
+		}
+
+		query, err := buildQuery(selector, index)
+		if err != nil {
+			return nil, err
+		}
+		side, err := queryTrades(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, side...)
+	}
+
+	sort.Slice(trades, func(i, j int) bool {
+		if trades[i].Timestamp != trades[j].Timestamp {
+			return trades[i].Timestamp < trades[j].Timestamp
+		}
+		return trades[i].TradeID < trades[j].TradeID
+	})
+
+	return trades, nil
+}
+
+// GetOffersByFactory - Get every offer of a factory, oldest first
+func (c *EnergyTokenContract) GetOffersByFactory(ctx contractapi.TransactionContextInterface,
+	factoryID string) ([]*Offer, error) {
+
+	query, err := buildQuery(map[string]interface{}{
+		"docType":   docTypeOffer,
+		"factoryId": factoryID,
+	}, indexOfferFactory)
+	if err != nil {
+		return nil, err
+	}
+
+	offers, err := queryOffers(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(offers, func(i, j int) bool {
+		if offers[i].CreatedAt != offers[j].CreatedAt {
+			return offers[i].CreatedAt < offers[j].CreatedAt
+		}
+		return offers[i].ID < offers[j].ID
+	})
+
+	return offers, nil
+}
+
+// GetOffersByType - Get active buy or sell offers, best price first
+// energyType is optional ("" for any source); prices are in millimes per kWh and a
+// maxPrice of 0 means no upper bound.
+func (c *EnergyTokenContract) GetOffersByType(ctx contractapi.TransactionContextInterface,
+	offerType string, energyType string, minPrice Amount, maxPrice Amount) ([]*Offer, error) {
+
+	if offerType != OfferTypeBuy && offerType != OfferTypeSell {
+		return nil, fmt.Errorf("offer type must be %s or %s", OfferTypeBuy, OfferTypeSell)
+	}
+	if minPrice < 0 || maxPrice < 0 {
+		return nil, fmt.Errorf("price bounds cannot be negative")
+	}
+
+	price := map[string]interface{}{"$gte": minPrice}
+	if maxPrice > 0 {
+		price["$lte"] = maxPrice
+	}
+	selector := map[string]interface{}{
+		"docType":     docTypeOffer,
+		"offerType":   offerType,
+		"pricePerKwh": price,
+		"status":      OfferStatusActive,
+	}
+	if energyType != "" {
+		selector["energyType"] = energyType
+	}
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := buildQuery(restrictToLive(selector, txTimestamp), indexOfferType)
+	if err != nil {
+		return nil, err
+	}
+	offers, err := queryOffers(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sellers compete on the lowest price, buyers on the highest
+	sort.Slice(offers, func(i, j int) bool {
+		if offers[i].PricePerKwh != offers[j].PricePerKwh {
+			if offerType == OfferTypeSell {
+				return offers[i].PricePerKwh < offers[j].PricePerKwh
+			}
+			return offers[i].PricePerKwh > offers[j].PricePerKwh
+		}
+		if offers[i].CreatedAt != offers[j].CreatedAt {
+			return offers[i].CreatedAt < offers[j].CreatedAt
+		}
+		return offers[i].ID < offers[j].ID
+	})
+
+	return offers, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Roles that can be granted to client identities
+const (
+	RoleOperator  = "operator"  // Zone operator: initializes the ledger, registers factories, manages roles
+	RoleOracle    = "oracle"    // Meter oracle: mints tokens and reports metered energy data
+	RoleRegulator = "regulator" // Regulator: oversees market rules
+	RoleAuditor   = "auditor"   // Auditor: reads the full history of ledger records
+	RoleMeter     = "meter"     // Smart meter: confirms the physical delivery of traded energy
+)
+
+// configRoleBootstrap - Config entry marking that the first zone operator has been assigned
+const configRoleBootstrap = "roleBootstrap"
+
+// Identity allowed to claim the operator role on a fresh ledger: an admin of the zone's organization
+const (
+	bootstrapOperatorMSP = "Org1MSP" // MSP ID of the zone's organization
+	bootstrapOperatorOU  = "admin"   // Organizational unit of its admin certificates
+)
+
+// RoleAssignment - Roles granted to a client identity
+type RoleAssignment struct {
+	DocType   string   `json:"docType"`                                  // Record namespace ("role")
+	MSPID     string   `json:"mspId"`                                    // MSP ID of the identity
+	ClientID  string   `json:"clientId"`                                 // Certificate ID of the identity
+	Roles     []string `json:"roles,omitempty" metadata:",optional"`     // Granted roles
+	UpdatedAt string   `json:"updatedAt,omitempty" metadata:",optional"` // Last update timestamp
+}
+
+// isValidRole - Check that a role name is one of the known roles
+func isValidRole(role string) bool {
+	switch role {
+	case RoleOperator, RoleOracle, RoleRegulator, RoleAuditor, RoleMeter:
+		return true
+	}
+	return false
+}
+
+// roleKey - Ledger key of the role assignment of an identity
+func roleKey(ctx contractapi.TransactionContextInterface, mspID string, clientID string) (string, error) {
+	return makeKey(ctx, docTypeRole, mspID, clientID)
+}
+
+// getRoleAssignment - Read the role assignment of an identity (empty if none)
+func getRoleAssignment(ctx contractapi.TransactionContextInterface,
+	mspID string, clientID string) (*RoleAssignment, error) {
+
+	key, err := roleKey(ctx, mspID, clientID)
+	if err != nil {
+		return nil, err
+	}
+	assignmentJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read roles: %v", err)
+	}
+
+	assignment := RoleAssignment{DocType: docTypeRole, MSPID: mspID, ClientID: clientID}
+	if assignmentJSON != nil {
+		if err := json.Unmarshal(assignmentJSON, &assignment); err != nil {
+			return nil, err
+		}
+	}
+
+	return &assignment, nil
+}
+
+// putRoleAssignment - Save the role assignment of an identity
+func putRoleAssignment(ctx contractapi.TransactionContextInterface, assignment *RoleAssignment) error {
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	assignment.UpdatedAt = txTimestamp
+	assignment.DocType = docTypeRole
+
+	key, err := roleKey(ctx, assignment.MSPID, assignment.ClientID)
+	if err != nil {
+		return err
+	}
+
+	return putRecord(ctx, key, assignment)
+}
+
+// hasRole - Check whether a role assignment contains a role
+func (a *RoleAssignment) hasRole(role string) bool {
+	for _, r := range a.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// callerHasRole - Check whether the submitting client holds a role
+func callerHasRole(ctx contractapi.TransactionContextInterface, role string) (bool, error) {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	assignment, err := getRoleAssignment(ctx, caller.MSPID, caller.ID)
+	if err != nil {
+		return false, err
+	}
+
+	return assignment.hasRole(role), nil
+}
+
+// assertRole - Reject the call unless the submitting client holds the role
+func assertRole(ctx contractapi.TransactionContextInterface, role string) error {
+	ok, err := callerHasRole(ctx, role)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("caller does not hold the %s role", role)
+	}
+	return nil
+}
+
+// isBootstrapAdmin - Whether the caller's certificate is an admin certificate of the zone's organization
+func isBootstrapAdmin(ctx contractapi.TransactionContextInterface, caller *callerIdentity) (bool, error) {
+	if caller.MSPID != bootstrapOperatorMSP {
+		return false, nil
+	}
+	cert, err := ctx.GetClientIdentity().GetX509Certificate()
+	if err != nil {
+		return false, fmt.Errorf("failed to read client certificate: %v", err)
+	}
+	for _, unit := range cert.Subject.OrganizationalUnit {
+		if unit == bootstrapOperatorOU {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// bootstrapOperator - Grant the operator role to the caller if no operator was ever assigned,
+// otherwise require the caller to be an operator
+// Only an admin of the zone's organization can claim the role on a fresh ledger, so the first
+// client to reach the chaincode cannot take it over.
+func bootstrapOperator(ctx contractapi.TransactionContextInterface) error {
+	markerKey, err := makeKey(ctx, docTypeConfig, configRoleBootstrap)
+	if err != nil {
+		return err
+	}
+	marker, err := ctx.GetStub().GetState(markerKey)
+	if err != nil {
+		return fmt.Errorf("failed to read role bootstrap marker: %v", err)
+	}
+	if marker != nil {
+		return assertRole(ctx, RoleOperator)
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	admin, err := isBootstrapAdmin(ctx, caller)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return fmt.Errorf("only a %s admin can become the first %s", bootstrapOperatorMSP, RoleOperator)
+	}
+
+	assignment, err := getRoleAssignment(ctx, caller.MSPID, caller.ID)
+	if err != nil {
+		return err
+	}
+	assignment.Roles = append(assignment.Roles, RoleOperator)
+	if err := putRoleAssignment(ctx, assignment); err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(markerKey, []byte(caller.MSPID))
+}
+
+// GrantRole - Grant a role to a client identity (operator only)
+func (c *EnergyTokenContract) GrantRole(ctx contractapi.TransactionContextInterface,
+	mspID string, clientID string, role string) error {
+
+	if err := assertRole(ctx, RoleOperator); err != nil {
+		return err
+	}
+	if !isValidRole(role) {
+		return fmt.Errorf("unknown role %s", role)
+	}
+	if mspID == "" || clientID == "" {
+		return fmt.Errorf("MSP ID and client ID are required")
+	}
+
+	assignment, err := getRoleAssignment(ctx, mspID, clientID)
+	if err != nil {
+		return err
+	}
+	if assignment.hasRole(role) {
+		return fmt.Errorf("identity already holds the %s role", role)
+	}
+
+	assignment.Roles = append(assignment.Roles, role)
+	return putRoleAssignment(ctx, assignment)
+}
+
+// RevokeRole - Revoke a role from a client identity (operator only)
+func (c *EnergyTokenContract) RevokeRole(ctx contractapi.TransactionContextInterface,
+	mspID string, clientID string, role string) error {
+
+	if err := assertRole(ctx, RoleOperator); err != nil {
+		return err
+	}
+
+	// Prevent the zone from losing its operator by accident
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if role == RoleOperator && caller.MSPID == mspID && caller.ID == clientID {
+		return fmt.Errorf("operators cannot revoke their own operator role")
+	}
+
+	assignment, err := getRoleAssignment(ctx, mspID, clientID)
+	if err != nil {
+		return err
+	}
+	if !assignment.hasRole(role) {
+		return fmt.Errorf("identity does not hold the %s role", role)
+	}
+
+	var remaining []string
+	for _, r := range assignment.Roles {
+		if r != role {
+			remaining = append(remaining, r)
+		}
+	}
+	assignment.Roles = remaining
+
+	return putRoleAssignment(ctx, assignment)
+}
+
+// GetRoles - Get the roles granted to a client identity
+func (c *EnergyTokenContract) GetRoles(ctx contractapi.TransactionContextInterface,
+	mspID string, clientID string) (*RoleAssignment, error) {
+
+	return getRoleAssignment(ctx, mspID, clientID)
+}
+
+// GetCallerRoles - Get the identity and roles of the submitting client
+// Clients use this to learn the client ID an operator must pass to GrantRole.
+func (c *EnergyTokenContract) GetCallerRoles(ctx contractapi.TransactionContextInterface) (*RoleAssignment, error) {
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return getRoleAssignment(ctx, caller.MSPID, caller.ID)
+}
+
+// SetFactoryOwner - Bind a factory to the identity that will operate it (operator only)
+// A factory with private details stays with the organization whose collection holds them.
+func (c *EnergyTokenContract) SetFactoryOwner(ctx contractapi.TransactionContextInterface,
+	factoryID string, ownerMSP string, ownerID string) error {
+
+	if err := assertRole(ctx, RoleOperator); err != nil {
+		return err
+	}
+	if ownerMSP == "" || ownerID == "" {
+		return fmt.Errorf("owner MSP ID and client ID are required")
+	}
+
+	factory, err := c.GetFactory(ctx, factoryID)
+	if err != nil {
+		return err
+	}
+
+	if factory.PrivateDetailsHash != "" && factory.OwnerMSP != "" && ownerMSP != factory.OwnerMSP {
+		return fmt.Errorf("factory %s keeps its private details in %s's collection and cannot move to %s",
+			factoryID, factory.OwnerMSP, ownerMSP)
+	}
+
+	factory.OwnerMSP = ownerMSP
+	factory.OwnerID = ownerID
+
+	return putFactory(ctx, factory)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+// identities - Number of client certificates created, which keeps their subjects distinct
+var identities int64
+
+// serializedIdentity - Creator bytes of a self-signed client certificate
+func serializedIdentity(t *testing.T, mspID string, units ...string) []byte {
+	t.Helper()
+	identities++
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(identities),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("client%d", identities), OrganizationalUnit: units},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator
+}
+
+func TestIsBootstrapAdmin(t *testing.T) {
+	tests := []struct {
+		name  string
+		msp   string
+		units []string
+		want  bool
+	}{
+		{name: "zone admin", msp: bootstrapOperatorMSP, units: []string{"admin"}, want: true},
+		{name: "zone client", msp: bootstrapOperatorMSP, units: []string{"client"}},
+		{name: "no organizational unit", msp: bootstrapOperatorMSP},
+		{name: "admin of another organization", msp: "Org2MSP", units: []string{"admin"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := shimtest.NewMockStub("energy", nil)
+			stub.Creator = serializedIdentity(t, tt.msp, tt.units...)
+			identity, err := cid.New(stub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := new(contractapi.TransactionContext)
+			ctx.SetStub(stub)
+			ctx.SetClientIdentity(identity)
+
+			caller, err := getCallerIdentity(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := isBootstrapAdmin(ctx, caller)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("isBootstrapAdmin = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
+)
+
+// Lot - Surplus energy sold in a sealed-bid commit-reveal auction
+type Lot struct {
+	DocType          string `json:"docType"`                                         // Record namespace ("lot")
+	ID               string `json:"id"`                                              // Lot identifier
+	SellerID         string `json:"sellerId"`                                        // Factory selling its surplus
+	EnergyAmount     Amount `json:"energyAmount"`                                    // Energy sold in Wh, reserved on the seller
+	ReservePrice     Amount `json:"reservePrice"`                                    // Lowest acceptable price per kWh in millimes
+	Pricing          string `json:"pricing"`                                         // Settlement rule (first-price, second-price)
+	Deposit          Amount `json:"deposit"`                                         // TEC each bidder escrows when committing in millimes
+	CommitDeadline   string `json:"commitDeadline"`                                  // Bids are committed strictly before this time (RFC 3339)
+	RevealDeadline   string `json:"revealDeadline"`                                  // Bids are revealed strictly before this time (RFC 3339)
+	Status           string `json:"status"`                                          // Lot status (open, sold, unsold)
+	WinnerID         string `json:"winnerId,omitempty" metadata:",optional"`         // Winning bidder
+	ClearingPrice    Amount `json:"clearingPrice,omitempty" metadata:",optional"`    // Price per kWh paid by the winner in millimes
+	TradeID          string `json:"tradeId,omitempty" metadata:",optional"`          // Trade settling the lot
+	ForfeitedDeposit Amount `json:"forfeitedDeposit,omitempty" metadata:",optional"` // Deposits of bidders who did not reveal, paid to the seller in millimes
+	CreatedAt        string `json:"createdAt"`                                       // Creation timestamp
+	SettledAt        string `json:"settledAt,omitempty" metadata:",optional"`        // Settlement timestamp
+	SchemaVersion    int    `json:"schemaVersion,omitempty" metadata:",optional"`    // Record layout version
+}
+
+// SealedBid - A bidder's commitment to a lot and, once revealed, its price
+type SealedBid struct {
+	DocType          string `json:"docType"`                                         // Record namespace ("sealedBid")
+	LotID            string `json:"lotId"`                                           // Lot bid on
+	BidderID         string `json:"bidderId"`                                        // Bidding factory
+	Commitment       string `json:"commitment"`                                      // Hex SHA-256 of the sealed bid
+	Deposit          Amount `json:"deposit"`                                         // Escrowed deposit in millimes
+	PricePerKwh      Amount `json:"pricePerKwh,omitempty" metadata:",optional"`      // Revealed price per kWh in millimes
+	ReservedCurrency Amount `json:"reservedCurrency,omitempty" metadata:",optional"` // TEC held for the revealed bid and deposit in millimes
+	Status           string `json:"status"`                                          // Bid status (committed, revealed, won, lost, forfeited)
+	CommittedAt      string `json:"committedAt"`                                     // Commitment timestamp
+	RevealedAt       string `json:"revealedAt,omitempty" metadata:",optional"`       // Reveal timestamp
+}
+
+// Lot statuses
+const (
+	LotStatusOpen   = "open"   // Taking commitments, then reveals
+	LotStatusSold   = "sold"   // Settled with a winner
+	LotStatusUnsold = "unsold" // Settled without a valid bid at or above the reserve price
+)
+
+// Lot pricing rules
+const (
+	LotPricingFirst  = "first-price"  // The winner pays its own bid
+	LotPricingSecond = "second-price" // The winner pays the best losing bid (Vickrey), at least the reserve price
+)
+
+// Sealed bid statuses
+const (
+	SealedBidCommitted = "committed" // Commitment recorded, deposit escrowed
+	SealedBidRevealed  = "revealed"  // Price disclosed and matched against the commitment
+	SealedBidWon       = "won"       // Won the lot and paid for it
+	SealedBidLost      = "lost"      // Revealed but did not win; deposit refunded
+	SealedBidForfeited = "forfeited" // Not revealed in time; deposit paid to the seller
+)
+
+// lotKey - Composite key of a lot
+func lotKey(ctx contractapi.TransactionContextInterface, lotID string) (string, error) {
+	return makeKey(ctx, docTypeLot, lotID)
+}
+
+// sealedBidKey - Composite key of a bidder's sealed bid on a lot
+func sealedBidKey(ctx contractapi.TransactionContextInterface, lotID string, bidderID string) (string, error) {
+	return makeKey(ctx, docTypeSealedBid, lotID, bidderID)
+}
+
+// putLot - Save a lot under its composite key
+func putLot(ctx contractapi.TransactionContextInterface, lot *Lot) error {
+	key, err := lotKey(ctx, lot.ID)
+	if err != nil {
+		return err
+	}
+	lot.DocType = docTypeLot
+	return putRecord(ctx, key, lot)
+}
+
+// putSealedBid - Save a sealed bid under its composite key
+func putSealedBid(ctx contractapi.TransactionContextInterface, bid *SealedBid) error {
+	key, err := sealedBidKey(ctx, bid.LotID, bid.BidderID)
+	if err != nil {
+		return err
+	}
+	bid.DocType = docTypeSealedBid
+	return putRecord(ctx, key, bid)
+}
+
+// getSealedBid - Read a bidder's sealed bid on a lot (nil if absent)
+func getSealedBid(ctx contractapi.TransactionContextInterface, lotID string, bidderID string) (*SealedBid, error) {
+	key, err := sealedBidKey(ctx, lotID, bidderID)
+	if err != nil {
+		return nil, err
+	}
+	bidJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sealed bid: %v", err)
+	}
+	if bidJSON == nil {
+		return nil, nil
+	}
+
+	var bid SealedBid
+	if err := json.Unmarshal(bidJSON, &bid); err != nil {
+		return nil, err
+	}
+	return &bid, nil
+}
+
+// bidCommitment - Hex SHA-256 commitment to a sealed bid
+// The lot and bidder are part of the preimage, so a commitment cannot be replayed by
+// another bidder or on another lot.
+func bidCommitment(lotID string, bidderID string, pricePerKwh Amount, salt string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%s", lotID, bidderID, pricePerKwh, salt)))
+	return hex.EncodeToString(sum[:])
+}
+
+// energySurplus - Available energy of a factory beyond its daily consumption (Wh, negative for a deficit)
+func energySurplus(factory *Factory) (Amount, error) {
+	return subAmount(factory.AvailableEnergy, factory.DailyConsumption)
+}
+
+// OpenLot - Put surplus energy up for a sealed-bid auction (factory owner only)
+// The lot may not exceed the factory's surplus as reported by GetEnergyStatus, and its
+// energy is reserved until settlement. Bidders commit until commitDeadline and reveal
+// until revealDeadline; pricing is first-price or second-price.
+func (c *EnergyTokenContract) OpenLot(ctx contractapi.TransactionContextInterface,
+	lotID string, factoryID string, energyAmount Amount, reservePrice Amount, pricing string,
+	deposit Amount, commitDeadline string, revealDeadline string) error {
+
+	if pricing != LotPricingFirst && pricing != LotPricingSecond {
+		return fmt.Errorf("pricing must be %s or %s", LotPricingFirst, LotPricingSecond)
+	}
+	if energyAmount <= 0 {
+		return fmt.Errorf("lot energy amount must be positive")
+	}
+	if reservePrice < 0 || deposit < 0 {
+		return fmt.Errorf("reserve price and deposit cannot be negative")
+	}
+
+	factory, err := c.GetFactory(ctx, factoryID)
+	if err != nil {
+		return err
+	}
+	if err := assertFactoryOwner(ctx, factory); err != nil {
+		return err
+	}
+	surplus, err := energySurplus(factory)
+	if err != nil {
+		return err
+	}
+	if energyAmount > surplus {
+		return fmt.Errorf("factory %s has a surplus of %d Wh, cannot auction %d Wh", factoryID, surplus, energyAmount)
+	}
+
+	key, err := lotKey(ctx, lotID)
+	if err != nil {
+		return err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read lot: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("lot %s already exists", lotID)
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	if commitDeadline, err = normalizeTimestamp("commit deadline", commitDeadline); err != nil {
+		return err
+	}
+	if revealDeadline, err = normalizeTimestamp("reveal deadline", revealDeadline); err != nil {
+		return err
+	}
+	if commitDeadline <= txTimestamp {
+		return fmt.Errorf("commit deadline %s is not in the future", commitDeadline)
+	}
+	if revealDeadline <= commitDeadline {
+		return fmt.Errorf("reveal deadline must be after the commit deadline")
+	}
+
+	if err := reserveFunds(factory, energyAmount, 0); err != nil {
+		return err
+	}
+
+	lot := Lot{
+		ID:             lotID,
+		SellerID:       factoryID,
+		EnergyAmount:   energyAmount,
+		ReservePrice:   reservePrice,
+		Pricing:        pricing,
+		Deposit:        deposit,
+		CommitDeadline: commitDeadline,
+		RevealDeadline: revealDeadline,
+		Status:         LotStatusOpen,
+		CreatedAt:      txTimestamp,
+		SchemaVersion:  currentSchemaVersion,
+	}
+	if err := putFactory(ctx, factory); err != nil {
+		return err
+	}
+	if err := putLot(ctx, &lot); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.LotOpened, events.LotOpenedEvent{
+		LotID:          lot.ID,
+		SellerID:       lot.SellerID,
+		EnergyAmount:   lot.EnergyAmount,
+		ReservePrice:   lot.ReservePrice,
+		Pricing:        lot.Pricing,
+		Deposit:        lot.Deposit,
+		CommitDeadline: lot.CommitDeadline,
+		RevealDeadline: lot.RevealDeadline,
+		Timestamp:      txTimestamp,
+	})
+}
+
+// GetLot - Get a sealed-bid lot
+func (c *EnergyTokenContract) GetLot(ctx contractapi.TransactionContextInterface, lotID string) (*Lot, error) {
+	key, err := lotKey(ctx, lotID)
+	if err != nil {
+		return nil, err
+	}
+	lotJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lot: %v", err)
+	}
+	if lotJSON == nil {
+		return nil, fmt.Errorf("lot %s does not exist", lotID)
+	}
+
+	var lot Lot
+	if err := json.Unmarshal(lotJSON, &lot); err != nil {
+		return nil, err
+	}
+	return &lot, nil
+}
+
+// GetLotBids - List the sealed bids on a lot
+// Prices are only visible once revealed; before that a bid shows its commitment alone.
+func (c *EnergyTokenContract) GetLotBids(ctx contractapi.TransactionContextInterface,
+	lotID string) ([]*SealedBid, error) {
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeSealedBid, []string{lotID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var bids []*SealedBid
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var bid SealedBid
+		if err := json.Unmarshal(queryResponse.Value, &bid); err != nil {
+			return nil, err
+		}
+		bids = append(bids, &bid)
+	}
+	return bids, nil
+}
+
+// CommitBid - Commit a sealed bid on a lot before the commit deadline (factory owner only)
+// commitment is the hex SHA-256 of "lotId|bidderId|pricePerKwh|salt"; the lot's deposit
+// is escrowed from the bidder and lost if the bid is not revealed in time.
+func (c *EnergyTokenContract) CommitBid(ctx contractapi.TransactionContextInterface,
+	lotID string, bidderID string, commitment string) error {
+
+	commitment = strings.ToLower(commitment)
+	if decoded, err := hex.DecodeString(commitment); err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("commitment must be a hex SHA-256 digest")
+	}
+
+	lot, err := c.GetLot(ctx, lotID)
+	if err != nil {
+		return err
+	}
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	if lot.Status != LotStatusOpen || txTimestamp >= lot.CommitDeadline {
+		return fmt.Errorf("lot %s no longer accepts bids", lotID)
+	}
+	if bidderID == lot.SellerID {
+		return fmt.Errorf("a factory cannot bid on its own lot")
+	}
+
+	bidder, err := c.GetFactory(ctx, bidderID)
+	if err != nil {
+		return err
+	}
+	if err := assertFactoryOwner(ctx, bidder); err != nil {
+		return err
+	}
+	existing, err := getSealedBid(ctx, lotID, bidderID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("factory %s already bid on lot %s", bidderID, lotID)
+	}
+
+	if err := reserveFunds(bidder, 0, lot.Deposit); err != nil {
+		return err
+	}
+
+	bid := SealedBid{
+		LotID:            lotID,
+		BidderID:         bidderID,
+		Commitment:       commitment,
+		Deposit:          lot.Deposit,
+		ReservedCurrency: lot.Deposit,
+		Status:           SealedBidCommitted,
+		CommittedAt:      txTimestamp,
+	}
+	if err := putFactory(ctx, bidder); err != nil {
+		return err
+	}
+	if err := putSealedBid(ctx, &bid); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.BidCommitted, events.BidCommittedEvent{
+		LotID:      lotID,
+		BidderID:   bidderID,
+		Commitment: commitment,
+		Deposit:    bid.Deposit,
+		Timestamp:  txTimestamp,
+	})
+}
+
+// RevealBid - Disclose a committed bid between the commit and reveal deadlines (factory owner only)
+// The price and salt must hash to the commitment. A revealed bid reserves the TEC needed to
+// pay for the whole lot at its price, on top of the deposit.
+func (c *EnergyTokenContract) RevealBid(ctx contractapi.TransactionContextInterface,
+	lotID string, bidderID string, pricePerKwh Amount, salt string) error {
+
+	lot, err := c.GetLot(ctx, lotID)
+	if err != nil {
+		return err
+	}
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	if lot.Status != LotStatusOpen || txTimestamp < lot.CommitDeadline || txTimestamp >= lot.RevealDeadline {
+		return fmt.Errorf("lot %s is not in its reveal phase", lotID)
+	}
+
+	bidder, err := c.GetFactory(ctx, bidderID)
+	if err != nil {
+		return err
+	}
+	if err := assertFactoryOwner(ctx, bidder); err != nil {
+		return err
+	}
+	bid, err := getSealedBid(ctx, lotID, bidderID)
+	if err != nil {
+		return err
+	}
+	if bid == nil {
+		return fmt.Errorf("factory %s has no bid on lot %s", bidderID, lotID)
+	}
+	if bid.Status != SealedBidCommitted {
+		return fmt.Errorf("bid of factory %s on lot %s is %s", bidderID, lotID, bid.Status)
+	}
+	if pricePerKwh < 0 {
+		return fmt.Errorf("price cannot be negative")
+	}
+	if bidCommitment(lotID, bidderID, pricePerKwh, salt) != bid.Commitment {
+		return fmt.Errorf("price and salt do not match the commitment")
+	}
+
+	value, err := tradeValue(lot.EnergyAmount, pricePerKwh)
+	if err != nil {
+		return err
+	}
+	if err := reserveFunds(bidder, 0, value); err != nil {
+		return err
+	}
+	if bid.ReservedCurrency, err = addAmount(bid.ReservedCurrency, value); err != nil {
+		return err
+	}
+
+	bid.PricePerKwh = pricePerKwh
+	bid.Status = SealedBidRevealed
+	bid.RevealedAt = txTimestamp
+	if err := putFactory(ctx, bidder); err != nil {
+		return err
+	}
+	if err := putSealedBid(ctx, bid); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.BidRevealed, events.BidRevealedEvent{
+		LotID:       lotID,
+		BidderID:    bidderID,
+		PricePerKwh: pricePerKwh,
+		Timestamp:   txTimestamp,
+	})
+}
+
+// SettleLot - Settle a lot after the reveal deadline
+// The highest revealed bid at or above the reserve price wins, ties going to the earlier
+// reveal and then the lower bidder ID. The winner pays its own price (first-price) or the
+// best losing price, at least the reserve price (second-price); the winning trade is held in
+// escrow until its delivery is confirmed. Losing bidders get their deposit back; deposits of
+// bidders who never revealed go to the seller. Settlement is deterministic, so any client
+// may run it.
+func (c *EnergyTokenContract) SettleLot(ctx contractapi.TransactionContextInterface, lotID string) (*Lot, error) {
+	lot, err := c.GetLot(ctx, lotID)
+	if err != nil {
+		return nil, err
+	}
+	if lot.Status != LotStatusOpen {
+		return nil, fmt.Errorf("lot %s is %s", lotID, lot.Status)
+	}
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if txTimestamp < lot.RevealDeadline {
+		return nil, fmt.Errorf("lot %s cannot be settled before its reveal deadline at %s", lotID, lot.RevealDeadline)
+	}
+
+	bids, err := c.GetLotBids(ctx, lotID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load each factory once; reads within a transaction do not see its own writes
+	seller, err := c.GetFactory(ctx, lot.SellerID)
+	if err != nil {
+		return nil, err
+	}
+	bidders := make(map[string]*Factory)
+	var valid []*SealedBid
+	for _, bid := range bids {
+		bidder, err := c.GetFactory(ctx, bid.BidderID)
+		if err != nil {
+			return nil, err
+		}
+		bidders[bid.BidderID] = bidder
+
+		// Every bid stops holding funds at settlement
+		if err := releaseFunds(bidder, 0, bid.ReservedCurrency); err != nil {
+			return nil, err
+		}
+		bid.ReservedCurrency = 0
+
+		if bid.Status == SealedBidCommitted {
+			// Not revealed: the deposit is paid to the seller
+			bid.Status = SealedBidForfeited
+			if err := settleTrade(seller, bidder, 0, bid.Deposit); err != nil {
+				return nil, err
+			}
+			if lot.ForfeitedDeposit, err = addAmount(lot.ForfeitedDeposit, bid.Deposit); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		bid.Status = SealedBidLost
+		if bid.PricePerKwh >= lot.ReservePrice {
+			valid = append(valid, bid)
+		}
+	}
+
+	sort.Slice(valid, func(i, j int) bool {
+		if valid[i].PricePerKwh != valid[j].PricePerKwh {
+			return valid[i].PricePerKwh > valid[j].PricePerKwh
+		}
+		if valid[i].RevealedAt != valid[j].RevealedAt {
+			return valid[i].RevealedAt < valid[j].RevealedAt
+		}
+		return valid[i].BidderID < valid[j].BidderID
+	})
+
+	// The lot's energy is either sold or returned to the seller
+	if err := releaseFunds(seller, lot.EnergyAmount, 0); err != nil {
+		return nil, err
+	}
+	lot.Status = LotStatusUnsold
+	lot.SettledAt = txTimestamp
+
+	var trade *EnergyTrade
+	if len(valid) > 0 {
+		winner := valid[0]
+		price := winner.PricePerKwh
+		if lot.Pricing == LotPricingSecond {
+			price = lot.ReservePrice
+			if len(valid) > 1 {
+				price = valid[1].PricePerKwh
+			}
+		}
+		totalPrice, err := tradeValue(lot.EnergyAmount, price)
+		if err != nil {
+			return nil, err
+		}
+
+		buyer := bidders[winner.BidderID]
+		trade = &EnergyTrade{
+			TradeID:       newTradeID(ctx, 1),
+			SellerID:      seller.ID,
+			BuyerID:       buyer.ID,
+			Amount:        lot.EnergyAmount,
+			PricePerUnit:  price,
+			TotalPrice:    totalPrice,
+			Timestamp:     txTimestamp,
+			EnergySource:  seller.EnergyType,
+			LotID:         lot.ID,
+			SchemaVersion: currentSchemaVersion,
+		}
+		if err := escrowTrade(seller, buyer, trade, txTimestamp); err != nil {
+			return nil, err
+		}
+
+		winner.Status = SealedBidWon
+		lot.Status = LotStatusSold
+		lot.WinnerID = buyer.ID
+		lot.ClearingPrice = price
+		lot.TradeID = trade.TradeID
+	}
+
+	if err := putFactory(ctx, seller); err != nil {
+		return nil, err
+	}
+	for _, bid := range bids {
+		if err := putFactory(ctx, bidders[bid.BidderID]); err != nil {
+			return nil, err
+		}
+		if err := putSealedBid(ctx, bid); err != nil {
+			return nil, err
+		}
+	}
+	if trade != nil {
+		if err := putTrade(ctx, trade); err != nil {
+			return nil, err
+		}
+	}
+	if err := putLot(ctx, lot); err != nil {
+		return nil, err
+	}
+
+	return lot, emitEvent(ctx, events.LotSettled, events.LotSettledEvent{
+		LotID:            lot.ID,
+		Status:           lot.Status,
+		WinnerID:         lot.WinnerID,
+		ClearingPrice:    lot.ClearingPrice,
+		TradeID:          lot.TradeID,
+		ForfeitedDeposit: lot.ForfeitedDeposit,
+		Timestamp:        txTimestamp,
+	})
+}
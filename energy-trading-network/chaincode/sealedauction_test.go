@@ -0,0 +1,147 @@
+package main
+
+import "testing"
+
+// revealedBid - Sealed bid revealed at a price, holding its deposit and bid value
+func revealedBid(t *testing.T, bidderID string, price Amount, revealedAt string) *SealedBid {
+	t.Helper()
+	value, err := tradeValue(10000, price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SealedBid{
+		LotID: "L1", BidderID: bidderID, Deposit: 100, PricePerKwh: price, ReservedCurrency: 100 + value,
+		Status: SealedBidRevealed, CommittedAt: "2026-01-01T09:00:00Z", RevealedAt: revealedAt,
+	}
+}
+
+func TestSettleLotPrice(t *testing.T) {
+	tests := []struct {
+		name       string
+		pricing    string
+		bids       []*SealedBid
+		wantWinner string
+		wantPrice  Amount
+	}{
+		{
+			name:    "second-price pays the runner-up bid",
+			pricing: LotPricingSecond,
+			bids: []*SealedBid{
+				revealedBid(t, "B1", 400, "2026-01-01T11:00:00Z"),
+				revealedBid(t, "B2", 300, "2026-01-01T11:00:00Z"),
+			},
+			wantWinner: "B1", wantPrice: 300,
+		},
+		{
+			name:       "second-price with one valid bid pays the reserve",
+			pricing:    LotPricingSecond,
+			bids:       []*SealedBid{revealedBid(t, "B1", 400, "2026-01-01T11:00:00Z")},
+			wantWinner: "B1", wantPrice: 200,
+		},
+		{
+			name:    "bids below the reserve do not set the price",
+			pricing: LotPricingSecond,
+			bids: []*SealedBid{
+				revealedBid(t, "B1", 400, "2026-01-01T11:00:00Z"),
+				revealedBid(t, "B2", 150, "2026-01-01T11:00:00Z"),
+			},
+			wantWinner: "B1", wantPrice: 200,
+		},
+		{
+			name:    "first-price pays the winning bid",
+			pricing: LotPricingFirst,
+			bids: []*SealedBid{
+				revealedBid(t, "B1", 400, "2026-01-01T11:00:00Z"),
+				revealedBid(t, "B2", 300, "2026-01-01T11:00:00Z"),
+			},
+			wantWinner: "B1", wantPrice: 400,
+		},
+		{
+			name:    "equal bids go to the earlier reveal",
+			pricing: LotPricingSecond,
+			bids: []*SealedBid{
+				revealedBid(t, "B1", 300, "2026-01-01T11:30:00Z"),
+				revealedBid(t, "B2", 300, "2026-01-01T11:00:00Z"),
+			},
+			wantWinner: "B2", wantPrice: 300,
+		},
+		{
+			name:    "no valid bid leaves the lot unsold",
+			pricing: LotPricingSecond,
+			bids:    []*SealedBid{revealedBid(t, "B1", 150, "2026-01-01T11:00:00Z")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newTestContext(t, "2026-01-01T12:00:00Z")
+			seedFactories(t, ctx, &Factory{ID: "F1", EnergyType: "solar", EnergyBalance: 20000, ReservedEnergy: 10000})
+			for _, bid := range tt.bids {
+				seedFactories(t, ctx, &Factory{ID: bid.BidderID, CurrencyBalance: 10000, ReservedCurrency: bid.ReservedCurrency})
+				if err := putSealedBid(ctx, bid); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := putLot(ctx, &Lot{
+				ID: "L1", SellerID: "F1", EnergyAmount: 10000, ReservePrice: 200, Pricing: tt.pricing, Deposit: 100,
+				CommitDeadline: "2026-01-01T10:00:00Z", RevealDeadline: "2026-01-01T12:00:00Z", Status: LotStatusOpen,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			commit(t, ctx)
+
+			c := new(EnergyTokenContract)
+			lot, err := c.SettleLot(ctx, "L1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			commit(t, ctx)
+
+			if tt.wantWinner == "" {
+				if lot.Status != LotStatusUnsold || lot.TradeID != "" {
+					t.Errorf("lot is %s with trade %q, want unsold without a trade", lot.Status, lot.TradeID)
+				}
+				seller, err := c.GetFactory(ctx, "F1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if seller.ReservedEnergy != 0 {
+					t.Errorf("seller still holds %d Wh", seller.ReservedEnergy)
+				}
+				return
+			}
+
+			if lot.Status != LotStatusSold || lot.WinnerID != tt.wantWinner || lot.ClearingPrice != tt.wantPrice {
+				t.Errorf("lot is %s to %q at %d, want sold to %q at %d",
+					lot.Status, lot.WinnerID, lot.ClearingPrice, tt.wantWinner, tt.wantPrice)
+			}
+			trade, err := c.GetTrade(ctx, lot.TradeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantTotal, err := tradeValue(10000, tt.wantPrice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if trade.Status != TradeStatusEscrowed || trade.BuyerID != tt.wantWinner || trade.TotalPrice != wantTotal {
+				t.Errorf("trade is %s to %q for %d millimes, want escrowed to %q for %d millimes",
+					trade.Status, trade.BuyerID, trade.TotalPrice, tt.wantWinner, wantTotal)
+			}
+
+			winner, err := c.GetFactory(ctx, tt.wantWinner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if winner.ReservedCurrency != wantTotal {
+				t.Errorf("winner holds %d millimes, want the trade value %d", winner.ReservedCurrency, wantTotal)
+			}
+			seller, err := c.GetFactory(ctx, "F1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seller.ReservedEnergy != 10000 {
+				t.Errorf("seller holds %d Wh, want the lot's 10000 Wh in escrow", seller.ReservedEnergy)
+			}
+		})
+	}
+}
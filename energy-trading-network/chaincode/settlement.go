@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// settleTrade - Move energy (Wh) from seller to buyer and its value (millimes) from buyer to seller
+// Only unreserved balances can be spent; callers release any reservation backing the trade first.
+// The factories are updated in memory and must be written by the caller.
+func settleTrade(seller *Factory, buyer *Factory, energy Amount, value Amount) error {
+	if spendableCurrency(buyer) < value {
+		return fmt.Errorf("buyer has insufficient unreserved %s balance: has %d millimes, needs %d millimes",
+			TokenSymbol, spendableCurrency(buyer), value)
+	}
+	if spendableEnergy(seller) < energy {
+		return fmt.Errorf("seller has insufficient unreserved energy balance: has %d Wh, needs %d Wh",
+			spendableEnergy(seller), energy)
+	}
+	return transferTrade(seller, buyer, energy, value)
+}
+
+// transferTrade - Move energy (Wh) from seller to buyer and its value (millimes) from buyer to seller
+// Balances are not checked: netting applies a whole batch first and then checks each
+// factory's net position.
+func transferTrade(seller *Factory, buyer *Factory, energy Amount, value Amount) error {
+	var err error
+	if seller.EnergyBalance, err = subAmount(seller.EnergyBalance, energy); err != nil {
+		return err
+	}
+	if buyer.EnergyBalance, err = addAmount(buyer.EnergyBalance, energy); err != nil {
+		return err
+	}
+	if buyer.CurrencyBalance, err = subAmount(buyer.CurrencyBalance, value); err != nil {
+		return err
+	}
+	if seller.CurrencyBalance, err = addAmount(seller.CurrencyBalance, value); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newTradeID - Deterministic ID of the n-th trade created by the current transaction
+func newTradeID(ctx contractapi.TransactionContextInterface, n int) string {
+	return fmt.Sprintf("%s-%d", ctx.GetStub().GetTxID(), n)
+}
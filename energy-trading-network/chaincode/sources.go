@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Energy sources
+const (
+	EnergySourceSolar    = "solar"    // Certified solar generation
+	EnergySourceWind     = "wind"     // Certified wind generation
+	EnergySourceFootstep = "footstep" // Kinetic floor tiles
+)
+
+// energySources - Every energy source a factory can generate from
+var energySources = []string{EnergySourceSolar, EnergySourceWind, EnergySourceFootstep}
+
+// SourceStats - Completed trade figures of one energy source
+type SourceStats struct {
+	EnergySource string `json:"energySource"` // Energy source of the sold energy
+	Trades       int    `json:"trades"`       // Number of completed trades
+	Volume       Amount `json:"volume"`       // Energy delivered in Wh
+	Value        Amount `json:"value"`        // TEC paid for the delivered energy in millimes
+	AveragePrice Amount `json:"averagePrice"` // Volume-weighted price per kWh in millimes
+	MinPrice     Amount `json:"minPrice"`     // Lowest price per kWh in millimes
+	MaxPrice     Amount `json:"maxPrice"`     // Highest price per kWh in millimes
+	Premium      Amount `json:"premium"`      // Average price above (or below, if negative) the market average
+}
+
+// MarketStats - Completed trade figures of the market and of each energy source
+type MarketStats struct {
+	From         string         `json:"from,omitempty" metadata:",optional"` // Start of the period (RFC 3339)
+	To           string         `json:"to,omitempty" metadata:",optional"`   // End of the period (RFC 3339)
+	Trades       int            `json:"trades"`                              // Number of completed trades
+	Volume       Amount         `json:"volume"`                              // Energy delivered in Wh
+	Value        Amount         `json:"value"`                               // TEC paid for the delivered energy in millimes
+	AveragePrice Amount         `json:"averagePrice"`                        // Volume-weighted price per kWh in millimes
+	Sources      []*SourceStats `json:"sources"`                             // Figures per energy source, by source name
+}
+
+// assertEnergySource - Reject an unknown energy source
+func assertEnergySource(source string) error {
+	for _, known := range energySources {
+		if source == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("energy source must be one of %s", strings.Join(energySources, ", "))
+}
+
+// parseAcceptedSources - Parse a comma-separated list of energy sources ("" for any source)
+// The result is sorted and free of duplicates.
+func parseAcceptedSources(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool)
+	var sources []string
+	for _, source := range strings.Split(value, ",") {
+		source = strings.TrimSpace(source)
+		if err := assertEnergySource(source); err != nil {
+			return nil, err
+		}
+		if !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+	return sources, nil
+}
+
+// offerSources - Validate the energy sources an offer accepts
+// Only buy offers may restrict the sources they take.
+func offerSources(offerType string, acceptedSources string) ([]string, error) {
+	sources, err := parseAcceptedSources(acceptedSources)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) > 0 && offerType != OfferTypeBuy {
+		return nil, fmt.Errorf("only buy offers can restrict energy sources")
+	}
+	return sources, nil
+}
+
+// sourceAccepted - Whether a buy offer takes energy from a source
+func sourceAccepted(buy *Offer, source string) bool {
+	if len(buy.AcceptedSources) == 0 {
+		return true
+	}
+	for _, accepted := range buy.AcceptedSources {
+		if accepted == source {
+			return true
+		}
+	}
+	return false
+}
+
+// sourcesMatch - Whether the buy side of two opposite orders accepts the sell side's source
+func sourcesMatch(order *Offer, resting *Offer) bool {
+	if order.OfferType == OfferTypeBuy {
+		return sourceAccepted(order, resting.EnergyType)
+	}
+	return sourceAccepted(resting, order.EnergyType)
+}
+
+// averagePrice - Volume-weighted price per kWh (millimes) of a value paid for a volume
+func averagePrice(value Amount, volume Amount) (Amount, error) {
+	if volume == 0 {
+		return 0, nil
+	}
+	return mulDivAmount(value, WhPerKwh, volume)
+}
+
+// deliveredVolume - Energy (Wh) a completed trade delivered and the value (millimes) paid for it
+// A trade confirmed with a shortfall was only paid for what was delivered; trades completed
+// before deliveries were confirmed delivered their full amount.
+func deliveredVolume(trade *EnergyTrade) (Amount, Amount, error) {
+	if trade.DeliveryConfirmation == nil || trade.DeliveredAmount == trade.Amount {
+		return trade.Amount, trade.TotalPrice, nil
+	}
+	value, err := deliveredValue(trade, trade.DeliveredAmount)
+	if err != nil {
+		return 0, 0, err
+	}
+	return trade.DeliveredAmount, value, nil
+}
+
+// GetMarketStats - Get prices and volumes of completed trades per energy source
+// The RFC 3339 bounds from and to are optional ("" to ignore) and apply to the trade
+// timestamp. Volumes and values count the energy delivered and the TEC paid for it, so a
+// trade that delivered nothing is left out. Each source's premium is its average price
+// minus the market average, which shows what buyers pay for certified green energy. Trades
+// recorded before sources were tracked count under the seller's current energy source.
+func (c *EnergyTokenContract) GetMarketStats(ctx contractapi.TransactionContextInterface,
+	from string, to string) (*MarketStats, error) {
+
+	timestamps, err := timeRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+	selector := map[string]interface{}{
+		"docType": docTypeTrade,
+		"status":  TradeStatusCompleted,
+	}
+	if timestamps != nil {
+		selector["timestamp"] = timestamps
+	}
+
+	query, err := buildQuery(selector, indexStatus)
+	if err != nil {
+		return nil, err
+	}
+	trades, err := queryTrades(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := MarketStats{From: from, To: to, Sources: []*SourceStats{}}
+	bySource := make(map[string]*SourceStats)
+	factories := make(map[string]*Factory)
+	for _, trade := range trades {
+		volume, value, err := deliveredVolume(trade)
+		if err != nil {
+			return nil, err
+		}
+		if volume == 0 {
+			continue
+		}
+
+		source := trade.EnergySource
+		if source == "" {
+			seller, ok := factories[trade.SellerID]
+			if !ok {
+				if seller, err = c.GetFactory(ctx, trade.SellerID); err != nil {
+					return nil, err
+				}
+				factories[trade.SellerID] = seller
+			}
+			source = seller.EnergyType
+		}
+
+		sourceStats, ok := bySource[source]
+		if !ok {
+			sourceStats = &SourceStats{EnergySource: source, MinPrice: trade.PricePerUnit, MaxPrice: trade.PricePerUnit}
+			bySource[source] = sourceStats
+			stats.Sources = append(stats.Sources, sourceStats)
+		}
+		sourceStats.Trades++
+		if sourceStats.Volume, err = addAmount(sourceStats.Volume, volume); err != nil {
+			return nil, err
+		}
+		if sourceStats.Value, err = addAmount(sourceStats.Value, value); err != nil {
+			return nil, err
+		}
+		if trade.PricePerUnit < sourceStats.MinPrice {
+			sourceStats.MinPrice = trade.PricePerUnit
+		}
+		if trade.PricePerUnit > sourceStats.MaxPrice {
+			sourceStats.MaxPrice = trade.PricePerUnit
+		}
+
+		stats.Trades++
+		if stats.Volume, err = addAmount(stats.Volume, volume); err != nil {
+			return nil, err
+		}
+		if stats.Value, err = addAmount(stats.Value, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if stats.AveragePrice, err = averagePrice(stats.Value, stats.Volume); err != nil {
+		return nil, err
+	}
+	for _, sourceStats := range stats.Sources {
+		if sourceStats.AveragePrice, err = averagePrice(sourceStats.Value, sourceStats.Volume); err != nil {
+			return nil, err
+		}
+		sourceStats.Premium = sourceStats.AveragePrice - stats.AveragePrice
+	}
+	sort.Slice(stats.Sources, func(i, j int) bool {
+		return stats.Sources[i].EnergySource < stats.Sources[j].EnergySource
+	})
+
+	return &stats, nil
+}
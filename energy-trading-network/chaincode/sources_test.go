@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestDeliveredVolume(t *testing.T) {
+	confirmed := &DeliveryConfirmation{Role: RoleMeter}
+	tests := []struct {
+		name       string
+		trade      *EnergyTrade
+		wantVolume Amount
+		wantValue  Amount
+	}{
+		{
+			name:       "delivered in full",
+			trade:      &EnergyTrade{Amount: 10000, PricePerUnit: 300, TotalPrice: 3000, DeliveredAmount: 10000, DeliveryConfirmation: confirmed},
+			wantVolume: 10000, wantValue: 3000,
+		},
+		{
+			name:       "shortfall pays for the delivered energy",
+			trade:      &EnergyTrade{Amount: 10000, PricePerUnit: 300, TotalPrice: 3000, DeliveredAmount: 6001, DeliveryConfirmation: confirmed},
+			wantVolume: 6001, wantValue: 1800,
+		},
+		{
+			name:  "nothing delivered",
+			trade: &EnergyTrade{Amount: 10000, PricePerUnit: 300, TotalPrice: 3000, DeliveryConfirmation: confirmed},
+		},
+		{
+			name:       "completed before deliveries were confirmed",
+			trade:      &EnergyTrade{Amount: 10000, PricePerUnit: 300, TotalPrice: 3000},
+			wantVolume: 10000, wantValue: 3000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume, value, err := deliveredVolume(tt.trade)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if volume != tt.wantVolume || value != tt.wantValue {
+				t.Errorf("deliveredVolume = %d Wh for %d millimes, want %d Wh for %d millimes",
+					volume, value, tt.wantVolume, tt.wantValue)
+			}
+		})
+	}
+}
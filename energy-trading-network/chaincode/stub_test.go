@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fabricStub - Mock stub that keeps a transaction's writes from its own reads, as a peer does
+// The shim's mock stub applies writes at once, which hides code that expects to read what
+// its transaction wrote. Here writes are buffered until commit, so reads and range scans
+// only see committed state.
+type fabricStub struct {
+	*shimtest.MockStub
+	writes map[string][]byte // Buffered writes by key (nil for a deletion)
+	tx     int               // Number of the current transaction
+}
+
+// PutState - Buffer a write until the transaction commits
+func (s *fabricStub) PutState(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("key must not be empty")
+	}
+	s.writes[key] = value
+	return nil
+}
+
+// DelState - Buffer a deletion until the transaction commits
+func (s *fabricStub) DelState(key string) error {
+	s.writes[key] = nil
+	return nil
+}
+
+// GetStateByRange - Range scan that, as on a peer, leaves composite keys out of an open range
+// The mock stub returns every key when both bounds are empty.
+func (s *fabricStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if startKey == "" {
+		startKey = "\x01"
+	}
+	if endKey == "" {
+		endKey = string(utf8.MaxRune)
+	}
+	return s.MockStub.GetStateByRange(startKey, endKey)
+}
+
+// newTestContext - Transaction context over an empty in-memory ledger, timestamped now (RFC 3339)
+func newTestContext(t *testing.T, now string) *contractapi.TransactionContext {
+	t.Helper()
+	stub := &fabricStub{MockStub: shimtest.NewMockStub("energy", nil), writes: make(map[string][]byte)}
+	ctx := new(contractapi.TransactionContext)
+	ctx.SetStub(stub)
+	startTransaction(t, ctx, now)
+	return ctx
+}
+
+// startTransaction - Start the next transaction at now (RFC 3339), after committing the
+// writes of the current one
+func startTransaction(t *testing.T, ctx *contractapi.TransactionContext, now string) {
+	t.Helper()
+	timestamp, err := time.Parse(time.RFC3339, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := ctx.GetStub().(*fabricStub)
+	keys := make([]string, 0, len(stub.writes))
+	for key := range stub.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var err error
+		if value := stub.writes[key]; value != nil {
+			err = stub.MockStub.PutState(key, value)
+		} else {
+			err = stub.MockStub.DelState(key)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stub.writes = make(map[string][]byte)
+
+	stub.tx++
+	stub.MockTransactionStart(fmt.Sprintf("tx%d", stub.tx))
+	stub.TxTimestamp = timestamppb.New(timestamp)
+}
+
+// commit - Commit the writes of the current transaction and start the next one at the same time
+func commit(t *testing.T, ctx *contractapi.TransactionContext) {
+	t.Helper()
+	timestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTransaction(t, ctx, timestamp)
+}
+
+// submitAs - Make creator (a serialized identity) the submitter of the current transaction
+func submitAs(t *testing.T, ctx *contractapi.TransactionContext, creator []byte) *callerIdentity {
+	t.Helper()
+	stub := ctx.GetStub().(*fabricStub)
+	stub.Creator = creator
+	identity, err := cid.New(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.SetClientIdentity(identity)
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caller
+}
+
+// seedFactories - Save factories to a test ledger in the current record layout and commit them
+func seedFactories(t *testing.T, ctx *contractapi.TransactionContext, factories ...*Factory) {
+	t.Helper()
+	for _, factory := range factories {
+		factory.SchemaVersion = currentSchemaVersion
+		if err := putFactory(ctx, factory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit(t, ctx)
+}
+
+// seedRoles - Grant roles to an identity on a test ledger and commit the assignment
+func seedRoles(t *testing.T, ctx *contractapi.TransactionContext, caller *callerIdentity, roles ...string) {
+	t.Helper()
+	if err := putRoleAssignment(ctx, &RoleAssignment{MSPID: caller.MSPID, ClientID: caller.ID, Roles: roles}); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, ctx)
+}
+
+// ownFactory - Make the client of a serialized identity the owner of a factory
+func ownFactory(t *testing.T, ctx *contractapi.TransactionContext, creator []byte, factory *Factory) *Factory {
+	t.Helper()
+	caller := submitAs(t, ctx, creator)
+	factory.OwnerMSP, factory.OwnerID = caller.MSPID, caller.ID
+	return factory
+}
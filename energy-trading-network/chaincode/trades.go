@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	"energy-token-chaincode/events"
+)
+
+// defaultTradeLifetime - How long a trade stays executable when no expiry is given
+const defaultTradeLifetime = 24 * time.Hour
+
+// Sides of a trade
+const (
+	TradeSideSeller = "seller"
+	TradeSideBuyer  = "buyer"
+)
+
+// TradeAcceptance - Identity that accepted a trade on behalf of one side
+type TradeAcceptance struct {
+	MSPID      string `json:"mspId"`      // MSP ID of the accepting identity
+	ClientID   string `json:"clientId"`   // Certificate ID of the accepting identity
+	AcceptedAt string `json:"acceptedAt"` // Acceptance timestamp
+}
+
+// tradeExpiry - Normalize the requested expiry of a trade created at now (both RFC 3339)
+// An empty expiry selects the default lifetime; an expiry in the past is rejected.
+func tradeExpiry(now string, expiresAt string) (string, error) {
+	created, err := time.Parse(time.RFC3339, now)
+	if err != nil {
+		return "", err
+	}
+	if expiresAt == "" {
+		return created.Add(defaultTradeLifetime).UTC().Format(time.RFC3339), nil
+	}
+
+	expiry, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return "", fmt.Errorf("expiry %s is not RFC 3339: %v", expiresAt, err)
+	}
+	if !expiry.After(created) {
+		return "", fmt.Errorf("expiry %s is not in the future", expiresAt)
+	}
+	return expiry.UTC().Format(time.RFC3339), nil
+}
+
+// acceptTradeSides - Record the caller's acceptance for each side of the trade it acts for
+// and has not accepted yet. Returns the sides accepted, seller first.
+func acceptTradeSides(ctx contractapi.TransactionContextInterface, trade *EnergyTrade,
+	seller *Factory, buyer *Factory, timestamp string) ([]string, error) {
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	acceptance := &TradeAcceptance{MSPID: caller.MSPID, ClientID: caller.ID, AcceptedAt: timestamp}
+
+	var sides []string
+	if trade.SellerAcceptance == nil {
+		ok, err := isFactoryOwner(ctx, seller)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			trade.SellerAcceptance = acceptance
+			sides = append(sides, TradeSideSeller)
+		}
+	}
+	if trade.BuyerAcceptance == nil {
+		ok, err := isFactoryOwner(ctx, buyer)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			trade.BuyerAcceptance = acceptance
+			sides = append(sides, TradeSideBuyer)
+		}
+	}
+
+	return sides, nil
+}
+
+// assertTradeExecutable - Reject settling a trade at now unless it is pending, unexpired and
+// accepted by both seller and buyer
+func assertTradeExecutable(trade *EnergyTrade, now string) error {
+	if trade.Status != TradeStatusPending {
+		return fmt.Errorf("trade %s is %s", trade.TradeID, trade.Status)
+	}
+	if trade.ExpiresAt != "" && now > trade.ExpiresAt {
+		return fmt.Errorf("trade %s expired at %s", trade.TradeID, trade.ExpiresAt)
+	}
+	if err := assertSlotOpen(now, trade.DeliveryStart); err != nil {
+		return err
+	}
+	if trade.SellerAcceptance == nil || trade.BuyerAcceptance == nil {
+		return fmt.Errorf("trade %s has not been accepted by both seller and buyer", trade.TradeID)
+	}
+	return nil
+}
+
+// assertTradeParty - Reject the call unless the submitting client owns the seller or the buyer
+func assertTradeParty(ctx contractapi.TransactionContextInterface, seller *Factory, buyer *Factory) error {
+	ok, err := isFactoryOwner(ctx, seller)
+	if err != nil || ok {
+		return err
+	}
+	return assertFactoryOwner(ctx, buyer)
+}
+
+// AcceptTrade - Accept a proposed trade on behalf of the counterparty
+// Once both seller and buyer have accepted, either of them can execute the trade.
+func (c *EnergyTokenContract) AcceptTrade(ctx contractapi.TransactionContextInterface, tradeID string) error {
+	trade, err := c.GetTrade(ctx, tradeID)
+	if err != nil {
+		return err
+	}
+	if trade.Status != TradeStatusPending {
+		return fmt.Errorf("trade %s is %s", tradeID, trade.Status)
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	if trade.ExpiresAt != "" && txTimestamp > trade.ExpiresAt {
+		return fmt.Errorf("trade %s expired at %s", tradeID, trade.ExpiresAt)
+	}
+	if err := assertSlotOpen(txTimestamp, trade.DeliveryStart); err != nil {
+		return err
+	}
+
+	seller, err := c.GetFactory(ctx, trade.SellerID)
+	if err != nil {
+		return err
+	}
+	buyer, err := c.GetFactory(ctx, trade.BuyerID)
+	if err != nil {
+		return err
+	}
+	if err := assertTradeParty(ctx, seller, buyer); err != nil {
+		return err
+	}
+
+	sides, err := acceptTradeSides(ctx, trade, seller, buyer, txTimestamp)
+	if err != nil {
+		return err
+	}
+	if len(sides) == 0 {
+		return fmt.Errorf("trade %s was already accepted for the sides the caller acts for", tradeID)
+	}
+
+	if err := putTrade(ctx, trade); err != nil {
+		return err
+	}
+
+	caller, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.TradeAccepted, events.TradeAcceptedEvent{
+		TradeID:   trade.TradeID,
+		Sides:     sides,
+		MSPID:     caller.MSPID,
+		ClientID:  caller.ID,
+		Accepted:  trade.SellerAcceptance != nil && trade.BuyerAcceptance != nil,
+		Timestamp: txTimestamp,
+	})
+}
+
+// closePendingTrade - Move a pending trade to a final status on behalf of one of its parties
+func (c *EnergyTokenContract) closePendingTrade(ctx contractapi.TransactionContextInterface,
+	tradeID string, partyID func(trade *EnergyTrade) string, status string) error {
+
+	trade, err := c.GetTrade(ctx, tradeID)
+	if err != nil {
+		return err
+	}
+	if trade.Status != TradeStatusPending {
+		return fmt.Errorf("trade %s is %s", tradeID, trade.Status)
+	}
+
+	party, err := c.GetFactory(ctx, partyID(trade))
+	if err != nil {
+		return err
+	}
+	if err := assertFactoryOwner(ctx, party); err != nil {
+		return err
+	}
+
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	previousStatus := trade.Status
+	trade.Status = status
+	if err := putTrade(ctx, trade); err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, events.TradeStatusChanged, events.TradeStatusChangedEvent{
+		TradeID:        trade.TradeID,
+		SellerID:       trade.SellerID,
+		BuyerID:        trade.BuyerID,
+		PreviousStatus: previousStatus,
+		Status:         trade.Status,
+		Timestamp:      txTimestamp,
+	})
+}
+
+// CancelTrade - Withdraw a pending trade (seller only)
+func (c *EnergyTokenContract) CancelTrade(ctx contractapi.TransactionContextInterface, tradeID string) error {
+	return c.closePendingTrade(ctx, tradeID, func(trade *EnergyTrade) string {
+		return trade.SellerID
+	}, TradeStatusCancelled)
+}
+
+// RejectTrade - Decline a pending trade (buyer only)
+func (c *EnergyTokenContract) RejectTrade(ctx contractapi.TransactionContextInterface, tradeID string) error {
+	return c.closePendingTrade(ctx, tradeID, func(trade *EnergyTrade) string {
+		return trade.BuyerID
+	}, TradeStatusRejected)
+}
+
+// ExpireTrades - Mark every pending trade whose expiry has passed as expired
+// Expiry is judged against the transaction timestamp, so any client may run the sweep.
+// Returns the IDs of the trades that were expired.
+func (c *EnergyTokenContract) ExpireTrades(ctx contractapi.TransactionContextInterface) ([]string, error) {
+	txTimestamp, err := getTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := buildQuery(map[string]interface{}{
+		"docType":   docTypeTrade,
+		"status":    TradeStatusPending,
+		"expiresAt": map[string]interface{}{"$lt": txTimestamp},
+	}, indexStatus)
+	if err != nil {
+		return nil, err
+	}
+	stale, err := queryTrades(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []string
+	for _, candidate := range stale {
+		// Re-read each trade so it is part of the read set and checked at commit
+		trade, err := c.GetTrade(ctx, candidate.TradeID)
+		if err != nil {
+			return nil, err
+		}
+		if trade.Status != TradeStatusPending || trade.ExpiresAt == "" || trade.ExpiresAt >= txTimestamp {
+			continue
+		}
+
+		trade.Status = TradeStatusExpired
+		if err := putTrade(ctx, trade); err != nil {
+			return nil, err
+		}
+		expired = append(expired, trade.TradeID)
+	}
+
+	if len(expired) == 0 {
+		return expired, nil
+	}
+
+	return expired, emitEvent(ctx, events.TradesExpired, events.TradesExpiredEvent{
+		TradeIDs:  expired,
+		Timestamp: txTimestamp,
+	})
+}
@@ -121,6 +121,7 @@ peer lifecycle chaincode approveformyorg \
   --version ${CHAINCODE_VERSION} \
   --package-id ${PACKAGE_ID} \
   --sequence ${CHAINCODE_SEQUENCE} \
+  --collections-config ${CHAINCODE_PATH}/collections_config.json \
   --tls \
   --cafile /mnt/c/premieretsyp/fabric-samples/test-network/organizations/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem
 
@@ -159,6 +160,7 @@ peer lifecycle chaincode approveformyorg \
   --version ${CHAINCODE_VERSION} \
   --package-id ${PACKAGE_ID} \
   --sequence ${CHAINCODE_SEQUENCE} \
+  --collections-config ${CHAINCODE_PATH}/collections_config.json \
   --tls \
   --cafile /mnt/c/premieretsyp/fabric-samples/test-network/organizations/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem
 
@@ -179,6 +181,7 @@ peer lifecycle chaincode checkcommitreadiness \
   --name ${CHAINCODE_NAME} \
   --version ${CHAINCODE_VERSION} \
   --sequence ${CHAINCODE_SEQUENCE} \
+  --collections-config ${CHAINCODE_PATH}/collections_config.json \
   --tls \
   --cafile /mnt/c/premieretsyp/fabric-samples/test-network/organizations/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem \
   --output json
@@ -195,6 +198,7 @@ peer lifecycle chaincode commit \
   --name ${CHAINCODE_NAME} \
   --version ${CHAINCODE_VERSION} \
   --sequence ${CHAINCODE_SEQUENCE} \
+  --collections-config ${CHAINCODE_PATH}/collections_config.json \
   --tls \
   --cafile /mnt/c/premieretsyp/fabric-samples/test-network/organizations/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem \
   --peerAddresses localhost:7051 \
@@ -227,7 +231,7 @@ peer chaincode invoke \
   -c '{"function":"InitLedger","Args":[]}'
 
 if [ $? -eq 0 ]; then
-  printSuccess "Ledger initialized with sample factories"
+  printSuccess "Ledger initialized with sample factories (Org1 admin is the zone operator)"
 else
   printError "Failed to initialize ledger"
   exit 1
@@ -240,11 +244,13 @@ echo "  - InitLedger: Initialize with sample factories"
 echo "  - RegisterFactory: Register a new factory"
 echo "  - MintEnergyTokens: Generate energy tokens"
 echo "  - TransferEnergy: Transfer tokens between factories"
-echo "  - CreateEnergyTrade: Create a trade transaction"
+echo "  - CreateEnergyTrade / AcceptTrade: Propose and accept a trade"
 echo "  - ExecuteTrade: Complete a trade"
+echo "  - CancelTrade / RejectTrade / ExpireTrades: Close pending trades"
 echo "  - GetFactory: Query factory information"
 echo "  - GetEnergyBalance: Get factory's token balance"
 echo "  - GetAllFactories: List all factories"
+echo "  - GrantRole / RevokeRole: Manage operator, oracle, regulator and auditor roles"
 echo ""
 echo "Example query:"
 echo 'peer chaincode query -C energychannel -n energytoken -c '"'"'{"Args":["GetAllFactories"]}'"'"